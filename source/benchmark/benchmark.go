@@ -3,16 +3,26 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
 	"os/exec"
+	"proj2/lock"
+	"proj2/queue"
 	"sort"
 	"strconv"
 	"time"
 )
 
-const usage = "Usage: benchmark version testSize threads\n" +
+const usage = "Usage: benchmark [-feed=strategy] [-lock=strategy] [-readers=n] [-stats] [-queuetype=strategy] [-steal] [-batch=size] version testSize threads\n" +
+	" -feed = the feed implementation passed to twitter.go (default: coarse)\n" +
+	" -lock = the r/w lock passed to twitter.go (default: cond)\n" +
+	" -readers = the reader cap of the r/w lock passed to twitter.go (default: 0 = 32 readers)\n" +
+	" -stats = pass -lockstats to twitter.go and print the contention statistics of the feed locks and the queue to stderr\n" +
+	" -queuetype = the queue of requests passed to twitter.go (default: lockfree)\n" +
+	" -steal = pass -steal to twitter.go: per-consumer deques with work stealing\n" +
+	" -batch = the maximum number of requests a consumer takes at once, passed to twitter.go (default: 0)\n" +
 	" version =  (p) - parallel version, (s) sequential version \n" +
 	" testSize = the test size \n" +
 	"\t xsmall = Run the extra small test size\n" +
@@ -42,6 +52,10 @@ type _TestFeedRequest struct {
 	Command string `json:"command"`
 	Id      int64  `json:"id"`
 }
+type _TestStatsRequest struct {
+	Command string `json:"command"`
+	Id      int64  `json:"id"`
+}
 type _TestDoneRequest struct {
 	Command string `json:"command"`
 }
@@ -56,6 +70,12 @@ type _TestFeedResponse struct {
 	Feed []_TestPostData `json:"feed"`
 }
 
+type _TestStatsResponse struct {
+	Id    int64              `json:"id"`
+	Locks lock.StatsSnapshot `json:"locks"`
+	Queue *queue.Stats       `json:"queue"`
+}
+
 type _TestPostData struct {
 	Body      string  `json:"body"`
 	Timestamp float64 `json:"timestamp"`
@@ -153,11 +173,25 @@ func runAllRequests(threads, version string, postInfo []int) {
 	defer cancel()
 	var cmd *exec.Cmd
 
+	// the strategies are passed as flags to twitter.go, so no recompiling is needed to sweep them
+	args := []string{"run", "proj2/twitter", "-feed=" + *feedStrategy, "-lock=" + *lockStrategy,
+		"-queuetype=" + *queueStrategy}
+	if *workStealing {
+		args = append(args, "-steal")
+	}
+	if *lockStats {
+		args = append(args, "-lockstats")
+	}
+	if *maxReaders != 0 {
+		args = append(args, "-readers="+strconv.Itoa(*maxReaders))
+	}
+	if *batchSize > 0 {
+		args = append(args, "-batch="+strconv.Itoa(*batchSize))
+	}
 	if version == "p" {
-		cmd = exec.CommandContext(ctx, "go", "run", "proj2/twitter", threads)
-	} else {
-		cmd = exec.CommandContext(ctx, "go", "run", "proj2/twitter")
+		args = append(args, threads)
 	}
+	cmd = exec.CommandContext(ctx, "go", args...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		fmt.Errorf("<runTwitter>: error in getting stdout pipe: Contact Professor Samuels, if see this message.")
@@ -210,7 +244,10 @@ func runAllRequests(threads, version string, postInfo []int) {
 	/**** Fourth Wave: check the feed is empty **/
 	wave4Done := make(chan bool)
 	order2 := []int{}
-	requestFeed, responseFeedExpected, _ := createFeed(order2, removeIdx2)
+	requestFeed, responseFeedExpected, feedIdx := createFeed(order2, removeIdx2)
+
+	/**** With -stats: ask for the lock statistics before shutting down **/
+	requestStats := _TestStatsRequest{"STATS", int64(feedIdx)}
 
 	go func() {
 		encoder := json.NewEncoder(stdin)
@@ -258,6 +295,12 @@ func runAllRequests(threads, version string, postInfo []int) {
 			os.Exit(1)
 		}
 		<-wave4Done
+		if *lockStats {
+			if err := encoder.Encode(&requestStats); err != nil {
+				fmt.Fprintf(os.Stderr, "<AllRequests> stats cmd.encode error: %v\n", err)
+				os.Exit(1)
+			}
+		}
 		if err := encoder.Encode(&doneRequest); err != nil {
 			fmt.Errorf("<AllRequests> done cmd.encode error in executing Test: Contact Professor Samuels, if see this message.")
 			os.Exit(1)
@@ -359,6 +402,14 @@ func runAllRequests(threads, version string, postInfo []int) {
 			fmt.Errorf("Did not receive the right amount of Add&Feed acknowledgements. Got:%v, Expected:%v", count, (len(postInfo)*2+(len(postInfo)/2)*3)+1)
 			os.Exit(1)
 		}
+		if *lockStats {
+			var responseStats _TestStatsResponse
+			if err := decoder.Decode(&responseStats); err != nil {
+				fmt.Fprintf(os.Stderr, "no lock statistics: %v (are the feed locks instrumented?)\n", err)
+			} else {
+				printStats(responseStats.Locks, responseStats.Queue)
+			}
+		}
 		outDone <- true
 	}()
 	<-inDone
@@ -445,16 +496,63 @@ func AllRequestsXtraLarge(threads string, version string) {
 	runAllRequests(threads, version, posts)
 }
 
+// printStats prints the contention statistics of the feed locks and the counters of the queue of tasks, if any,
+// to stderr, so that stdout only has the elapsed time
+func printStats(s lock.StatsSnapshot, q *queue.Stats) {
+	fmt.Fprintf(os.Stderr, "lock stats: %d reads, %d writes, at most %d readers at once\n",
+		s.ReadAcquisitions, s.WriteAcquisitions, s.MaxConcurrentReaders)
+	if q != nil {
+		fmt.Fprintf(os.Stderr, "queue stats: %d enqueue retries, %d dequeue retries, %d consumer waits\n",
+			q.EnqueueRetries, q.DequeueRetries, q.Waits)
+	}
+	for _, side := range []struct {
+		name         string
+		acquisitions uint64
+		wait         lock.WaitHistogram
+		holdNs       int64
+	}{{"read", s.ReadAcquisitions, s.ReadWait, s.ReadHoldNs}, {"write", s.WriteAcquisitions, s.WriteWait, s.WriteHoldNs}} {
+		if side.acquisitions == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "  %s: mean wait %v, mean hold %v, waits:", side.name,
+			time.Duration(side.wait.TotalNs/int64(side.acquisitions)), time.Duration(side.holdNs/int64(side.acquisitions)))
+		// bucket i counts the waits shorter than 2^i µs; see lock.WaitBuckets
+		for i, count := range side.wait.Buckets {
+			if count == 0 {
+				continue
+			}
+			if i == lock.WaitBuckets-1 {
+				fmt.Fprintf(os.Stderr, " >=%v:%d", time.Duration(1<<(i-1))*time.Microsecond, count)
+			} else {
+				fmt.Fprintf(os.Stderr, " <%v:%d", time.Duration(1<<i)*time.Microsecond, count)
+			}
+		}
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// feed, lock and queue strategies of the twitter server being benchmarked
+var feedStrategy = flag.String("feed", "coarse", "feed implementation")
+var lockStrategy = flag.String("lock", "cond", "r/w lock of the lock-based feeds")
+var maxReaders = flag.Int("readers", 0, "reader cap of the r/w lock")
+var queueStrategy = flag.String("queuetype", "lockfree", "queue of requests")
+var workStealing = flag.Bool("steal", false, "per-consumer deques with work stealing")
+var lockStats = flag.Bool("stats", false, "print the contention statistics of the feed locks")
+var batchSize = flag.Int("batch", 0, "maximum number of requests a consumer takes at once")
+
 func main() {
+	flag.Usage = func() { fmt.Print(usage) }
+	flag.Parse()
+	args := flag.Args()
 
-	if len(os.Args) < 3 {
+	if len(args) < 2 {
 		fmt.Println(usage)
 	} else {
-		version := os.Args[1]
-		test := os.Args[2]
+		version := args[0]
+		test := args[1]
 		var threads string
 		if version == "p" {
-			threads = os.Args[3]
+			threads = args[2]
 		}
 
 		start := time.Now()
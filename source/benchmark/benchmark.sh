@@ -20,13 +20,30 @@ go mod tidy
 
 testSizes=("xsmall" "small" "medium" "large" "xlarge") 
 n_threads=(1 2 4 6 8 10 12)   
-repeat=5       # number of times to repeat each combination of testSize x n_thread
+feeds=("coarse")   # feed implementations to sweep (coarse, optimistic, upgradable, skiplist, fine, lazy, lockfree)
+locks=("cond")     # r/w locks to sweep (cond, reader, fair, faster, atomic, sync)
+repeat=5       # number of times to repeat each combination of feed x lock x testSize x n_thread
 resultsFile="./benchmark/results.txt" # file to output resulting elapsed times
+lockStats=false    # if true, also record the contention statistics of the feed locks of every run
+statsFile="./benchmark/lockstats.txt" # file to output the lock statistics
 
 # clean results file
 echo "" > $resultsFile
+statsFlag=""
+statsOut="/dev/stderr"
+if [ "$lockStats" == "true" ]
+then
+    statsFlag="-stats"
+    statsOut=$statsFile
+    echo "" > $statsFile
+fi
 
-# loop through all test sizes and threads
+# loop through all feeds, locks, test sizes and threads
+# obs: the plotter averages every line of the results file; sweep one feed x lock combination at a time to plot it
+for feed in ${feeds[@]}
+do
+for lock in ${locks[@]}
+do
 for testSize in ${testSizes[@]}
 do
     for n_thread in ${n_threads[@]}
@@ -41,11 +58,16 @@ do
         # run the benchmark `repeat` times
         for (( i=0; i<$repeat; i++ ))
         do
+            # the lock statistics go to stderr, so that the output is only the elapsed time
+            if [ "$lockStats" == "true" ]
+            then
+                echo "feed=$feed lock=$lock testSize=$testSize threads=$n_thread" >> $statsFile
+            fi
             if [ "$n_thread" == "1" ]
             then
-                output=$(go run ./benchmark/benchmark.go "s" "$testSize")
+                output=$(go run ./benchmark/benchmark.go -feed="$feed" -lock="$lock" $statsFlag "s" "$testSize" 2>>$statsOut)
             else
-                output=$(go run ./benchmark/benchmark.go "p" "$testSize" "$n_thread")
+                output=$(go run ./benchmark/benchmark.go -feed="$feed" -lock="$lock" $statsFlag "p" "$testSize" "$n_thread" 2>>$statsOut)
             fi
 
             if [ $? -ne 0 ]
@@ -54,9 +76,11 @@ do
                 exit 1
             fi
 
-            echo "{\"version\":\"$version\", \"testSize\":\"$testSize\", \"threads\":$n_thread, \"time\":$output}" >> $resultsFile
+            echo "{\"version\":\"$version\", \"feed\":\"$feed\", \"lock\":\"$lock\", \"testSize\":\"$testSize\", \"threads\":$n_thread, \"time\":$output}" >> $resultsFile
         done
     done
 done
+done
+done
 
 go run ./plotter/plot.go
\ No newline at end of file
@@ -0,0 +1,38 @@
+// Batches of mutations of a feed.
+// A consumer executing many "ADD"s on the same feed takes the feed's write lock once per post. ApplyBatch
+// applies a sequence of adds and removes at once, so the lock-based feeds (`feed` and `optFeed`) take their
+// write lock once per batch. The feeds without a feed-wide lock apply the operations one by one.
+// Obs: the operations of a batch are applied in order, so an add followed by a remove of the same post
+// leaves the feed without the post.
+
+package feed
+
+// OpKind is the kind of mutation of an Op
+type OpKind int
+
+const (
+	AddOp 		OpKind = iota 	// add the post (Body, Timestamp)
+	RemoveOp 					// remove the post with Timestamp
+)
+
+// Op represents a mutation of a feed, applied as part of a batch
+type Op struct {
+	Kind 		OpKind
+	Body 		string 		// the text of the post; AddOp only
+	Timestamp 	float64 	// the timestamp of the post
+}
+
+// applyEach applies the operations of `ops` to `f` one by one, returning the result of each:
+// true for an add, whether the post was removed for a remove
+func applyEach(f Feed, ops []Op) []bool {
+	results := make([]bool, len(ops))
+	for i, op := range ops {
+		if op.Kind == RemoveOp {
+			results[i] = f.Remove(op.Timestamp)
+		} else {
+			f.Add(op.Body, op.Timestamp)
+			results[i] = true
+		}
+	}
+	return results
+}
@@ -4,25 +4,34 @@
 package feed
 
 import (
+	"context"
 	"proj2/lock"
 )
 
 //Feed represents a user's twitter feed
 // @Add: inserts a new post to the feed
-// @Remove: deletes the post with the given timestamp
+// Obs: posts with the same timestamp coexist in every feed
+// @Remove: deletes a post with the given timestamp
 // @Contains: determines whether a post with the given timestamp is inside a feed
 // @ReturnFeed: returns the whole feed as a slice of Post structs
+// @ReturnRange: returns at most `limit` posts with newerThan < timestamp < olderThan
+// @Len: returns the number of posts in the feed
+// @ApplyBatch: applies a batch of adds and removes in order; returns the result of each (see batch.go)
 type Feed interface {
 	Add(body string, timestamp float64)
 	Remove(timestamp float64) bool
 	Contains(timestamp float64) bool
 	ReturnFeed() []Post
+	ReturnRange(newerThan float64, olderThan float64, limit int) []Post
+	Len() int
+	ApplyBatch(ops []Op) []bool
 }
 
 //feed is the internal representation of a user's twitter feed (hidden from outside packages)
 type feed struct {
 	start 		*post 			// a pointer to the beginning post
 	rwLock 		lock.RWLock		// a read-write lock
+	size 		int 			// the number of posts in the feed
 }
 
 //post is the internal representation of a post on a user's twitter feed (hidden from outside packages)
@@ -44,15 +53,18 @@ type Post struct {
 
 //NewPost creates and returns a new post value given its body and timestamp
 func newPost(body string, timestamp float64, next *post) *post {
-	p := &post{body, timestamp, next, nil, false}
+	p := &post{body: body, timestamp: timestamp, next: next}
 	p.content = &Post{Body: &p.body, Timestamp: &p.timestamp}
 	return p
 }
 
 //NewFeed creates a empty user feed and returns a pointer to it
 func NewFeed() Feed {
-	rwLock := lock.NewRWLock()
-	// rwLock := lock.NewRWLockFaster()
+	return NewFeedWithLock(lock.NewRWLock())
+}
+
+//NewFeedWithLock creates a empty user feed that synchronizes with `rwLock` and returns a pointer to it
+func NewFeedWithLock(rwLock lock.RWLock) Feed {
 	return &feed{start: nil, rwLock: rwLock}
 }
 
@@ -72,13 +84,19 @@ func (f *feed) Add(body string, timestamp float64) {
 
 	f.rwLock.Lock()
 	defer f.rwLock.Unlock()
+	f.add(newPost)
+}
 
+// add inserts `newPost` to the feed. Must be called with the writer lock held.
+func (f *feed) add(newPost *post) {
+	timestamp := newPost.timestamp
 	// iterates over all feed; if timestamp in the middle add post to the middle of the feed
 	curPost := f.start
 	// if feed is empty or post is the most recent, add post to the beginning of the feed
 	if curPost == nil || timestamp > curPost.timestamp {
 		newPost.next = curPost
 		f.start = newPost	
+		f.size++
 		return
 	// else, traverse the feed until find the correct position to insert the post	
 	} else {
@@ -87,6 +105,7 @@ func (f *feed) Add(body string, timestamp float64) {
 		}
 		newPost.next = curPost.next
 		curPost.next = newPost
+		f.size++
 		return
 	}
 }
@@ -100,8 +119,11 @@ func (f *feed) Remove(timestamp float64) bool {
 	// see obs in Add() for more details
 	f.rwLock.Lock()
 	defer f.rwLock.Unlock()
+	return f.remove(timestamp)
+}
 
-	
+// remove deletes the post with the given timestamp, if any. Must be called with the writer lock held.
+func (f *feed) remove(timestamp float64) bool {
 	// iterate over all feed; if timestamp in the middle remove post and update pointers
 	// such that: old feed: a -> b -> c ===> new feed: a -> c	
 	curPost := f.start
@@ -112,6 +134,7 @@ func (f *feed) Remove(timestamp float64) bool {
 	// if post to be removed is the most recent, remove it and update feed
 	} else if timestamp == curPost.timestamp{
 		f.start = curPost.next
+		f.size--
 		return true
 	// else, traverse the feed until find the correct position to remove the post
 	} else {
@@ -125,6 +148,7 @@ func (f *feed) Remove(timestamp float64) bool {
 		// else, remove post and update pointers (e.g. old feed: a -> b -> c ===> new feed: a -> c)
 		} else {
 			curPost.next = curPost.next.next
+			f.size--
 			return true
 		}
 	}
@@ -165,4 +189,62 @@ func (f *feed) ReturnFeed() []Post {
 		curPost = curPost.next
 	}
 	return feed
-}
\ No newline at end of file
+}
+
+// ReturnRange returns the posts whose timestamp is strictly between `newerThan` and `olderThan`,
+// from the most recent to the least recent. At most `limit` posts are returned; `limit` <= 0 means no limit.
+// Use math.Inf(-1) and math.Inf(1) to leave a bound open.
+func (f *feed) ReturnRange(newerThan float64, olderThan float64, limit int) []Post {
+	f.rwLock.RLock()
+	defer f.rwLock.RUnlock()
+	return f.returnRange(newerThan, olderThan, limit)
+}
+
+// returnRangeCtx is like ReturnRange, but gives up waiting for the reader lock once `ctx` is done; see timed.go
+func (f *feed) returnRangeCtx(ctx context.Context, newerThan float64, olderThan float64, limit int) ([]Post, error) {
+	if err := rLockCtx(ctx, f.rwLock); err != nil {
+		return nil, err
+	}
+	defer f.rwLock.RUnlock()
+	return f.returnRange(newerThan, olderThan, limit), nil
+}
+
+// returnRange returns the posts of ReturnRange. Must be called with the reader lock held.
+func (f *feed) returnRange(newerThan float64, olderThan float64, limit int) []Post {
+	var feed []Post
+
+	// skip posts that are too recent
+	curPost := f.start
+	for curPost != nil && curPost.timestamp >= olderThan {
+		curPost = curPost.next
+	}
+	// collect posts until the range or the limit is exhausted
+	for curPost != nil && curPost.timestamp > newerThan && (limit <= 0 || len(feed) < limit) {
+		feed = append(feed, *curPost.content)
+		curPost = curPost.next
+	}
+	return feed
+}
+
+// Len returns the number of posts in the feed
+func (f *feed) Len() int {
+	f.rwLock.RLock()
+	defer f.rwLock.RUnlock()
+	return f.size
+}
+
+// ApplyBatch applies the adds and removes of `ops` in order under a single writer lock
+func (f *feed) ApplyBatch(ops []Op) []bool {
+	results := make([]bool, len(ops))
+	f.rwLock.Lock()
+	defer f.rwLock.Unlock()
+	for i, op := range ops {
+		if op.Kind == RemoveOp {
+			results[i] = f.remove(op.Timestamp)
+		} else {
+			f.add(newPost(op.Body, op.Timestamp, nil))
+			results[i] = true
+		}
+	}
+	return results
+}
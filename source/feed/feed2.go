@@ -6,6 +6,7 @@
 package feed
 
 import (
+	"context"
 	"proj2/lock"
 )
 
@@ -14,12 +15,16 @@ import (
 type optFeed struct {
 	start 		*post 			// a pointer to the beginning post
 	rwLock 		lock.RWLock		// a read-write lock
+	size 		int 			// the number of posts in the feed
 }
 
-//NewFeed creates a empty user feed and returns a pointer to it
+//NewOptFeed creates a empty user feed and returns a pointer to it
 func NewOptFeed() Feed {
-	rwLock := lock.NewRWLock()
-	// rwLock := lock.NewRWLockFaster()
+	return NewOptFeedWithLock(lock.NewRWLock())
+}
+
+//NewOptFeedWithLock creates a empty user feed that synchronizes with `rwLock` and returns a pointer to it
+func NewOptFeedWithLock(rwLock lock.RWLock) Feed {
 	sentinelPost := newPost("", -1, nil)
 	return &optFeed{start: sentinelPost, rwLock: rwLock}
 }
@@ -33,54 +38,49 @@ func (f *optFeed) Add(body string, timestamp float64) {
 	newPost := newPost(body, timestamp, nil)
 
 	for {
-		// Acquire a read lock to traverse feed
+		// Acquire a read lock to traverse feed and find the insertion point
 		f.rwLock.RLock()
-		// if feed is empty or post is the most recent, add post to the beginning of the feed (*)
-		if f.start.next == nil || timestamp > f.start.next.timestamp {
-			f.rwLock.RUnlock()
-			// acquire a write lock to try updating feed
-			f.rwLock.Lock()
-			// check if condition (*) still holds; if so, update feed; else, release lock and retry
-			if f.start.next == nil || timestamp > f.start.next.timestamp {
-				newPost.next = f.start.next
-				f.start.next = newPost
-				f.rwLock.Unlock()
-				return
-			} else {
-				f.rwLock.Unlock()
-				continue
-			}
-		// else, traverse the feed until find the correct position to insert the post	
-		} else {
-
-			curPost := f.start.next
-			for curPost.next != nil && timestamp < curPost.next.timestamp{
-				curPost = curPost.next
-			}
-			// insertion point found => release read lock and acquire write lock to update feed
-			f.rwLock.RUnlock()
-			f.rwLock.Lock()
-
-			// check if in the change of locks, insertion point is still valid; 
-			// if so, update feed; else, release lock and retry
-			// Explanation of the conditions. E.g.: feed = 12 -> 10 -> 3 ; new post: 5
-			// - condition 1 checks if 10 not deleted; in this case we need to change the pointer of 12 not 10, so retry.
-			// - condition 2 checks if the insertion point is still correct. This might not be the case if another 
-			//   thread inserts a 6 resulting in feed = 12 -> 10 -> 6 -> 3; continuing with the operation would result
-			//   in feed = 12 -> 10 -> 5 -> 6 -> 3 so retry. (i.e., curPost is lagging, must update to 6)
-			if !curPost.removed && (curPost.next == nil || timestamp > curPost.next.timestamp) {
-				newPost.next = curPost.next
-				curPost.next = newPost
-				f.rwLock.Unlock()
-				return
-			} else {
-				f.rwLock.Unlock()
-				continue
-			}
+		curPost := f.findPred(timestamp)
+		// insertion point found => release read lock and acquire write lock to update feed
+		f.rwLock.RUnlock()
+		f.rwLock.Lock()
+		// if in the change of locks the insertion point is still valid, the post is inserted; else, retry
+		added := f.add(curPost, newPost)
+		f.rwLock.Unlock()
+		if added {
+			return
 		}
 	}
 }
 
+// findPred returns the last post more recent than `timestamp` (the sentinel if there is none).
+// Must be called with the reader or writer lock held.
+func (f *optFeed) findPred(timestamp float64) *post {
+	curPost := f.start
+	for curPost.next != nil && timestamp < curPost.next.timestamp {
+		curPost = curPost.next
+	}
+	return curPost
+}
+
+// add inserts `newPost` right after `curPost` if it is still the insertion point found by findPred. Returns false
+// otherwise. Must be called with the writer lock held.
+// Explanation of the conditions. E.g.: feed = 12 -> 10 -> 3 ; new post: 5
+// - condition 1 checks if 10 not deleted; in this case we need to change the pointer of 12 not 10, so retry.
+// - condition 2 checks if the insertion point is still correct. This might not be the case if another
+//   thread inserts a 6 resulting in feed = 12 -> 10 -> 6 -> 3; continuing with the operation would result
+//   in feed = 12 -> 10 -> 5 -> 6 -> 3 so retry. (i.e., curPost is lagging, must update to 6)
+// Obs: a post with the same timestamp as the new one may follow the insertion point
+func (f *optFeed) add(curPost *post, newPost *post) bool {
+	if curPost.removed || (curPost.next != nil && newPost.timestamp < curPost.next.timestamp) {
+		return false
+	}
+	newPost.next = curPost.next
+	curPost.next = newPost
+	f.size++
+	return true
+}
+
 // Remove deletes the post with the given timestamp. If the timestamp
 // is not included in a post of the feed then the feed remains
 // unchanged. Return true if the deletion was a success, otherwise return false
@@ -89,65 +89,48 @@ func (f *optFeed) Remove(timestamp float64) bool {
 	// iterate over all feed; if timestamp in the middle remove post and update pointers
 	// such that: old feed: a -> b -> c ===> new feed: a -> c	
 
-	for{
-		// Acquire a read lock to traverse feed
+	for {
+		// Acquire a read lock to traverse feed and find the post before the one to be removed
 		f.rwLock.RLock()
-
-		// if feed is empty, return false
-		if f.start.next == nil {
+		curPost := f.findPred(timestamp)
+		// if post to be removed is not in the feed, return false
+		if curPost.next == nil || curPost.next.timestamp != timestamp {
 			f.rwLock.RUnlock()
 			return false
-		
-		// if post to be removed is the most recent, remove it and update feed
-		} else if timestamp == f.start.next.timestamp {
-			// release read lock and acquire write lock to update feed
-			f.rwLock.RUnlock()
-			f.rwLock.Lock()
-			// check if condition still holds; if so, update feed; else, release lock and retry
-			if  timestamp == f.start.next.timestamp {
-				f.start.next.removed = true
-				f.start.next = f.start.next.next
-				f.rwLock.Unlock()
-				return true
-			} else {
-				f.rwLock.Unlock()
-				continue
-			}
-			
-		// else, traverse the feed until find the correct position to remove the post
-		} else {
-			curPost := f.start.next
-			for curPost.next != nil && timestamp != curPost.next.timestamp{
-				curPost = curPost.next
-			}
-			// if post to be removed is not in the feed, return false
-			f.rwLock.RUnlock()
-			f.rwLock.Lock()
-			// check if removing point still valid; if so, update feed; else, release lock and retry
-			if !curPost.removed && (curPost.next == nil || timestamp == curPost.next.timestamp) {
-				// if next post is still nil, end of feed was reached and post was not found
-				if curPost.next == nil{
-					f.rwLock.Unlock()
-					return false
-				// else, remove post, update pointers and annotate post as removed
-				// (e.g. old feed: curPost -> next -> next.next => curPost -> next.next)
-				} else {
-					// annotate post as removed. This is needed because the node will be dangling and
-					// other threads would still be able to use it to find next nodes and think
-					// they are doing a valid operation.
-					curPost.next.removed = true
-					curPost.next = curPost.next.next
-					f.rwLock.Unlock()
-					return true
-				}
-			} else {
-				f.rwLock.Unlock()
-				continue
-			}
+		}
+		// release read lock and acquire write lock to update feed
+		f.rwLock.RUnlock()
+		f.rwLock.Lock()
+		// if in the change of locks the removing point is still valid, the post is removed; else, retry
+		valid, removed := f.remove(curPost, timestamp)
+		f.rwLock.Unlock()
+		if valid {
+			return removed
 		}
 	}
 }
 
+// remove deletes the post with `timestamp` right after `curPost`, if `curPost` is still the post found by findPred.
+// Returns whether it still is and whether the post was removed. Must be called with the writer lock held.
+func (f *optFeed) remove(curPost *post, timestamp float64) (valid bool, removed bool) {
+	if curPost.removed || (curPost.next != nil && timestamp < curPost.next.timestamp) {
+		return false, false
+	}
+	// if next post is nil or older, the post is not in the feed
+	if curPost.next == nil || curPost.next.timestamp != timestamp {
+		return true, false
+	}
+	// else, remove post, update pointers and annotate post as removed
+	// (e.g. old feed: curPost -> next -> next.next => curPost -> next.next)
+	// annotate post as removed. This is needed because the node will be dangling and
+	// other threads would still be able to use it to find next nodes and think
+	// they are doing a valid operation.
+	curPost.next.removed = true
+	curPost.next = curPost.next.next
+	f.size--
+	return true, true
+}
+
 // Contains determines whether a post with the given timestamp is
 // inside a feed. The function returns true if there is a post
 // with the timestamp, otherwise, false.
@@ -182,4 +165,63 @@ func (f *optFeed) ReturnFeed() []Post {
 		curPost = curPost.next
 	}
 	return feed
-} 
\ No newline at end of file
+} 
+
+// ReturnRange returns the posts whose timestamp is strictly between `newerThan` and `olderThan`,
+// from the most recent to the least recent. At most `limit` posts are returned; `limit` <= 0 means no limit.
+func (f *optFeed) ReturnRange(newerThan float64, olderThan float64, limit int) []Post {
+	// get a reader lock to read the feed
+	f.rwLock.RLock()
+	defer f.rwLock.RUnlock()
+	return f.returnRange(newerThan, olderThan, limit)
+}
+
+// returnRangeCtx is like ReturnRange, but gives up waiting for the reader lock once `ctx` is done; see timed.go
+func (f *optFeed) returnRangeCtx(ctx context.Context, newerThan float64, olderThan float64, limit int) ([]Post, error) {
+	if err := rLockCtx(ctx, f.rwLock); err != nil {
+		return nil, err
+	}
+	defer f.rwLock.RUnlock()
+	return f.returnRange(newerThan, olderThan, limit), nil
+}
+
+// returnRange returns the posts of ReturnRange. Must be called with the reader lock held.
+func (f *optFeed) returnRange(newerThan float64, olderThan float64, limit int) []Post {
+	var feed []Post
+
+	// skip posts that are too recent
+	curPost := f.start.next
+	for curPost != nil && curPost.timestamp >= olderThan {
+		curPost = curPost.next
+	}
+	// collect posts until the range or the limit is exhausted
+	for curPost != nil && curPost.timestamp > newerThan && (limit <= 0 || len(feed) < limit) {
+		feed = append(feed, *curPost.content)
+		curPost = curPost.next
+	}
+	return feed
+}
+
+// Len returns the number of posts in the feed
+func (f *optFeed) Len() int {
+	f.rwLock.RLock()
+	defer f.rwLock.RUnlock()
+	return f.size
+}
+
+// ApplyBatch applies the adds and removes of `ops` in order under a single writer lock.
+// Obs: holding the writer lock, the post found by findPred is always valid: there is no need to retry
+func (f *optFeed) ApplyBatch(ops []Op) []bool {
+	results := make([]bool, len(ops))
+	f.rwLock.Lock()
+	defer f.rwLock.Unlock()
+	for i, op := range ops {
+		curPost := f.findPred(op.Timestamp)
+		if op.Kind == RemoveOp {
+			_, results[i] = f.remove(curPost, op.Timestamp)
+		} else {
+			results[i] = f.add(curPost, newPost(op.Body, op.Timestamp, nil))
+		}
+	}
+	return results
+}
@@ -1,12 +1,40 @@
 package feed
 
 import (
+	"context"
+	"math"
 	"math/rand"
+	"proj2/lock"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
+// feedConstructors lists every implementation of Feed; each test runs against all of them
+var feedConstructors = []struct {
+	name    string
+	newFeed func() Feed
+}{
+	{"Coarse", NewFeed},
+	{"Optimistic", NewOptFeed},
+	{"Upgradable", NewUpgradableFeed},
+	{"SkipList", NewSkipListFeed},
+	{"Fine", NewFineFeed},
+	{"Lazy", NewLazyFeed},
+	{"LockFree", NewLockFreeFeed},
+}
+
+func forEachFeed(t *testing.T, test func(t *testing.T, newFeed func() Feed)) {
+	for _, constructor := range feedConstructors {
+		newFeed := constructor.newFeed
+		t.Run(constructor.name, func(t *testing.T) {
+			test(t, newFeed)
+		})
+	}
+}
+
 func addGoroutine(amount int, feed Feed, localCount int, wg *sync.WaitGroup) {
 	for i := 0; i < localCount; i++ {
 		num := amount + i
@@ -75,6 +103,17 @@ func removeGoroutine2(shouldRemoveEven bool, t *testing.T, amount int, feed Feed
 	}
 	wg.Done()
 }
+// sharedReads is how many reads each reader of the parallel tests does when they run against every feed.
+// The coarse-grained feed also runs them with as many reads as posts (TestParallelAdd, ...), which takes too long
+// for the whole suite.
+const sharedReads = 100
+
+// forEachFeedWithReads runs a parallel test as a subtest for each feed, with `sharedReads` reads per reader
+func forEachFeedWithReads(t *testing.T, test func(t *testing.T, newFeed func() Feed, reads int)) {
+	forEachFeed(t, func(t *testing.T, newFeed func() Feed) {
+		test(t, newFeed, sharedReads)
+	})
+}
 func randomReads(feed Feed, localCount int, wg *sync.WaitGroup) {
 	for i := 0; i < localCount; i++ {
 		feed.Contains(float64(i))
@@ -83,8 +122,11 @@ func randomReads(feed Feed, localCount int, wg *sync.WaitGroup) {
 }
 
 func TestSimpleSeq(t *testing.T) {
+	forEachFeed(t, testSimpleSeq)
+}
+func testSimpleSeq(t *testing.T, newFeed func() Feed) {
 
-	feed := NewFeed()
+	feed := newFeed()
 
 	//Check to make sure Contains returns False on empty feed
 	for i := 1; i <= rand.Intn(100); i++ {
@@ -110,9 +152,12 @@ func TestSimpleSeq(t *testing.T) {
 	}
 }
 func TestAdd(t *testing.T) {
+	forEachFeed(t, testAdd)
+}
+func testAdd(t *testing.T, newFeed func() Feed) {
 
 	postInfo := [20]int{1, 2, 18, 9, 8, 20, 16, 10, 6, 14, 17, 15, 19, 5, 13, 11, 7, 4, 3, 12}
-	feed := NewFeed()
+	feed := newFeed()
 
 	//Add 20 posts to the feed
 	for _, num := range postInfo {
@@ -130,9 +175,12 @@ func TestAdd(t *testing.T) {
 
 }
 func TestContains(t *testing.T) {
+	forEachFeed(t, testContains)
+}
+func testContains(t *testing.T, newFeed func() Feed) {
 
 	postInfo := [20]int{1, 2, 18, 9, 8, 20, 16, 10, 6, 14, 17, 15, 19, 5, 13, 11, 7, 4, 3, 12}
-	feed := NewFeed()
+	feed := newFeed()
 
 	//Add 20 posts to the feed
 	for _, num := range postInfo {
@@ -154,9 +202,12 @@ func TestContains(t *testing.T) {
 	}
 }
 func TestRemove(t *testing.T) {
+	forEachFeed(t, testRemove)
+}
+func testRemove(t *testing.T, newFeed func() Feed) {
 
 	postInfo := [20]int{1, 2, 18, 9, 8, 20, 16, 10, 6, 14, 17, 15, 19, 5, 13, 11, 7, 4, 3, 12}
-	feed := NewFeed()
+	feed := newFeed()
 
 	//Add 20 posts to the feed
 	for _, num := range postInfo {
@@ -202,11 +253,18 @@ func TestRemove(t *testing.T) {
 	}
 }
 func TestParallelAdd(t *testing.T) {
+	// the coarse-grained feed with as many reads per reader as posts
+	testParallelAdd(t, NewFeed, 5000)
+}
+func TestEveryFeedParallelAdd(t *testing.T) {
+	forEachFeedWithReads(t, testParallelAdd)
+}
+func testParallelAdd(t *testing.T, newFeed func() Feed, reads int) {
 
 	const totalSize = 5000
 	const threadCount = 100
 	const localCount = totalSize / threadCount
-	feed := NewFeed()
+	feed := newFeed()
 
 	var wg sync.WaitGroup
 
@@ -216,7 +274,7 @@ func TestParallelAdd(t *testing.T) {
 		go addGoroutine(i*localCount, feed, localCount, &wg)
 		for i := 0; i < 5; i++ {
 			wg.Add(1)
-			go randomReads(feed, totalSize, &wg) //Throw in some readers while adding
+			go randomReads(feed, reads, &wg) //Throw in some readers while adding
 		}
 		
 	}
@@ -237,11 +295,18 @@ func TestParallelAdd(t *testing.T) {
 		}
 }
 func TestParallelRemoveAndAdd(t *testing.T) {
+	// the coarse-grained feed with as many reads per reader as posts
+	testParallelRemoveAndAdd(t, NewFeed, 5000)
+}
+func TestEveryFeedParallelRemoveAndAdd(t *testing.T) {
+	forEachFeedWithReads(t, testParallelRemoveAndAdd)
+}
+func testParallelRemoveAndAdd(t *testing.T, newFeed func() Feed, reads int) {
 
 	const totalSize = 5000
 	const threadCount = 100
 	const localCount = totalSize / threadCount
-	feed := NewFeed()
+	feed := newFeed()
 
 	//Sequentially add in all the posts
 	for i := 0; i < totalSize; i++ {
@@ -255,7 +320,7 @@ func TestParallelRemoveAndAdd(t *testing.T) {
 		go removeGoroutine(t, i*localCount, feed, localCount, &wg)
 		for i := 0; i < 15; i++ {
 			wg.Add(1)
-			go randomReads(feed, totalSize, &wg) //Throw in some readers while removing
+			go randomReads(feed, reads, &wg) //Throw in some readers while removing
 		}
 	}
 	wg.Wait()
@@ -273,11 +338,18 @@ func TestParallelRemoveAndAdd(t *testing.T) {
 	}
 }
 func TestParallelAll(t *testing.T) {
+	// the coarse-grained feed with as many reads per reader as posts
+	testParallelAll(t, NewFeed, 5000)
+}
+func TestEveryFeedParallelAll(t *testing.T) {
+	forEachFeedWithReads(t, testParallelAll)
+}
+func testParallelAll(t *testing.T, newFeed func() Feed, reads int) {
 
 	const totalSize = 5000
 	const threadCount = 50
 	const localCount = totalSize / threadCount
-	feed := NewFeed()
+	feed := newFeed()
 
 	//First: add the even timestamps
 	var wg sync.WaitGroup
@@ -286,7 +358,7 @@ func TestParallelAll(t *testing.T) {
 		go addGoroutine2(true, i*localCount, feed, localCount, &wg)
 		for i := 0; i < 5; i++ {
 			wg.Add(1)
-			go randomReads(feed, totalSize, &wg) //Through in some readers while adding
+			go randomReads(feed, reads, &wg) //Through in some readers while adding
 		}
 	}
 	wg.Wait()
@@ -298,7 +370,7 @@ func TestParallelAll(t *testing.T) {
 		go removeGoroutine2(true, t, i*localCount, feed, localCount, &wg)
 		for i := 0; i < 5; i++ {
 			wg.Add(1)
-			go randomReads(feed, totalSize, &wg) //Throw in some readers while adding
+			go randomReads(feed, reads, &wg) //Throw in some readers while adding
 		}
 	}
 	wg.Wait()
@@ -309,7 +381,7 @@ func TestParallelAll(t *testing.T) {
 		go containsGoroutine(t, i*localCount, feed, localCount, &wg)
 		for i := 0; i < 15; i++ {
 			wg.Add(1)
-			go randomReads(feed, totalSize, &wg) //Throw in some readers while removing
+			go randomReads(feed, reads, &wg) //Throw in some readers while removing
 		}
 	}
 	wg.Wait()
@@ -319,4 +391,290 @@ func TestParallelAll(t *testing.T) {
 			t.Errorf("Removed all items but not all were removed:\n"+"(Got):%v\n", i)
 		}
 	}
-}
\ No newline at end of file
+}
+func TestRegistryConcurrentCreate(t *testing.T) {
+
+	const threadCount = 50
+	users := NewRegistry(NewFeed)
+	feeds := make([]Feed, threadCount)
+
+	//Every goroutine asks for the feed of the same new user
+	var wg sync.WaitGroup
+	for i := 0; i < threadCount; i++ {
+		wg.Add(1)
+		go func(i int) {
+			feeds[i] = users.Feed("alice")
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	//Check that all goroutines got the same feed
+	for i := 1; i < threadCount; i++ {
+		if feeds[i] != feeds[0] {
+			t.Errorf("Goroutine %v got a different feed for the same user", i)
+		}
+	}
+}
+func TestRegistryTimeline(t *testing.T) {
+
+	users := NewRegistry(NewFeed)
+
+	//alice posts the multiples of 3, bob the multiples of 3 plus 1 and carol the rest
+	for i := 1; i <= 30; i++ {
+		body := strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			users.Feed("alice").Add(body, float64(i))
+		case 1:
+			users.Feed("bob").Add(body, float64(i))
+		default:
+			users.Feed("carol").Add(body, float64(i))
+		}
+	}
+
+	if !users.Follow("alice", "bob") {
+		t.Errorf("alice should be able to follow bob")
+	}
+	if users.Follow("alice", "bob") || users.Follow("alice", "alice") {
+		t.Errorf("alice should not follow bob twice nor herself")
+	}
+
+	//Timeline of alice has her posts and bob's posts, most recent first
+	timeline := users.Timeline("alice")
+	if len(timeline) != 20 {
+		t.Fatalf("Expected 20 posts in the timeline. Got:%v", len(timeline))
+	}
+	for i, post := range timeline {
+		if i > 0 && *timeline[i-1].Timestamp < *post.Timestamp {
+			t.Errorf("Timeline is not ordered: %v before %v", *timeline[i-1].Timestamp, *post.Timestamp)
+		}
+		if int(*post.Timestamp)%3 == 2 {
+			t.Errorf("Timeline of alice contains a post of carol: %v", *post.Timestamp)
+		}
+	}
+
+	//After unfollowing bob, only the posts of alice remain
+	if !users.Unfollow("alice", "bob") || users.Unfollow("alice", "bob") {
+		t.Errorf("alice should unfollow bob exactly once")
+	}
+	if timeline = users.Timeline("alice"); len(timeline) != 10 {
+		t.Errorf("Expected 10 posts in the timeline. Got:%v", len(timeline))
+	}
+}
+func TestReturnRange(t *testing.T) {
+	forEachFeed(t, testReturnRange)
+}
+func testReturnRange(t *testing.T, newFeed func() Feed) {
+
+	feed := newFeed()
+	for i := 1; i <= 20; i++ {
+		feed.Add(strconv.Itoa(i), float64(i))
+	}
+
+	//Posts strictly between 5 and 15, most recent first
+	posts := feed.ReturnRange(5, 15, 0)
+	if len(posts) != 9 {
+		t.Fatalf("Expected 9 posts in (5, 15). Got:%v", len(posts))
+	}
+	for i, post := range posts {
+		if *post.Timestamp != float64(14-i) {
+			t.Errorf("Expected timestamp %v at position %v. Got:%v", 14-i, i, *post.Timestamp)
+		}
+	}
+
+	//The limit keeps only the most recent posts of the range
+	posts = feed.ReturnRange(5, 15, 3)
+	if len(posts) != 3 || *posts[0].Timestamp != 14 || *posts[2].Timestamp != 12 {
+		t.Errorf("Expected posts 14, 13, 12. Got:%v posts", len(posts))
+	}
+
+	//Empty range
+	if posts = feed.ReturnRange(10, 11, 0); len(posts) != 0 {
+		t.Errorf("Expected no posts in (10, 11). Got:%v", len(posts))
+	}
+}
+
+func TestReturnRangeCtx(t *testing.T) {
+	forEachFeed(t, testReturnRangeCtx)
+}
+func testReturnRangeCtx(t *testing.T, newFeed func() Feed) {
+
+	feed := newFeed()
+	for i := 1; i <= 20; i++ {
+		feed.Add(strconv.Itoa(i), float64(i))
+	}
+
+	//Same posts as ReturnRange while the feed is not locked
+	posts, err := ReturnRangeCtx(context.Background(), feed, 5, 15, 3)
+	if err != nil || len(posts) != 3 || *posts[0].Timestamp != 14 {
+		t.Errorf("Expected posts 14, 13, 12. Got:%v posts (%v)", len(posts), err)
+	}
+}
+
+func TestReturnRangeCtxTimeout(t *testing.T) {
+	//A feed whose lock is held by a writer gives up once the context is done
+	rw := lock.NewRWLock()
+	for _, feed := range []Feed{NewFeedWithLock(rw), NewOptFeedWithLock(rw)} {
+		feed.Add("post", 1)
+		rw.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if posts, err := ReturnRangeCtx(ctx, feed, math.Inf(-1), math.Inf(1), 0); err != context.DeadlineExceeded {
+			t.Errorf("Expected the deadline to pass. Got:%v posts (%v)", len(posts), err)
+		}
+		cancel()
+		rw.Unlock()
+	}
+}
+
+func TestDuplicateTimestamps(t *testing.T) {
+	//Every feed keeps both posts (see Feed)
+	for _, constructor := range feedConstructors {
+		feed := constructor.newFeed()
+		feed.Add("first", 1)
+		feed.Add("second", 1)
+		if feed.Len() != 2 || len(feed.ReturnFeed()) != 2 {
+			t.Errorf("%s: expected 2 posts. Got:%v", constructor.name, feed.Len())
+		}
+		//Removing one of the posts leaves the other one
+		if !feed.Remove(1) || !feed.Contains(1) || feed.Len() != 1 {
+			t.Errorf("%s: expected the other post to remain after removing one", constructor.name)
+		}
+		if !feed.Remove(1) || feed.Contains(1) || feed.Remove(1) {
+			t.Errorf("%s: expected no post left after removing both", constructor.name)
+		}
+	}
+}
+
+func TestParallelDuplicateTimestamps(t *testing.T) {
+	forEachFeed(t, testParallelDuplicateTimestamps)
+}
+func testParallelDuplicateTimestamps(t *testing.T, newFeed func() Feed) {
+
+	//Concurrent adds of posts sharing a few timestamps, then concurrent removals of all of them
+	const threads, perThread, timestamps = 8, 200, 5
+	feed := newFeed()
+	var wg sync.WaitGroup
+	run := func(op func(i int)) {
+		for th := 0; th < threads; th++ {
+			wg.Add(1)
+			go func(th int) {
+				defer wg.Done()
+				for i := 0; i < perThread; i++ {
+					op(th*perThread + i)
+				}
+			}(th)
+		}
+		wg.Wait()
+	}
+	run(func(i int) { feed.Add(strconv.Itoa(i), float64(i%timestamps)) })
+	if feed.Len() != threads*perThread || len(feed.ReturnFeed()) != threads*perThread {
+		t.Fatalf("Expected %d posts. Got:%v", threads*perThread, feed.Len())
+	}
+	var failed atomic.Int32
+	run(func(i int) {
+		if !feed.Remove(float64(i % timestamps)) {
+			failed.Add(1)
+		}
+	})
+	if failed.Load() != 0 || feed.Len() != 0 || len(feed.ReturnFeed()) != 0 {
+		t.Errorf("Expected every removal to succeed and an empty feed. Got %d failed removals and %v posts",
+			failed.Load(), feed.Len())
+	}
+}
+
+func TestLen(t *testing.T) {
+	forEachFeed(t, testLen)
+}
+func testLen(t *testing.T, newFeed func() Feed) {
+
+	feed := newFeed()
+	if feed.Len() != 0 {
+		t.Fatalf("Expected an empty feed. Got:%v", feed.Len())
+	}
+
+	//Concurrent adds of distinct posts, then removals of half of them (plus some missing ones)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				feed.Add("post", float64(g*100+i))
+			}
+		}(g)
+	}
+	wg.Wait()
+	if feed.Len() != 800 {
+		t.Fatalf("Expected 800 posts. Got:%v", feed.Len())
+	}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i += 2 {
+				feed.Remove(float64(g*100 + i))
+				feed.Remove(float64(-1 - g*100 - i))
+			}
+		}(g)
+	}
+	wg.Wait()
+	if feed.Len() != 400 || len(feed.ReturnFeed()) != 400 {
+		t.Errorf("Expected 400 posts. Got:%v (%v returned)", feed.Len(), len(feed.ReturnFeed()))
+	}
+}
+
+func TestApplyBatch(t *testing.T) {
+	forEachFeed(t, testApplyBatch)
+}
+func testApplyBatch(t *testing.T, newFeed func() Feed) {
+
+	feed := newFeed()
+	feed.Add("old", 5)
+
+	//The operations are applied in order: the post added and then removed is not in the feed
+	ops := []Op{
+		{Kind: AddOp, Body: "a", Timestamp: 3},
+		{Kind: AddOp, Body: "b", Timestamp: 7},
+		{Kind: RemoveOp, Timestamp: 5},
+		{Kind: RemoveOp, Timestamp: 4},
+		{Kind: AddOp, Body: "c", Timestamp: 4},
+		{Kind: RemoveOp, Timestamp: 4},
+	}
+	results := feed.ApplyBatch(ops)
+	expected := []bool{true, true, true, false, true, true}
+	for i := range expected {
+		if results[i] != expected[i] {
+			t.Errorf("Expected result %v for op %d. Got:%v", expected[i], i, results[i])
+		}
+	}
+
+	posts := feed.ReturnFeed()
+	if len(posts) != 2 || *posts[0].Timestamp != 7 || *posts[1].Timestamp != 3 {
+		t.Fatalf("Expected the posts 7 and 3. Got:%v", posts)
+	}
+	if feed.Len() != 2 {
+		t.Errorf("Expected 2 posts. Got:%v", feed.Len())
+	}
+
+	//Concurrent batches of distinct posts
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			batch := make([]Op, 0, 10)
+			for i := 0; i < 100; i++ {
+				batch = append(batch, Op{Kind: AddOp, Body: "post", Timestamp: float64(100 + g*100 + i)})
+				if len(batch) == cap(batch) {
+					feed.ApplyBatch(batch)
+					batch = batch[:0]
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if feed.Len() != 802 {
+		t.Errorf("Expected 802 posts. Got:%v", feed.Len())
+	}
+}
@@ -0,0 +1,146 @@
+// A thread-safe feed implemented as a linked list with a fine-grained strategy using one lock per post.
+// Differences to the implementation in `feed`: there is no feed-wide lock. Threads traverse the feed
+// hand-over-hand, always holding the locks of two consecutive posts and releasing the first only after
+// acquiring the next one, so operations in different regions of the feed proceed in parallel.
+// Obs: as in the coarse-grained feed, posts with the same timestamp may coexist; `Remove` deletes one of them.
+
+package feed
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// fineNode is a post in the fine-grained feed
+type fineNode struct {
+	body 		string 			// the text of the post
+	timestamp 	float64 		// Unix timestamp of the post
+	content 	*Post 			// helper struct for returning the feed
+	next 		*fineNode 		// the next post in the feed
+	mux 		sync.Mutex 		// locks the post while traversing it or updating its successor
+}
+
+// newFineNode creates a post in the fine-grained feed pointing to `next`
+func newFineNode(body string, timestamp float64, next *fineNode) *fineNode {
+	n := &fineNode{body: body, timestamp: timestamp, next: next}
+	n.content = &Post{Body: &n.body, Timestamp: &n.timestamp}
+	return n
+}
+
+// fineFeed is the internal representation of a user's twitter feed with per-post locks
+type fineFeed struct {
+	head 	*fineNode 		// sentinel with timestamp +Inf; the first post of the feed
+	tail 	*fineNode 		// sentinel with timestamp -Inf; the last post of the feed
+	size 	atomic.Int64 	// the number of posts in the feed
+}
+
+// NewFineFeed creates a empty user feed with hand-over-hand locking and returns a pointer to it
+func NewFineFeed() Feed {
+	tail := newFineNode("", math.Inf(-1), nil)
+	head := newFineNode("", math.Inf(1), tail)
+	return &fineFeed{head: head, tail: tail}
+}
+
+// find returns the locked pair of consecutive posts (pred, curr) such that
+// pred.timestamp > timestamp >= curr.timestamp. The caller must unlock both.
+func (f *fineFeed) find(timestamp float64) (*fineNode, *fineNode) {
+	pred := f.head
+	pred.mux.Lock()
+	curr := pred.next
+	curr.mux.Lock()
+	// hand-over-hand: lock the next post before releasing the previous one
+	// Obs: the tail sentinel has timestamp -Inf, so the loop always stops before the end of the feed
+	for curr.timestamp > timestamp {
+		pred.mux.Unlock()
+		pred = curr
+		curr = curr.next
+		curr.mux.Lock()
+	}
+	return pred, curr
+}
+
+// Add inserts a new post to the feed. The feed is always ordered by the timestamp where
+// the most recent timestamp is at the beginning of the feed followed by the second most
+// recent timestamp, etc.
+func (f *fineFeed) Add(body string, timestamp float64) {
+	pred, curr := f.find(timestamp)
+	defer pred.mux.Unlock()
+	defer curr.mux.Unlock()
+
+	pred.next = newFineNode(body, timestamp, curr)
+	f.size.Add(1)
+}
+
+// Remove deletes the post with the given timestamp. If the timestamp
+// is not included in a post of the feed then the feed remains
+// unchanged. Return true if the deletion was a success, otherwise return false
+func (f *fineFeed) Remove(timestamp float64) bool {
+	pred, curr := f.find(timestamp)
+	defer pred.mux.Unlock()
+	defer curr.mux.Unlock()
+
+	if curr.timestamp != timestamp {
+		return false
+	}
+	pred.next = curr.next
+	f.size.Add(-1)
+	return true
+}
+
+// Contains determines whether a post with the given timestamp is
+// inside a feed. The function returns true if there is a post
+// with the timestamp, otherwise, false.
+func (f *fineFeed) Contains(timestamp float64) bool {
+	pred, curr := f.find(timestamp)
+	defer pred.mux.Unlock()
+	defer curr.mux.Unlock()
+
+	return curr.timestamp == timestamp
+}
+
+// ReturnFeed returns the whole feed as a slice of Post structs
+func (f *fineFeed) ReturnFeed() []Post {
+	return f.ReturnRange(math.Inf(-1), math.Inf(1), 0)
+}
+
+// ReturnRange returns the posts whose timestamp is strictly between `newerThan` and `olderThan`,
+// from the most recent to the least recent. At most `limit` posts are returned; `limit` <= 0 means no limit.
+// Obs: writers can work behind the traversal, so the result is not a snapshot of the whole feed.
+func (f *fineFeed) ReturnRange(newerThan float64, olderThan float64, limit int) []Post {
+	var feed []Post
+
+	// skip posts that are too recent (hand-over-hand)
+	pred := f.head
+	pred.mux.Lock()
+	curr := pred.next
+	curr.mux.Lock()
+	for curr != f.tail && curr.timestamp >= olderThan {
+		pred.mux.Unlock()
+		pred = curr
+		curr = curr.next
+		curr.mux.Lock()
+	}
+	// collect posts until the range or the limit is exhausted
+	for curr != f.tail && curr.timestamp > newerThan && (limit <= 0 || len(feed) < limit) {
+		feed = append(feed, *curr.content)
+		pred.mux.Unlock()
+		pred = curr
+		curr = curr.next
+		curr.mux.Lock()
+	}
+	curr.mux.Unlock()
+	pred.mux.Unlock()
+	return feed
+}
+
+// Len returns the number of posts in the feed
+// Obs: takes no lock; `size` is updated while holding the locks of the posts around the update
+func (f *fineFeed) Len() int {
+	return int(f.size.Load())
+}
+
+// ApplyBatch applies the adds and removes of `ops` in order, one by one: there is no feed-wide lock to amortize
+func (f *fineFeed) ApplyBatch(ops []Op) []bool {
+	return applyEach(f, ops)
+}
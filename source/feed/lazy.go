@@ -0,0 +1,165 @@
+// A thread-safe feed implemented as a lazy linked list (Heller et al.) with one lock per post.
+// Differences to the implementation in `fine.go`: threads traverse the feed without locks and only lock
+// the two posts around the update point, validating them before updating. Removal is done in two steps:
+// the post is first marked as removed (`lazyNode.removed`) and then unlinked. Because marked posts are never
+// considered part of the feed, `Contains` takes no lock and is wait-free.
+// Obs: as in the coarse-grained feed, posts with the same timestamp may coexist; `Remove` deletes one of them.
+
+package feed
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// lazyNode is a post in the lazy list
+// Obs: `next` and `removed` are read without locks, so they are atomics.
+type lazyNode struct {
+	body 		string 						// the text of the post
+	timestamp 	float64 					// Unix timestamp of the post
+	content 	*Post 						// helper struct for returning the feed
+	next 		atomic.Pointer[lazyNode] 	// the next post in the feed
+	removed 	atomic.Bool 				// post is logically removed from the feed
+	mux 		sync.Mutex 					// locks the post while it or its successor is updated
+}
+
+// lazyFeed is the internal representation of a user's twitter feed as a lazy list
+type lazyFeed struct {
+	head 	*lazyNode 		// sentinel with timestamp +Inf; the first post of the feed
+	tail 	*lazyNode 		// sentinel with timestamp -Inf; the last post of the feed
+	size 	atomic.Int64 	// the number of posts in the feed
+}
+
+// newLazyNode creates a post followed by `next`
+func newLazyNode(body string, timestamp float64, next *lazyNode) *lazyNode {
+	n := &lazyNode{body: body, timestamp: timestamp}
+	n.content = &Post{Body: &n.body, Timestamp: &n.timestamp}
+	n.next.Store(next)
+	return n
+}
+
+// NewLazyFeed creates a empty user feed with lazy synchronization and returns a pointer to it
+func NewLazyFeed() Feed {
+	tail := newLazyNode("", math.Inf(-1), nil)
+	head := newLazyNode("", math.Inf(1), tail)
+	return &lazyFeed{head: head, tail: tail}
+}
+
+// find returns, without taking locks, consecutive posts (pred, curr) such that
+// pred.timestamp > timestamp >= curr.timestamp
+func (f *lazyFeed) find(timestamp float64) (*lazyNode, *lazyNode) {
+	pred := f.head
+	curr := pred.next.Load()
+	for curr.timestamp > timestamp {
+		pred = curr
+		curr = curr.next.Load()
+	}
+	return pred, curr
+}
+
+// validate checks that, with both locks held, `pred` and `curr` are still in the feed
+// and still consecutive
+func validate(pred *lazyNode, curr *lazyNode) bool {
+	return !pred.removed.Load() && !curr.removed.Load() && pred.next.Load() == curr
+}
+
+// Add inserts a new post to the feed. The feed is always ordered by the timestamp where
+// the most recent timestamp is at the beginning of the feed followed by the second most
+// recent timestamp, etc.
+func (f *lazyFeed) Add(body string, timestamp float64) {
+	for {
+		pred, curr := f.find(timestamp)
+		pred.mux.Lock()
+		curr.mux.Lock()
+
+		// if the posts changed while locking, retry
+		if !validate(pred, curr) {
+			curr.mux.Unlock()
+			pred.mux.Unlock()
+			continue
+		}
+		pred.next.Store(newLazyNode(body, timestamp, curr))
+		f.size.Add(1)
+		curr.mux.Unlock()
+		pred.mux.Unlock()
+		return
+	}
+}
+
+// Remove deletes the post with the given timestamp. If the timestamp
+// is not included in a post of the feed then the feed remains
+// unchanged. Return true if the deletion was a success, otherwise return false
+func (f *lazyFeed) Remove(timestamp float64) bool {
+	for {
+		pred, curr := f.find(timestamp)
+		pred.mux.Lock()
+		curr.mux.Lock()
+
+		// if the posts changed while locking, retry
+		if !validate(pred, curr) {
+			curr.mux.Unlock()
+			pred.mux.Unlock()
+			continue
+		}
+		success := curr.timestamp == timestamp
+		if success {
+			// logical removal first, then physical removal
+			curr.removed.Store(true)
+			pred.next.Store(curr.next.Load())
+			f.size.Add(-1)
+		}
+		curr.mux.Unlock()
+		pred.mux.Unlock()
+		return success
+	}
+}
+
+// Contains determines whether a post with the given timestamp is
+// inside a feed. The function returns true if there is a post
+// with the timestamp, otherwise, false.
+// Obs: wait-free; a post marked as removed is not in the feed even if it is still linked, but another
+// post with the same timestamp may follow it.
+func (f *lazyFeed) Contains(timestamp float64) bool {
+	_, curr := f.find(timestamp)
+	for curr.timestamp == timestamp && curr.removed.Load() {
+		curr = curr.next.Load()
+	}
+	return curr.timestamp == timestamp
+}
+
+// ReturnFeed returns the whole feed as a slice of Post structs
+func (f *lazyFeed) ReturnFeed() []Post {
+	return f.ReturnRange(math.Inf(-1), math.Inf(1), 0)
+}
+
+// ReturnRange returns the posts whose timestamp is strictly between `newerThan` and `olderThan`,
+// from the most recent to the least recent. At most `limit` posts are returned; `limit` <= 0 means no limit.
+// Obs: the feed is traversed without locks, skipping posts marked as removed.
+func (f *lazyFeed) ReturnRange(newerThan float64, olderThan float64, limit int) []Post {
+	var feed []Post
+
+	// skip posts that are too recent
+	curr := f.head.next.Load()
+	for curr != f.tail && curr.timestamp >= olderThan {
+		curr = curr.next.Load()
+	}
+	// collect posts until the range or the limit is exhausted
+	for curr != f.tail && curr.timestamp > newerThan && (limit <= 0 || len(feed) < limit) {
+		if !curr.removed.Load() {
+			feed = append(feed, *curr.content)
+		}
+		curr = curr.next.Load()
+	}
+	return feed
+}
+
+// Len returns the number of posts in the feed
+func (f *lazyFeed) Len() int {
+	return int(f.size.Load())
+}
+
+// ApplyBatch applies the adds and removes of `ops` in order, one by one: there is no feed-wide lock to amortize
+func (f *lazyFeed) ApplyBatch(ops []Op) []bool {
+	return applyEach(f, ops)
+}
@@ -0,0 +1,195 @@
+// A lock-free feed implemented as a linked list a la Harris and Michael.
+// Every post's `next` field holds both the pointer to the next post and a mark telling whether the post
+// itself was removed. Removal is done in two steps: the post is first marked (logical deletion) and then
+// unlinked from its predecessor with a CAS (physical deletion). Traversals unlink the marked posts they find.
+// Obs: Go does not allow stealing a bit of a pointer for the mark, so `next` points to an immutable
+// (pointer, mark) pair and updating either of them means swapping the pair with a CAS.
+// Obs2: as in the coarse-grained feed, posts with the same timestamp may coexist; a new post goes before
+// the posts with the same timestamp and `Remove` deletes one of them.
+
+package feed
+
+import (
+	"math"
+	"sync/atomic"
+	"unsafe"
+)
+
+// markedRef is an immutable (next post, removed mark) pair
+type markedRef struct {
+	post 		*lfPost 		// the next post in the feed
+	marked 		bool 			// true if the post holding this reference was removed
+}
+
+// lfPost is a post in the lock-free feed
+// Obs: as in `queue/lockfree.go`, `next` is an unsafe.Pointer (to a markedRef) to avoid casting on every CAS
+type lfPost struct {
+	body 		string 			// the text of the post
+	timestamp 	float64 		// Unix timestamp of the post
+	content 	*Post 			// helper struct for returning the feed
+	next 		unsafe.Pointer 	// *markedRef to the next post
+}
+
+// lockFreeFeed is the internal representation of a user's twitter feed as a lock-free list
+type lockFreeFeed struct {
+	head 	*lfPost 		// sentinel with timestamp +Inf; the first post of the feed
+	tail 	*lfPost 		// sentinel with timestamp -Inf; the last post of the feed
+	size 	atomic.Int64 	// the number of posts in the feed
+}
+
+// newLFPost creates a post pointing to `next`
+func newLFPost(body string, timestamp float64, next *lfPost) *lfPost {
+	p := &lfPost{body: body, timestamp: timestamp}
+	p.content = &Post{Body: &p.body, Timestamp: &p.timestamp}
+	p.next = unsafe.Pointer(&markedRef{post: next})
+	return p
+}
+
+// NewLockFreeFeed creates a empty lock-free user feed and returns a pointer to it
+func NewLockFreeFeed() Feed {
+	tail := newLFPost("", math.Inf(-1), nil)
+	head := newLFPost("", math.Inf(1), tail)
+	return &lockFreeFeed{head: head, tail: tail}
+}
+
+// loadNext atomically reads the (next post, mark) pair of `p`
+func (p *lfPost) loadNext() (unsafe.Pointer, *markedRef) {
+	ref := atomic.LoadPointer(&p.next)
+	return ref, (*markedRef)(ref)
+}
+
+// find returns consecutive unmarked posts (pred, curr) such that pred.timestamp > timestamp >= curr.timestamp.
+// Marked posts found on the way are physically removed; if that fails because the feed changed
+// under us, the traversal restarts from the head.
+// Also returns the reference read from pred.next, to be used as the expected value of a CAS.
+func (f *lockFreeFeed) find(timestamp float64) (*lfPost, *lfPost, unsafe.Pointer) {
+retry:
+	for {
+		pred := f.head
+		predRef, predNext := pred.loadNext()
+		curr := predNext.post
+		for {
+			currRef, currNext := curr.loadNext()
+			// curr is marked => try to unlink it (pred.next: curr -> curr.next)
+			for currNext.marked {
+				newRef := unsafe.Pointer(&markedRef{post: currNext.post})
+				if !atomic.CompareAndSwapPointer(&pred.next, predRef, newRef) {
+					continue retry
+				}
+				predRef = newRef
+				curr = currNext.post
+				currRef, currNext = curr.loadNext()
+			}
+			// Obs: the tail sentinel has timestamp -Inf, so the loop always stops before the end of the feed
+			if curr.timestamp <= timestamp {
+				return pred, curr, predRef
+			}
+			// move forward; `currRef` is unmarked, so a later CAS on pred.next fails if pred gets removed
+			pred, predRef = curr, currRef
+			curr = currNext.post
+		}
+	}
+}
+
+// Add inserts a new post to the feed. The feed is always ordered by the timestamp where
+// the most recent timestamp is at the beginning of the feed followed by the second most
+// recent timestamp, etc.
+func (f *lockFreeFeed) Add(body string, timestamp float64) {
+	newPost := newLFPost(body, timestamp, nil)
+	for {
+		pred, curr, predRef := f.find(timestamp)
+		// link the new post between pred and curr; fails if pred was marked or another post
+		// was inserted after pred in the meantime
+		newPost.next = unsafe.Pointer(&markedRef{post: curr})
+		if atomic.CompareAndSwapPointer(&pred.next, predRef, unsafe.Pointer(&markedRef{post: newPost})) {
+			f.size.Add(1)
+			return
+		}
+	}
+}
+
+// Remove deletes the post with the given timestamp. If the timestamp
+// is not included in a post of the feed then the feed remains
+// unchanged. Return true if the deletion was a success, otherwise return false
+func (f *lockFreeFeed) Remove(timestamp float64) bool {
+	for {
+		pred, curr, predRef := f.find(timestamp)
+		if curr.timestamp != timestamp {
+			return false
+		}
+
+		// logical removal: mark curr; fails if curr was marked by another thread or its successor changed
+		// if another thread marked curr first, retry: `find` unlinks it and may find another post with the timestamp
+		currRef, currNext := curr.loadNext()
+		if currNext.marked {
+			continue
+		}
+		if !atomic.CompareAndSwapPointer(&curr.next, currRef, unsafe.Pointer(&markedRef{post: currNext.post, marked: true})) {
+			continue
+		}
+		f.size.Add(-1)
+		// physical removal: try once to unlink curr; if it fails, a later traversal will do it
+		atomic.CompareAndSwapPointer(&pred.next, predRef, unsafe.Pointer(&markedRef{post: currNext.post}))
+		return true
+	}
+}
+
+// Contains determines whether a post with the given timestamp is
+// inside a feed. The function returns true if there is a post
+// with the timestamp, otherwise, false.
+// Obs: wait-free; does not help removing marked posts, it only skips them.
+func (f *lockFreeFeed) Contains(timestamp float64) bool {
+	curr := f.head
+	for curr.timestamp > timestamp {
+		_, next := curr.loadNext()
+		curr = next.post
+	}
+	for curr.timestamp == timestamp {
+		_, currNext := curr.loadNext()
+		if !currNext.marked {
+			return true
+		}
+		curr = currNext.post
+	}
+	return false
+}
+
+// ReturnFeed returns the whole feed as a slice of Post structs
+func (f *lockFreeFeed) ReturnFeed() []Post {
+	return f.ReturnRange(math.Inf(-1), math.Inf(1), 0)
+}
+
+// ReturnRange returns the posts whose timestamp is strictly between `newerThan` and `olderThan`,
+// from the most recent to the least recent. At most `limit` posts are returned; `limit` <= 0 means no limit.
+// Obs: the feed is traversed without helping removals, skipping posts marked as removed.
+func (f *lockFreeFeed) ReturnRange(newerThan float64, olderThan float64, limit int) []Post {
+	var feed []Post
+
+	// skip posts that are too recent
+	_, next := f.head.loadNext()
+	curr := next.post
+	for curr != f.tail && curr.timestamp >= olderThan {
+		_, next = curr.loadNext()
+		curr = next.post
+	}
+	// collect posts until the range or the limit is exhausted
+	for curr != f.tail && curr.timestamp > newerThan && (limit <= 0 || len(feed) < limit) {
+		_, next = curr.loadNext()
+		if !next.marked {
+			feed = append(feed, *curr.content)
+		}
+		curr = next.post
+	}
+	return feed
+}
+
+// Len returns the number of posts in the feed
+// Obs: posts count from their insertion until they are marked as removed
+func (f *lockFreeFeed) Len() int {
+	return int(f.size.Load())
+}
+
+// ApplyBatch applies the adds and removes of `ops` in order, one by one: the feed takes no lock
+func (f *lockFreeFeed) ApplyBatch(ops []Op) []bool {
+	return applyEach(f, ops)
+}
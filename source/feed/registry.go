@@ -0,0 +1,175 @@
+// A registry of per-user feeds and of the follow graph between users.
+// Feeds are created lazily the first time a user's feed is asked for (see Feed), and creation is safe
+// for concurrent callers: two threads asking for the feed of a new user get the same feed.
+
+package feed
+
+import (
+	"container/heap"
+	"proj2/lock"
+	"sort"
+)
+
+// Registry holds the feed of every user known to the server and who follows whom
+type Registry struct {
+	newFeed 		func() Feed 					// constructor used to create the feed of a new user
+	feeds 			map[string]Feed 				// user -> user's feed
+	feedsLock 		lock.RWLock 					// protects `feeds`
+	follows 		map[string]map[string]bool 	// user -> set of users it follows
+	followsLock 	lock.RWLock 					// protects `follows`
+	lockStats 		*lock.Stats 					// statistics of the locks of the feeds; nil if not collected
+}
+
+// NewRegistry creates an empty registry. `newFeed` is called once for every new user.
+func NewRegistry(newFeed func() Feed) *Registry {
+	return &Registry{
+		newFeed: newFeed,
+		feeds: make(map[string]Feed),
+		feedsLock: lock.NewRWLock(),
+		follows: make(map[string]map[string]bool),
+		followsLock: lock.NewRWLock(),
+	}
+}
+
+// NewRegistryWithStats creates an empty registry like NewRegistry, where the feeds created by `newFeed` record
+// the statistics of their locks in `stats` (see lock.NewInstrumentedRWLock)
+func NewRegistryWithStats(newFeed func() Feed, stats *lock.Stats) *Registry {
+	r := NewRegistry(newFeed)
+	r.lockStats = stats
+	return r
+}
+
+// LockStats returns the statistics of the locks of the feeds, or nil if they are not collected
+func (r *Registry) LockStats() *lock.Stats {
+	return r.lockStats
+}
+
+// Feed returns the feed of `user`, creating an empty one if the user is new.
+func (r *Registry) Feed(user string) Feed {
+	// fast path: user already exists => only a reader lock is needed
+	r.feedsLock.RLock()
+	f, ok := r.feeds[user]
+	r.feedsLock.RUnlock()
+	if ok {
+		return f
+	}
+
+	// slow path: acquire a writer lock and check again; another thread might have
+	// created the feed while we were swapping locks
+	r.feedsLock.Lock()
+	defer r.feedsLock.Unlock()
+	if f, ok = r.feeds[user]; !ok {
+		f = r.newFeed()
+		r.feeds[user] = f
+	}
+	return f
+}
+
+// Len returns the number of posts in the feed of `user`, or 0 if the user is unknown. Unlike Feed, it never
+// creates a feed, so it can be asked about any user (e.g. to estimate the cost of a request) without growing
+// the registry.
+func (r *Registry) Len(user string) int {
+	r.feedsLock.RLock()
+	f, ok := r.feeds[user]
+	r.feedsLock.RUnlock()
+	if !ok {
+		return 0
+	}
+	return f.Len()
+}
+
+// Follow makes `user` follow `followee`. Returns false if `user` already follows
+// `followee` or if both are the same user.
+func (r *Registry) Follow(user string, followee string) bool {
+	if user == followee {
+		return false
+	}
+	r.followsLock.Lock()
+	defer r.followsLock.Unlock()
+
+	followees, ok := r.follows[user]
+	if !ok {
+		followees = make(map[string]bool)
+		r.follows[user] = followees
+	}
+	if followees[followee] {
+		return false
+	}
+	followees[followee] = true
+	return true
+}
+
+// Unfollow makes `user` stop following `followee`. Returns false if `user` was not following `followee`.
+func (r *Registry) Unfollow(user string, followee string) bool {
+	r.followsLock.Lock()
+	defer r.followsLock.Unlock()
+
+	if !r.follows[user][followee] {
+		return false
+	}
+	delete(r.follows[user], followee)
+	return true
+}
+
+// Following returns the users followed by `user`, sorted by name
+func (r *Registry) Following(user string) []string {
+	r.followsLock.RLock()
+	followees := make([]string, 0, len(r.follows[user]))
+	for followee := range r.follows[user] {
+		followees = append(followees, followee)
+	}
+	r.followsLock.RUnlock()
+
+	sort.Strings(followees)
+	return followees
+}
+
+// Timeline returns the posts of `user` and of everyone `user` follows, merged into a single
+// slice ordered from the most recent to the least recent timestamp.
+// Obs: each feed is read separately, so the timeline is a merge of per-feed snapshots and not
+// a snapshot of all feeds at a single point in time.
+func (r *Registry) Timeline(user string) []Post {
+	users := append(r.Following(user), user)
+
+	// take one snapshot per feed; each snapshot is already ordered by timestamp
+	snapshots := make(postHeap, 0, len(users))
+	total := 0
+	for _, u := range users {
+		if posts := r.Feed(u).ReturnFeed(); len(posts) > 0 {
+			snapshots = append(snapshots, posts)
+			total += len(posts)
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	// k-way merge: repeatedly take the most recent head among all snapshots
+	timeline := make([]Post, 0, total)
+	heap.Init(&snapshots)
+	for len(snapshots) > 0 {
+		timeline = append(timeline, snapshots[0][0])
+		snapshots[0] = snapshots[0][1:]
+		if len(snapshots[0]) == 0 {
+			heap.Pop(&snapshots)
+		} else {
+			heap.Fix(&snapshots, 0)
+		}
+	}
+	return timeline
+}
+
+// postHeap is a max-heap of feed snapshots keyed by the timestamp of their first (most recent) post.
+// It implements heap.Interface and is used to merge feeds in `Timeline`.
+type postHeap [][]Post
+
+func (h postHeap) Len() int            { return len(h) }
+func (h postHeap) Less(i, j int) bool  { return *h[i][0].Timestamp > *h[j][0].Timestamp }
+func (h postHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *postHeap) Push(x interface{}) { *h = append(*h, x.([]Post)) }
+func (h *postHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
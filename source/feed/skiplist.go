@@ -0,0 +1,277 @@
+// A thread-safe feed implemented as a lazy skip list a la Herlihy and Shavit.
+// Differences to the linked-list feeds: posts are linked in several levels so that `Add`, `Remove`
+// and `Contains` take O(log n) steps instead of walking the whole feed. There is no feed-wide lock:
+// writers lock only the predecessors of the post being added/removed, and `Contains` takes no lock at all.
+// Obs: as in the coarse-grained feed, posts with the same timestamp may coexist; `Remove` deletes one of them.
+// A new post goes before the posts with the same timestamp at every level.
+
+package feed
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// maxLevel is the number of levels of the skip list. With a probability of 1/2 of promoting a post
+// to the next level, 20 levels keep operations logarithmic for feeds of up to ~1 million posts.
+const maxLevel = 20
+
+// skipNode is a post in the skip list
+// Obs: `next`, `marked` and `fullyLinked` are read without locks, so they are atomics.
+type skipNode struct {
+	body 			string 								// the text of the post
+	timestamp 		float64 							// Unix timestamp of the post
+	content 		*Post 								// helper struct for returning the feed
+	next 			[maxLevel]atomic.Pointer[skipNode] 	// next post at each level
+	topLevel 		int 								// highest level the post is linked in
+	mux 			sync.Mutex 							// locks the post while its successors are updated
+	marked 			atomic.Bool 						// post is logically removed from the feed
+	fullyLinked 	atomic.Bool 						// post is linked at all of its levels
+}
+
+// skipListFeed is the internal representation of a user's twitter feed as a skip list
+type skipListFeed struct {
+	head 	*skipNode 		// sentinel with timestamp +Inf; the first post of every level
+	tail 	*skipNode 		// sentinel with timestamp -Inf; the last post of every level
+	size 	atomic.Int64 	// the number of posts in the feed
+}
+
+// newSkipNode creates a post linked up to level `topLevel`
+func newSkipNode(body string, timestamp float64, topLevel int) *skipNode {
+	n := &skipNode{body: body, timestamp: timestamp, topLevel: topLevel}
+	n.content = &Post{Body: &n.body, Timestamp: &n.timestamp}
+	return n
+}
+
+// NewSkipListFeed creates a empty user feed backed by a skip list and returns a pointer to it
+func NewSkipListFeed() Feed {
+	head := newSkipNode("", math.Inf(1), maxLevel-1)
+	tail := newSkipNode("", math.Inf(-1), maxLevel-1)
+	for level := 0; level < maxLevel; level++ {
+		head.next[level].Store(tail)
+	}
+	head.fullyLinked.Store(true)
+	tail.fullyLinked.Store(true)
+	return &skipListFeed{head: head, tail: tail}
+}
+
+// randomLevel returns the top level of a new post: level `l` with probability 1/2^(l+1)
+func randomLevel() int {
+	bits := rand.Int63()
+	level := 0
+	for level < maxLevel-1 && bits&1 == 1 {
+		level++
+		bits >>= 1
+	}
+	return level
+}
+
+// find fills `preds` and `succs` with the posts right before and right after `timestamp` at every level:
+// preds[level].timestamp > timestamp >= succs[level].timestamp
+// Obs: the feed is ordered from the most recent timestamp to the least recent, so
+// "before" means "more recent".
+func (f *skipListFeed) find(timestamp float64, preds *[maxLevel]*skipNode, succs *[maxLevel]*skipNode) {
+	pred := f.head
+	for level := maxLevel - 1; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr.timestamp > timestamp {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+		preds[level] = pred
+		succs[level] = curr
+	}
+}
+
+// findPost returns the first post with `timestamp` that is fully linked and not marked as removed,
+// or nil if there is none
+func (f *skipListFeed) findPost(timestamp float64) *skipNode {
+	var preds, succs [maxLevel]*skipNode
+	f.find(timestamp, &preds, &succs)
+	for curr := succs[0]; curr.timestamp == timestamp; curr = curr.next[0].Load() {
+		if curr.fullyLinked.Load() && !curr.marked.Load() {
+			return curr
+		}
+	}
+	return nil
+}
+
+// findPreds fills `preds` with the posts right before `victim` at every level it is linked in, and right before
+// the posts with its timestamp at the levels above
+// Obs: other posts with the same timestamp may be before the victim, so they are skipped at its levels
+func (f *skipListFeed) findPreds(victim *skipNode, preds *[maxLevel]*skipNode) {
+	pred := f.head
+	for level := maxLevel - 1; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr.timestamp > victim.timestamp ||
+			(level <= victim.topLevel && curr != victim && curr.timestamp == victim.timestamp) {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+		preds[level] = pred
+	}
+}
+
+// unlockPreds unlocks the (distinct) predecessors locked from level 0 up to `highestLocked`
+func unlockPreds(preds *[maxLevel]*skipNode, highestLocked int) {
+	var prevPred *skipNode
+	for level := 0; level <= highestLocked; level++ {
+		if preds[level] != prevPred {
+			preds[level].mux.Unlock()
+			prevPred = preds[level]
+		}
+	}
+}
+
+// Add inserts a new post to the feed. The feed is always ordered by the timestamp where
+// the most recent timestamp is at the beginning of the feed followed by the second most
+// recent timestamp, etc.
+func (f *skipListFeed) Add(body string, timestamp float64) {
+	var preds, succs [maxLevel]*skipNode
+	topLevel := randomLevel()
+
+	for {
+		f.find(timestamp, &preds, &succs)
+
+		// lock the predecessors bottom-up and check they are still valid, i.e.:
+		// - neither the predecessor nor the successor were removed
+		// - no other post was inserted between them
+		highestLocked := -1
+		valid := true
+		var prevPred *skipNode
+		for level := 0; valid && level <= topLevel; level++ {
+			pred, succ := preds[level], succs[level]
+			if pred != prevPred {
+				pred.mux.Lock()
+				highestLocked = level
+				prevPred = pred
+			}
+			valid = !pred.marked.Load() && !succ.marked.Load() && pred.next[level].Load() == succ
+		}
+		if !valid {
+			unlockPreds(&preds, highestLocked)
+			continue
+		}
+
+		// link the new post bottom-up; the post becomes visible to `Contains` once fully linked
+		node := newSkipNode(body, timestamp, topLevel)
+		for level := 0; level <= topLevel; level++ {
+			node.next[level].Store(succs[level])
+		}
+		for level := 0; level <= topLevel; level++ {
+			preds[level].next[level].Store(node)
+		}
+		node.fullyLinked.Store(true)
+		f.size.Add(1)
+		unlockPreds(&preds, highestLocked)
+		return
+	}
+}
+
+// Remove deletes the post with the given timestamp. If the timestamp
+// is not included in a post of the feed then the feed remains
+// unchanged. Return true if the deletion was a success, otherwise return false
+func (f *skipListFeed) Remove(timestamp float64) bool {
+	var preds [maxLevel]*skipNode
+
+	// logically remove a post with the timestamp: mark it while holding its lock
+	var victim *skipNode
+	for victim == nil {
+		victim = f.findPost(timestamp)
+		if victim == nil {
+			return false
+		}
+		victim.mux.Lock()
+		if victim.marked.Load() {
+			// another Remove marked it first: look for another post with the timestamp
+			victim.mux.Unlock()
+			victim = nil
+		}
+	}
+	victim.marked.Store(true)
+	f.size.Add(-1)
+	topLevel := victim.topLevel
+
+	for {
+		f.findPreds(victim, &preds)
+
+		// lock the predecessors bottom-up and check they still point to the victim
+		highestLocked := -1
+		valid := true
+		var prevPred *skipNode
+		for level := 0; valid && level <= topLevel; level++ {
+			pred := preds[level]
+			if pred != prevPred {
+				pred.mux.Lock()
+				highestLocked = level
+				prevPred = pred
+			}
+			valid = !pred.marked.Load() && pred.next[level].Load() == victim
+		}
+		if !valid {
+			unlockPreds(&preds, highestLocked)
+			continue
+		}
+
+		// physically remove the post top-down
+		for level := topLevel; level >= 0; level-- {
+			preds[level].next[level].Store(victim.next[level].Load())
+		}
+		victim.mux.Unlock()
+		unlockPreds(&preds, highestLocked)
+		return true
+	}
+}
+
+// Contains determines whether a post with the given timestamp is
+// inside a feed. The function returns true if there is a post
+// with the timestamp, otherwise, false.
+// Obs: no lock is taken; a post counts as in the feed if it is fully linked and not marked as removed.
+func (f *skipListFeed) Contains(timestamp float64) bool {
+	return f.findPost(timestamp) != nil
+}
+
+// ReturnFeed returns the whole feed as a slice of Post structs
+// Obs: the bottom level is traversed without locks, so concurrent updates may or may not be seen.
+func (f *skipListFeed) ReturnFeed() []Post {
+	return f.ReturnRange(math.Inf(-1), math.Inf(1), 0)
+}
+
+// ReturnRange returns the posts whose timestamp is strictly between `newerThan` and `olderThan`,
+// from the most recent to the least recent. At most `limit` posts are returned; `limit` <= 0 means no limit.
+func (f *skipListFeed) ReturnRange(newerThan float64, olderThan float64, limit int) []Post {
+	var feed []Post
+
+	// use the upper levels to skip the posts that are too recent
+	pred := f.head
+	for level := maxLevel - 1; level >= 0; level-- {
+		curr := pred.next[level].Load()
+		for curr != f.tail && curr.timestamp >= olderThan {
+			pred = curr
+			curr = pred.next[level].Load()
+		}
+	}
+
+	// collect posts from the bottom level until the range or the limit is exhausted
+	curr := pred.next[0].Load()
+	for curr != f.tail && curr.timestamp > newerThan && (limit <= 0 || len(feed) < limit) {
+		if curr.fullyLinked.Load() && !curr.marked.Load() {
+			feed = append(feed, *curr.content)
+		}
+		curr = curr.next[0].Load()
+	}
+	return feed
+}
+
+// Len returns the number of posts in the feed
+// Obs: posts count from the moment they are fully linked until they are marked as removed, as in `Contains`
+func (f *skipListFeed) Len() int {
+	return int(f.size.Load())
+}
+
+// ApplyBatch applies the adds and removes of `ops` in order, one by one: there is no feed-wide lock to amortize
+func (f *skipListFeed) ApplyBatch(ops []Op) []bool {
+	return applyEach(f, ops)
+}
@@ -0,0 +1,37 @@
+// Reading a feed with a deadline.
+// The lock-based feeds (`feed`, `optFeed` and `upgFeed`) take a feed-wide reader lock to read the feed, so a read
+// waits for as long as a writer holds the lock (e.g., while it applies a big batch). ReturnRangeCtx gives up
+// waiting once a context is done, so that the server can fail a request instead of blocking a consumer.
+// Obs: giving up needs a lock.TimedRWLock (the locks of NewRWLock and NewRWLockFaster, also when wrapped by
+// lock.NewInstrumentedRWLock or lock.NewDebugRWLock); with other locks, and with the feeds without a feed-wide
+// lock, the read waits as ReturnRange does.
+
+package feed
+
+import (
+	"context"
+	"proj2/lock"
+)
+
+// rangeReaderCtx is implemented by the feeds whose reads can give up waiting for their lock
+type rangeReaderCtx interface {
+	returnRangeCtx(ctx context.Context, newerThan float64, olderThan float64, limit int) ([]Post, error)
+}
+
+// ReturnRangeCtx returns f.ReturnRange(newerThan, olderThan, limit), unless `ctx` is done before the feed's
+// reader lock is acquired. Returns nil and the context's error in that case.
+func ReturnRangeCtx(ctx context.Context, f Feed, newerThan float64, olderThan float64, limit int) ([]Post, error) {
+	if rf, ok := f.(rangeReaderCtx); ok {
+		return rf.returnRangeCtx(ctx, newerThan, olderThan, limit)
+	}
+	return f.ReturnRange(newerThan, olderThan, limit), nil
+}
+
+// rLockCtx acquires a reader lock of `rw`, giving up once `ctx` is done if `rw` is a lock.TimedRWLock
+func rLockCtx(ctx context.Context, rw lock.RWLock) error {
+	if timed, ok := rw.(lock.TimedRWLock); ok {
+		return timed.RLockCtx(ctx)
+	}
+	rw.RLock()
+	return nil
+}
@@ -0,0 +1,57 @@
+// A thread-safe feed implemented as a linked list using an upgradable read lock.
+// Differences to the implementation in `feed2`: the optimistic feed traverses under a READ lock, swaps it for
+// a WRITE lock and must revalidate, retrying from the beginning if another writer changed the feed in between.
+// Here, writers traverse under an UPGRADABLE read lock, which shares the feed with the readers but not with other
+// writers or upgraders, and then upgrade it atomically: nobody can change the feed between the traversal and the
+// update, so the update point found is always valid and writers never retry.
+// Obs: writers are still serialized among themselves (as with the coarse-grained lock), but readers are only
+// blocked while the update itself is made, not during the writers' traversals.
+
+package feed
+
+import (
+	"proj2/lock"
+)
+
+// upgFeed is the internal representation of a user's twitter feed using an upgradable read lock.
+// The read operations are those of the optimistic feed, which take a READ lock of the same lock.
+type upgFeed struct {
+	*optFeed
+	uLock 		lock.UpgradableRWLock 	// the lock of the feed, as an upgradable lock
+}
+
+// NewUpgradableFeed creates a empty user feed using an upgradable read lock and returns a pointer to it
+func NewUpgradableFeed() Feed {
+	return NewUpgradableFeedWithLock(lock.NewUpgradableRWLock())
+}
+
+// NewUpgradableFeedWithLock creates a empty user feed that synchronizes with `uLock` and returns a pointer to it
+func NewUpgradableFeedWithLock(uLock lock.UpgradableRWLock) Feed {
+	return &upgFeed{optFeed: NewOptFeedWithLock(uLock).(*optFeed), uLock: uLock}
+}
+
+// Add inserts a new post to the feed, keeping the feed ordered from the most recent to the least recent post
+func (f *upgFeed) Add(body string, timestamp float64) {
+	f.uLock.ULock()
+	curPost := f.findPred(timestamp)
+	// no writer could have changed the feed since the traversal: the insertion point is still valid
+	f.uLock.Upgrade()
+	f.add(curPost, newPost(body, timestamp, nil))
+	f.uLock.Unlock()
+}
+
+// Remove deletes the post with the given timestamp. If the timestamp is not included in a post of the feed
+// then the feed remains unchanged. Return true if the deletion was a success, otherwise return false
+func (f *upgFeed) Remove(timestamp float64) bool {
+	f.uLock.ULock()
+	curPost := f.findPred(timestamp)
+	// if the post is not in the feed, there is nothing to update
+	if curPost.next == nil || curPost.next.timestamp != timestamp {
+		f.uLock.UUnlock()
+		return false
+	}
+	f.uLock.Upgrade()
+	f.remove(curPost, timestamp)
+	f.uLock.Unlock()
+	return true
+}
@@ -0,0 +1,383 @@
+// Debug mode of the r/w locks: ownership tracking and deadlock detection.
+// NewDebugRWLock wraps a r/w lock and records which goroutines (see GetGID) hold it and which ones wait for it.
+// Releasing a lock the caller does not hold panics, instead of corrupting the lock or unlocking it on behalf of
+// another goroutine:
+// - Unlock by a goroutine other than the writer holding the lock
+// - Unlock of a lock no writer holds (e.g., a double unlock)
+// - RUnlock by a goroutine that does not hold a reader lock (an RUnlock without RLock, or a double RUnlock)
+// Every debug lock reports to a Watchdog, which may be shared by many locks (e.g., the locks of the feeds of every
+// user). When a lock is held longer than the watchdog's threshold, the watchdog reports the wait-for graph of all
+// its locks: who holds each lock, who waits for it and since when, and the cycles of goroutines waiting for each
+// other (i.e., the deadlocks).
+// Obs: a lock must be released by the goroutine that acquired it, which sync.RWMutex does not require.
+// Obs2: all the debug locks of a watchdog share its mutex and GetGID reads the stack of the caller, so a debug
+// lock is much slower than the lock it wraps. Meant for debugging only.
+
+package lock
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHoldThreshold is the hold time after which a watchdog reports a lock, if not set
+const DefaultHoldThreshold = time.Second
+
+// hold represents a goroutine holding, or waiting for, a debug lock
+type hold struct {
+	gid 		uint64
+	write 		bool 			// writer lock
+	since 		time.Time 		// when it got the lock / started waiting
+	caller 		string 			// file:line of the call to (R)Lock
+	count 		int 			// # reader locks held by the goroutine (a reader may hold the lock more than once)
+	timer 		*time.Timer 	// reports the hold once it exceeds the threshold; nil if there is no threshold
+}
+
+// Watchdog tracks the holders and waiters of debug locks and reports the locks held for too long
+type Watchdog struct {
+	mutex 		sync.Mutex 				// guards the state of every lock of the watchdog
+	threshold 	time.Duration 			// a lock held longer is reported; <= 0 means never
+	report 		func(dump string) 		// receives the reports
+	locks 		[]*debugRWLock 			// the locks of the watchdog, by id
+	waiting 	map[uint64]*hold 		// the goroutines waiting for a lock (one at most per goroutine)
+	waitingFor 	map[uint64]*debugRWLock // the lock each waiting goroutine waits for
+}
+
+// NewWatchdog creates a watchdog calling `report` with the wait-for graph of its locks when one of them is held
+// longer than `threshold` (once per acquisition). If `threshold` <= 0, the locks are never reported.
+func NewWatchdog(threshold time.Duration, report func(dump string)) *Watchdog {
+	return &Watchdog{threshold: threshold, report: report, waiting: map[uint64]*hold{},
+		waitingFor: map[uint64]*debugRWLock{}}
+}
+
+// debugRWLock is the internal representation of a r/w lock tracking its holders
+type debugRWLock struct {
+	rw 			RWLock 				// the lock being debugged
+	w 			*Watchdog
+	id 			int 				// index of the lock in the watchdog's locks
+	writer 		*hold 				// the writer holding the lock; nil if none
+	readers 	map[uint64]*hold 	// the readers holding the lock, by goroutine id
+}
+
+// NewDebugRWLock returns `rw` tracking its holders and reporting to `w`. The lock panics when released by a
+// goroutine not holding it. If `rw` is a TimedRWLock, so is the returned lock; a waiter giving up is no longer
+// tracked.
+func NewDebugRWLock(rw RWLock, w *Watchdog) RWLock {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	l := &debugRWLock{rw: rw, w: w, id: len(w.locks), readers: map[uint64]*hold{}}
+	w.locks = append(w.locks, l)
+	if timed, ok := rw.(TimedRWLock); ok {
+		return &timedDebugRWLock{debugRWLock: l, timed: timed}
+	}
+	return l
+}
+
+// caller returns the file:line of the caller of the lock's method
+func caller() string {
+	_, file, line, ok := runtime.Caller(4)
+	if !ok {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// RLock acquires the reader lock, recording the caller as a waiter and then as a holder
+func (l *debugRWLock) RLock() {
+	l.acquire(false, func() bool {
+		l.rw.RLock()
+		return true
+	})
+}
+
+// acquire acquires the lock with `acquire`, recording the caller as a waiter and then, if `acquire` returns true,
+// as a holder. Returns the result of `acquire`.
+func (l *debugRWLock) acquire(write bool, acquire func() bool) bool {
+	h := l.w.wait(l, write)
+	if !acquire() {
+		l.w.gaveUp(h)
+		return false
+	}
+	l.w.acquired(l, h)
+	return true
+}
+
+// RUnlock releases the reader lock. Panics if the caller does not hold it.
+func (l *debugRWLock) RUnlock() {
+	l.w.release(l, false)
+	l.rw.RUnlock()
+}
+
+// Lock acquires the writer lock, recording the caller as a waiter and then as the holder
+func (l *debugRWLock) Lock() {
+	l.acquire(true, func() bool {
+		l.rw.Lock()
+		return true
+	})
+}
+
+// Unlock releases the writer lock. Panics if the caller does not hold it.
+func (l *debugRWLock) Unlock() {
+	l.w.release(l, true)
+	l.rw.Unlock()
+}
+
+// wait records the caller as waiting for `l`
+func (w *Watchdog) wait(l *debugRWLock, write bool) *hold {
+	h := &hold{gid: GetGID(), write: write, since: time.Now(), caller: caller()}
+	w.mutex.Lock()
+	w.waiting[h.gid] = h
+	w.waitingFor[h.gid] = l
+	w.mutex.Unlock()
+	return h
+}
+
+// gaveUp removes the goroutine of `h` from the waiters
+func (w *Watchdog) gaveUp(h *hold) {
+	w.mutex.Lock()
+	delete(w.waiting, h.gid)
+	delete(w.waitingFor, h.gid)
+	w.mutex.Unlock()
+}
+
+// acquired records the goroutine of `h` as a holder of `l`, starting the timer reporting a long hold
+func (w *Watchdog) acquired(l *debugRWLock, h *hold) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	delete(w.waiting, h.gid)
+	delete(w.waitingFor, h.gid)
+
+	// a reader already holding the lock keeps its first hold
+	if held, ok := l.readers[h.gid]; ok && !h.write {
+		held.count++
+		return
+	}
+	h.since = time.Now()
+	h.count = 1
+	if h.write {
+		l.writer = h
+	} else {
+		l.readers[h.gid] = h
+	}
+	if w.threshold > 0 {
+		h.timer = time.AfterFunc(w.threshold, func() { w.overdue(l, h) })
+	}
+}
+
+// release removes the caller from the holders of `l`. Panics if it does not hold the lock.
+// Obs: the panic happens before the lock is released, so the lock stays held by its actual holders
+func (w *Watchdog) release(l *debugRWLock, write bool) {
+	gid := GetGID()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var h *hold
+	if write {
+		switch {
+		case l.writer == nil:
+			panic(fmt.Sprintf("lock: Unlock by goroutine %d of lock %d, which no writer holds (double unlock?)", gid, l.id))
+		case l.writer.gid != gid:
+			panic(fmt.Sprintf("lock: Unlock by goroutine %d of lock %d, held by goroutine %d", gid, l.id, l.writer.gid))
+		}
+		h, l.writer = l.writer, nil
+	} else {
+		h = l.readers[gid]
+		if h == nil {
+			panic(fmt.Sprintf("lock: RUnlock by goroutine %d of lock %d without RLock", gid, l.id))
+		}
+		if h.count--; h.count > 0 {
+			return
+		}
+		delete(l.readers, gid)
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+}
+
+// timedDebugRWLock is a debug lock wrapping a TimedRWLock, which gives up like the lock it wraps
+type timedDebugRWLock struct {
+	*debugRWLock
+	timed 		TimedRWLock 	// the lock being debugged
+}
+
+// TryRLock acquires the reader lock only if it can be acquired without waiting, recording the caller if acquired
+func (l *timedDebugRWLock) TryRLock() bool {
+	return l.acquire(false, l.timed.TryRLock)
+}
+
+// TryLock acquires the writer lock only if it can be acquired without waiting, recording the caller if acquired
+func (l *timedDebugRWLock) TryLock() bool {
+	return l.acquire(true, l.timed.TryLock)
+}
+
+// RLockTimeout acquires the reader lock, waiting at most `d` for it, recording the caller as a waiter meanwhile
+func (l *timedDebugRWLock) RLockTimeout(d time.Duration) bool {
+	return l.acquire(false, func() bool { return l.timed.RLockTimeout(d) })
+}
+
+// LockTimeout acquires the writer lock, waiting at most `d` for it, recording the caller as a waiter meanwhile
+func (l *timedDebugRWLock) LockTimeout(d time.Duration) bool {
+	return l.acquire(true, func() bool { return l.timed.LockTimeout(d) })
+}
+
+// RLockCtx acquires the reader lock, waiting for it until `ctx` is done, recording the caller as a waiter meanwhile
+func (l *timedDebugRWLock) RLockCtx(ctx context.Context) error {
+	var err error
+	l.acquire(false, func() bool {
+		err = l.timed.RLockCtx(ctx)
+		return err == nil
+	})
+	return err
+}
+
+// LockCtx acquires the writer lock, waiting for it until `ctx` is done, recording the caller as a waiter meanwhile
+func (l *timedDebugRWLock) LockCtx(ctx context.Context) error {
+	var err error
+	l.acquire(true, func() bool {
+		err = l.timed.LockCtx(ctx)
+		return err == nil
+	})
+	return err
+}
+
+// overdue reports the wait-for graph if the goroutine of `h` still holds `l`
+func (w *Watchdog) overdue(l *debugRWLock, h *hold) {
+	w.mutex.Lock()
+	if l.writer != h && l.readers[h.gid] != h {
+		w.mutex.Unlock()
+		return
+	}
+	dump := fmt.Sprintf("lock: lock %d held by goroutine %d for longer than %v\n", l.id, h.gid, w.threshold) +
+		w.dumpLocked()
+	w.mutex.Unlock()
+	w.report(dump)
+}
+
+// Dump returns the wait-for graph of the locks of the watchdog
+func (w *Watchdog) Dump() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.dumpLocked()
+}
+
+// dumpLocked returns the wait-for graph of the locks. Must be called with the watchdog's mutex held.
+// The graph has an edge from each waiting goroutine to each goroutine holding the lock it waits for.
+func (w *Watchdog) dumpLocked() string {
+	var dump strings.Builder
+	now := time.Now()
+	since := func(h *hold) string {
+		return fmt.Sprintf("for %v (at %s)", now.Sub(h.since).Round(time.Microsecond), h.caller)
+	}
+
+	// holders and waiters of each lock with any
+	waiters := make([][]*hold, len(w.locks))
+	for gid, l := range w.waitingFor {
+		waiters[l.id] = append(waiters[l.id], w.waiting[gid])
+	}
+	for _, l := range w.locks {
+		if l.writer == nil && len(l.readers) == 0 && len(waiters[l.id]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&dump, "lock %d:\n", l.id)
+		if l.writer != nil {
+			fmt.Fprintf(&dump, "\twrite-locked by goroutine %d %s\n", l.writer.gid, since(l.writer))
+		}
+		for _, h := range sortedHolds(l.readers) {
+			fmt.Fprintf(&dump, "\tread-locked by goroutine %d %s\n", h.gid, since(h))
+		}
+		sort.Slice(waiters[l.id], func(i, j int) bool { return waiters[l.id][i].gid < waiters[l.id][j].gid })
+		for _, h := range waiters[l.id] {
+			mode := "read"
+			if h.write {
+				mode = "write"
+			}
+			fmt.Fprintf(&dump, "\tgoroutine %d waiting to %s %s\n", h.gid, mode, since(h))
+		}
+	}
+
+	// edges of the graph
+	edges := map[uint64][]uint64{}
+	var gids []uint64
+	for gid := range w.waitingFor {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+	dump.WriteString("wait-for graph:\n")
+	for _, gid := range gids {
+		l := w.waitingFor[gid]
+		holders := sortedHolds(l.readers)
+		if l.writer != nil {
+			holders = append([]*hold{l.writer}, holders...)
+		}
+		for _, h := range holders {
+			edges[gid] = append(edges[gid], h.gid)
+			fmt.Fprintf(&dump, "\tgoroutine %d -> goroutine %d (lock %d)\n", gid, h.gid, l.id)
+		}
+	}
+	for _, cycle := range findCycles(gids, edges) {
+		fmt.Fprintf(&dump, "deadlock: goroutine %d", cycle[0])
+		for _, gid := range cycle[1:] {
+			fmt.Fprintf(&dump, " -> goroutine %d", gid)
+		}
+		dump.WriteString("\n")
+	}
+	return dump.String()
+}
+
+// sortedHolds returns the holds of `readers` sorted by goroutine id
+func sortedHolds(readers map[uint64]*hold) []*hold {
+	holds := make([]*hold, 0, len(readers))
+	for _, h := range readers {
+		holds = append(holds, h)
+	}
+	sort.Slice(holds, func(i, j int) bool { return holds[i].gid < holds[j].gid })
+	return holds
+}
+
+// findCycles returns the cycles of the graph with `edges` found by a depth-first search from `nodes`, each as the
+// path from a goroutine back to itself. Each cycle is found once, although not every cycle sharing goroutines with
+// another one is.
+func findCycles(nodes []uint64, edges map[uint64][]uint64) [][]uint64 {
+	const (
+		unvisited = iota
+		onPath 			// on the path of the search
+		visited 		// all its successors were searched
+	)
+	state := map[uint64]int{}
+	var path []uint64
+	var cycles [][]uint64
+
+	var search func(gid uint64)
+	search = func(gid uint64) {
+		state[gid] = onPath
+		path = append(path, gid)
+		for _, next := range edges[gid] {
+			switch state[next] {
+			case unvisited:
+				search(next)
+			case onPath:
+				// the path from `next` to `gid`, back to `next`
+				start := len(path) - 1
+				for path[start] != next {
+					start--
+				}
+				cycle := append(append([]uint64{}, path[start:]...), next)
+				cycles = append(cycles, cycle)
+			}
+		}
+		path = path[:len(path)-1]
+		state[gid] = visited
+	}
+	for _, gid := range nodes {
+		if state[gid] == unvisited {
+			search(gid)
+		}
+	}
+	return cycles
+}
@@ -0,0 +1,179 @@
+package lock
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// panics returns the value `f` panicked with, or nil
+func panics(f func()) (value interface{}) {
+	defer func() { value = recover() }()
+	f()
+	return nil
+}
+
+// inGoroutine runs `f` in a new goroutine and returns the value it panicked with, or nil
+func inGoroutine(f func()) interface{} {
+	value := make(chan interface{})
+	go func() { value <- panics(f) }()
+	return <-value
+}
+
+func TestDebugMisuse(t *testing.T) {
+	inner := NewRWLock()
+	rw := NewDebugRWLock(inner, NewWatchdog(0, nil))
+
+	rw.Lock()
+	if inGoroutine(rw.Unlock) == nil {
+		t.Error("Expected a panic on Unlock by a goroutine not holding the lock")
+	}
+	// the lock is still held by its owner
+	if inner.(TimedRWLock).TryRLock() {
+		t.Fatal("The failed Unlock released the lock")
+	}
+	rw.Unlock()
+
+	rw.RLock()
+	if panics(rw.Unlock) == nil {
+		t.Error("Expected a panic on Unlock of a lock held by a reader")
+	}
+	rw.RUnlock()
+	if value := panics(rw.RUnlock); value == nil || !strings.Contains(value.(string), "without RLock") {
+		t.Errorf("Expected a panic on a double RUnlock. Got:%v", value)
+	}
+	rw.Lock()
+	rw.Unlock()
+	if value := panics(rw.Unlock); value == nil || !strings.Contains(value.(string), "double unlock") {
+		t.Errorf("Expected a panic on a double Unlock. Got:%v", value)
+	}
+
+	// a reader may hold the lock more than once, and another goroutine cannot release it
+	rw.RLock()
+	rw.RLock()
+	if inGoroutine(rw.RUnlock) == nil {
+		t.Error("Expected a panic on RUnlock by a goroutine not holding the lock")
+	}
+	rw.RUnlock()
+	rw.RUnlock()
+	if blocked, _ := waits(func() { rw.Lock(); rw.Unlock() }); blocked {
+		t.Error("The lock was not released by its reader")
+	}
+}
+
+func TestDebugTimed(t *testing.T) {
+	// the debug lock gives up like the lock it wraps, and a waiter giving up is no longer tracked
+	w := NewWatchdog(0, nil)
+	rw, ok := NewDebugRWLock(NewRWLock(), w).(TimedRWLock)
+	if !ok {
+		t.Fatal("Expected the debug lock of a TimedRWLock to be a TimedRWLock")
+	}
+	if _, ok := NewDebugRWLock(NewRWLockAtomic(), w).(TimedRWLock); ok {
+		t.Error("Expected the debug lock of a lock that cannot give up not to be a TimedRWLock")
+	}
+	rw.Lock()
+	if inGoroutine(func() {
+		if rw.TryRLock() || rw.RLockTimeout(time.Millisecond) || rw.LockTimeout(time.Millisecond) {
+			panic("acquired")
+		}
+	}) != nil {
+		t.Error("An acquisition of the lock held by a writer did not give up")
+	}
+	if dump := w.Dump(); strings.Contains(dump, "waiting") {
+		t.Errorf("Expected no waiters after giving up. Got:\n%s", dump)
+	}
+	rw.Unlock()
+	if !rw.TryLock() {
+		t.Fatal("A writer did not get the free lock")
+	}
+	if dump := w.Dump(); !strings.Contains(dump, "write-locked") || !strings.Contains(dump, "debug_test.go") {
+		t.Errorf("Expected the writer and its caller in the dump. Got:\n%s", dump)
+	}
+	rw.Unlock()
+}
+
+func TestWatchdogReport(t *testing.T) {
+	reports := make(chan string, 10)
+	w := NewWatchdog(20*time.Millisecond, func(dump string) { reports <- dump })
+	rw := NewDebugRWLock(NewRWLock(), w)
+
+	// a hold shorter than the threshold is not reported
+	rw.Lock()
+	rw.Unlock()
+
+	rw.Lock()
+	blocked, done := waits(func() { rw.RLock(); rw.RUnlock() })
+	if !blocked {
+		t.Fatal("A reader got the lock held by a writer")
+	}
+	var dump string
+	select {
+	case dump = <-reports:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The watchdog did not report the lock held for too long")
+	}
+	for _, expected := range []string{"write-locked by goroutine", "waiting to read", "-> goroutine"} {
+		if !strings.Contains(dump, expected) {
+			t.Errorf("Expected %q in the report. Got:\n%s", expected, dump)
+		}
+	}
+	if strings.Contains(dump, "deadlock") || !strings.Contains(dump, "debug_test.go") {
+		t.Errorf("Expected the callers and no deadlock in the report. Got:\n%s", dump)
+	}
+	rw.Unlock()
+	<-done
+	select {
+	case dump = <-reports:
+		t.Errorf("Expected a single report. Got another one:\n%s", dump)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWatchdogDeadlock(t *testing.T) {
+	reports := make(chan string, 10)
+	w := NewWatchdog(20*time.Millisecond, func(dump string) { reports <- dump })
+	inner1, inner2 := NewRWLock(), NewRWLock()
+	rw1, rw2 := NewDebugRWLock(inner1, w), NewDebugRWLock(inner2, w)
+
+	// two goroutines take the locks in opposite orders
+	locked := make(chan bool)
+	proceed := make(chan bool)
+	done := make(chan bool)
+	take := func(first RWLock, second RWLock) {
+		first.Lock()
+		locked <- true
+		<-proceed
+		second.Lock()
+		done <- true
+	}
+	go take(rw1, rw2)
+	go take(rw2, rw1)
+	<-locked
+	<-locked
+	close(proceed)
+
+	select {
+	case dump := <-reports:
+		if !strings.Contains(dump, "deadlock: goroutine") {
+			t.Errorf("Expected the deadlock in the report. Got:\n%s", dump)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The watchdog did not report the deadlock")
+	}
+
+	// release the goroutines by unlocking the wrapped locks; they do not release the debug locks
+	inner1.Unlock()
+	<-done
+	inner2.Unlock()
+	<-done
+}
+
+func TestFindCycles(t *testing.T) {
+	// 1 -> 2 -> 3 -> 1, 4 -> 4 (a writer waiting for its own reader lock) and 5 -> 1, not in a cycle
+	edges := map[uint64][]uint64{1: {2}, 2: {3}, 3: {1}, 4: {4}, 5: {1}}
+	cycles := findCycles([]uint64{1, 2, 3, 4, 5}, edges)
+	if len(cycles) != 2 || len(cycles[0]) != 4 || cycles[0][0] != 1 || cycles[0][3] != 1 ||
+		len(cycles[1]) != 2 || cycles[1][0] != 4 {
+		t.Errorf("Expected the cycles [1 2 3 1] and [4 4]. Got:%v", cycles)
+	}
+}
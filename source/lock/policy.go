@@ -0,0 +1,63 @@
+// Policies of the r/w lock built by NewRWLock.
+// A policy decides who gets the lock when readers and writers are waiting for it:
+// - WriterPreferred (default): a waiting writer blocks the readers that arrive after it, so writers are never
+// starved, but a stream of writers starves the readers
+// - ReaderPreferred: readers get the lock whenever no writer holds it, so readers are never starved, but a
+// stream of overlapping readers starves the writers
+// - FairPolicy: readers and writers get the lock in the order they asked for it (each one takes a ticket, as
+// in a ticket lock); consecutive readers still share the lock. Nobody starves, at the cost of readers
+// waiting behind an earlier writer even if the lock is held by readers.
+// The number of readers holding the lock at once is capped (DefaultMaxReaders, see WithMaxReaders).
+
+package lock
+
+import (
+	"math"
+)
+
+// Policy represents who gets a r/w lock first when readers and writers are waiting for it
+type Policy int
+
+const (
+	WriterPreferred Policy = iota 	// waiting writers go before new readers
+	ReaderPreferred 				// new readers go before waiting writers
+	FairPolicy 						// first come, first served
+)
+
+// DefaultMaxReaders is the maximum number of readers holding a r/w lock at once, if not set with WithMaxReaders
+const DefaultMaxReaders = 32
+
+// options holds the configuration of a r/w lock
+type options struct {
+	policy 		Policy
+	maxReaders 	int 		// maximum number of readers holding the lock at once
+}
+
+// Option configures a r/w lock created by NewRWLock
+type Option func(*options)
+
+// WithPolicy sets the policy of the lock
+func WithPolicy(policy Policy) Option {
+	return func(o *options) {
+		o.policy = policy
+	}
+}
+
+// WithMaxReaders sets the maximum number of readers holding the lock at once; n <= 0 means no limit
+func WithMaxReaders(n int) Option {
+	return func(o *options) {
+		if n <= 0 {
+			n = math.MaxInt
+		}
+		o.maxReaders = n
+	}
+}
+
+// newOptions returns the configuration given by `opts` over the default one
+func newOptions(opts []Option) options {
+	o := options{policy: WriterPreferred, maxReaders: DefaultMaxReaders}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
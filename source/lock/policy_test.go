@@ -0,0 +1,128 @@
+package lock
+
+import (
+	"testing"
+	"time"
+)
+
+// waits returns true if `f` does not return within 20ms; in that case, f keeps running in the background
+// and `done` is closed once it returns
+func waits(f func()) (bool, chan bool) {
+	done := make(chan bool)
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return false, done
+	case <-time.After(20 * time.Millisecond):
+		return true, done
+	}
+}
+
+// acquireInTurn makes a writer hold `rw` while a reader, a writer and a reader, in this order, ask for the lock.
+// Returns the order in which they got it.
+func acquireInTurn(rw RWLock) []string {
+	order := make(chan string, 3)
+	rw.Lock()
+	for _, name := range []string{"r1", "w2", "r3"} {
+		go func(name string) {
+			if name[0] == 'w' {
+				rw.Lock()
+				order <- name
+				time.Sleep(10 * time.Millisecond)
+				rw.Unlock()
+			} else {
+				rw.RLock()
+				order <- name
+				time.Sleep(10 * time.Millisecond)
+				rw.RUnlock()
+			}
+		}(name)
+		// let the goroutine get in line before the next one
+		time.Sleep(20 * time.Millisecond)
+	}
+	rw.Unlock()
+	return []string{<-order, <-order, <-order}
+}
+
+func TestWriterPreferred(t *testing.T) {
+	// the waiting writer goes before both readers, although r1 asked first
+	order := acquireInTurn(NewRWLock(WithPolicy(WriterPreferred)))
+	if order[0] != "w2" {
+		t.Errorf("Expected the writer first. Got:%v", order)
+	}
+}
+
+func TestReaderPreferred(t *testing.T) {
+	// a reader joins the readers holding the lock, although a writer asked for it first
+	// Obs: acquireInTurn is not used here: when the first writer releases the lock, the waiting readers and
+	// writer compete for it, and the writer may win
+	rw := NewRWLock(WithPolicy(ReaderPreferred))
+	rw.RLock()
+	blocked, done := waits(rw.Lock)
+	if !blocked {
+		t.Fatal("A writer got the lock held by a reader")
+	}
+	if blocked, _ := waits(func() { rw.RLock(); rw.RUnlock() }); blocked {
+		t.Error("A reader waited for the waiting writer")
+	}
+	rw.RUnlock()
+	<-done
+	rw.Unlock()
+}
+
+func TestFairPolicy(t *testing.T) {
+	// first come, first served
+	order := acquireInTurn(NewRWLock(WithPolicy(FairPolicy)))
+	if order[0] != "r1" || order[1] != "w2" || order[2] != "r3" {
+		t.Errorf("Expected the order r1, w2, r3. Got:%v", order)
+	}
+}
+
+func TestFairReadersShare(t *testing.T) {
+	// consecutive readers hold the lock together under the fair policy
+	rw := NewRWLock(WithPolicy(FairPolicy))
+	rw.RLock()
+	done := make(chan bool)
+	go func() {
+		rw.RLock()
+		rw.RUnlock()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("A reader waited for another reader")
+	}
+	rw.RUnlock()
+}
+
+func TestMaxReaders(t *testing.T) {
+	for _, policy := range []Policy{WriterPreferred, ReaderPreferred, FairPolicy} {
+		rw := NewRWLock(WithPolicy(policy), WithMaxReaders(2))
+		rw.RLock()
+		rw.RLock()
+
+		// a third reader waits until one of the readers leaves
+		done := make(chan bool)
+		go func() {
+			rw.RLock()
+			done <- true
+			rw.RUnlock()
+		}()
+		select {
+		case <-done:
+			t.Fatalf("Policy %v: more than 2 readers got the lock", policy)
+		case <-time.After(20 * time.Millisecond):
+		}
+		rw.RUnlock()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Policy %v: the waiting reader was not woken up", policy)
+		}
+		rw.RUnlock()
+	}
+}
@@ -3,14 +3,16 @@
 package lock
 
 import (
+	"context"
 	"sync"
 	"runtime"
 	"bytes"
 	"strconv"
+	"time"
 )
 
-// maxReaders is the maximum number of readers allowed to enter the critical section
-const maxReaders = 32;
+// maxReaders is the maximum number of readers allowed to enter the critical section of a rwLockFaster
+const maxReaders = DefaultMaxReaders;
 
 // RWLock represents a reader/writer lock
 type RWLock interface {
@@ -20,38 +22,146 @@ type RWLock interface {
 	RUnlock()
 }
 
+// TimedRWLock represents a reader/writer lock whose acquisition can give up instead of waiting indefinitely
+// @TryLock, @TryRLock: acquire the lock only if it can be acquired without waiting. Return true if acquired.
+// @LockTimeout, @RLockTimeout: wait at most `d` for the lock. Return true if acquired.
+// @LockCtx, @RLockCtx: wait for the lock until `ctx` is done. Return nil if acquired or else the context's error.
+// Obs: a lock that can be acquired right away is acquired, even if the timeout is 0 or the context is done
+type TimedRWLock interface {
+	RWLock
+	TryLock() bool
+	TryRLock() bool
+	LockTimeout(d time.Duration) bool
+	RLockTimeout(d time.Duration) bool
+	LockCtx(ctx context.Context) error
+	RLockCtx(ctx context.Context) error
+}
+
+// UpgradableRWLock represents a reader/writer lock with an upgradable read mode
+// @ULock: acquires an upgradable read lock, shared with the plain readers but with no other upgrader or writer
+// @UUnlock: releases an upgradable read lock that was not upgraded
+// @Upgrade: atomically promotes the caller's upgradable read lock to a writer lock, waiting for the readers to
+// leave. No writer can get the lock in between, so what the caller read is still valid. Release with Unlock.
+// @Downgrade: atomically turns the caller's writer lock into a reader lock. Release with RUnlock.
+type UpgradableRWLock interface {
+	RWLock
+	ULock()
+	UUnlock()
+	Upgrade()
+	Downgrade()
+}
+
 // rwlock is the internal representation of a r/w lock
+// Obs: the tickets are only used by FairPolicy: `nextTicket` is the ticket of the next reader/writer to arrive and
+// `serving` the ticket of the next one to get the lock. A reader/writer that gives up waiting leaves its ticket
+// in `abandoned`, so that the turn skips it.
 type rwLock struct {
 	mutex       *sync.Mutex
 	cond        *sync.Cond
-	readerCount int
-	writerCount int
-	writerWait  bool
+	readerCount int 		// # readers holding the lock
+	writerCount int 		// # writers waiting for or holding the lock
+	writerWait  bool 		// a writer holds the lock
+	upgrader 	bool 		// an upgradable reader holds the lock
+	upgrading 	bool 		// the upgradable reader is waiting for the readers to leave to become a writer
+	nextTicket 	uint64
+	serving 	uint64
+	abandoned 	map[uint64]bool
+	options 				// policy and reader cap; see policy.go
 }
 
-// NewRWLock creates and returns a new r/w lock
-func NewRWLock() RWLock {
+// NewRWLock creates and returns a new r/w lock, writer-preferred with at most DefaultMaxReaders readers
+// unless configured otherwise by `opts`. The lock is also a TimedRWLock and an UpgradableRWLock.
+func NewRWLock(opts ...Option) RWLock {
 	var mutex sync.Mutex
 	condVar := sync.NewCond(&mutex)
-	return &rwLock{mutex: &mutex, cond: condVar}
+	return &rwLock{mutex: &mutex, cond: condVar, options: newOptions(opts)}
 }
 
-// RLock acuires a reader if there is no writer using the lock and if there are less than `maxReaders` readers
-func (rw *rwLock) RLock() {
-	rw.mutex.Lock()
+// NewUpgradableRWLock creates and returns a new r/w lock with an upgradable read mode, configured like NewRWLock
+// Obs: the upgrader follows the policy of the lock: with ReaderPreferred, readers that keep coming can delay
+// an Upgrade forever
+func NewUpgradableRWLock(opts ...Option) UpgradableRWLock {
+	return NewRWLock(opts...).(*rwLock)
+}
 
-	// if writer is waiting, wait
-	for rw.writerCount > 0 {
-		rw.cond.Wait()
+// canRead returns true if a reader holding `ticket` can get the lock. Must be called with the mutex held.
+func (rw *rwLock) canRead(ticket uint64) bool {
+	// if a writer is writing or there are `maxReaders` readers, wait
+	if rw.writerWait || rw.readerCount >= rw.maxReaders {
+		return false
+	}
+	switch rw.policy {
+	case ReaderPreferred:
+		return true
+	case FairPolicy:
+		return ticket == rw.serving && !rw.upgrading
+	}
+	// if writer is waiting (including an upgrader), wait
+	return rw.writerCount == 0
+}
+
+// canWrite returns true if a writer holding `ticket` can get the lock. Must be called with the mutex held.
+func (rw *rwLock) canWrite(ticket uint64) bool {
+	if rw.readerCount > 0 || rw.writerWait || rw.upgrader {
+		return false
+	}
+	return rw.policy != FairPolicy || ticket == rw.serving
+}
+
+// advance passes the turn to the next ticket not abandoned (fair policy only). Must be called with the mutex held.
+func (rw *rwLock) advance() {
+	rw.serving++
+	for rw.abandoned[rw.serving] {
+		delete(rw.abandoned, rw.serving)
+		rw.serving++
 	}
+}
+
+// abandon gives up `ticket`, whose reader/writer stops waiting for the lock. Must be called with the mutex held.
+func (rw *rwLock) abandon(ticket uint64) {
+	if rw.policy != FairPolicy {
+		return
+	}
+	// if it is its turn, pass it on; otherwise, skip the ticket when its turn comes
+	if ticket == rw.serving {
+		rw.advance()
+		rw.cond.Broadcast()
+		return
+	}
+	if rw.abandoned == nil {
+		rw.abandoned = make(map[uint64]bool)
+	}
+	rw.abandoned[ticket] = true
+}
 
-	// if more than `maxReaders`, wait
-	for rw.readerCount > maxReaders {
+// RLock acquires a reader lock when the policy lets the reader go and there are less than `maxReaders` readers
+func (rw *rwLock) RLock() {
+	rw.rLock(never)
+}
+
+// rLock acquires a reader lock like RLock, unless `expired` returns true while it has to wait.
+// Returns true if the lock was acquired.
+func (rw *rwLock) rLock(expired func() bool) bool {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	ticket := rw.nextTicket
+	rw.nextTicket++
+
+	for !rw.canRead(ticket) {
+		if expired() {
+			rw.abandon(ticket)
+			return false
+		}
 		rw.cond.Wait()
 	}
 
 	rw.readerCount++
-	rw.mutex.Unlock()
+	// fair policy: let the next in line try; if it is a reader, it shares the lock
+	if rw.policy == FairPolicy {
+		rw.advance()
+		rw.cond.Broadcast()
+	}
+	return true
 }
 
 // RUnlock unlocks the reader lock
@@ -60,8 +170,9 @@ func (rw *rwLock) RUnlock() {
 
 	rw.readerCount--
 
-	// when no readers, wake up all sleeping threads
-	if rw.readerCount == 0 {
+	// when no readers, wake up all sleeping threads (writers wait for this)
+	// when a reader leaves a full lock, wake up the readers waiting for a place
+	if rw.readerCount == 0 || rw.readerCount == rw.maxReaders-1 {
 		rw.cond.Broadcast()
 	}
 	rw.mutex.Unlock()
@@ -70,21 +181,36 @@ func (rw *rwLock) RUnlock() {
 
 // Lock writer lock: allows only one writer at a time to enter in critical section
 func (rw *rwLock) Lock() {
+	rw.lock(never)
+}
+
+// lock acquires the writer lock like Lock, unless `expired` returns true while it has to wait.
+// Returns true if the lock was acquired.
+func (rw *rwLock) lock(expired func() bool) bool {
 	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	ticket := rw.nextTicket
+	rw.nextTicket++
 	rw.writerCount++
 
-	// if other readers reading, wait
-	for rw.readerCount > 0 {
-		rw.cond.Wait()
-	}
-	// if there is a writer using, wait
-	for rw.writerWait {
+	// if other readers reading or there is a writer using, wait
+	for !rw.canWrite(ticket) {
+		if expired() {
+			// readers may be waiting for this writer (writer-preferred policy)
+			rw.writerCount--
+			rw.abandon(ticket)
+			rw.cond.Broadcast()
+			return false
+		}
 		rw.cond.Wait()
 	}
 
 	// obtain the lock
 	rw.writerWait = true
-	rw.mutex.Unlock()
+	if rw.policy == FairPolicy {
+		rw.advance()
+	}
+	return true
 }
 
 // Unlock -> writer unlock the r/w lock
@@ -102,6 +228,111 @@ func (rw *rwLock) Unlock() {
 }
 
 
+// TryRLock acquires a reader lock only if it can be acquired without waiting. Returns true if acquired.
+func (rw *rwLock) TryRLock() bool {
+	return rw.rLock(always)
+}
+
+// TryLock acquires the writer lock only if it can be acquired without waiting. Returns true if acquired.
+func (rw *rwLock) TryLock() bool {
+	return rw.lock(always)
+}
+
+// RLockTimeout acquires a reader lock, waiting at most `d` for it. Returns true if acquired.
+func (rw *rwLock) RLockTimeout(d time.Duration) bool {
+	// the deadline is set before the wake-up, so that waiters woken up by it see it passed
+	expired := deadline(d)
+	stop := WakeAfter(rw.cond, d)
+	defer stop()
+	return rw.rLock(expired)
+}
+
+// LockTimeout acquires the writer lock, waiting at most `d` for it. Returns true if acquired.
+func (rw *rwLock) LockTimeout(d time.Duration) bool {
+	expired := deadline(d)
+	stop := WakeAfter(rw.cond, d)
+	defer stop()
+	return rw.lock(expired)
+}
+
+// RLockCtx acquires a reader lock, waiting for it until `ctx` is done.
+// Returns nil if acquired or else the context's error.
+func (rw *rwLock) RLockCtx(ctx context.Context) error {
+	stop := WakeOnDone(ctx, rw.cond)
+	defer stop()
+	if !rw.rLock(done(ctx)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// LockCtx acquires the writer lock, waiting for it until `ctx` is done.
+// Returns nil if acquired or else the context's error.
+func (rw *rwLock) LockCtx(ctx context.Context) error {
+	stop := WakeOnDone(ctx, rw.cond)
+	defer stop()
+	if !rw.lock(done(ctx)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// ULock acquires an upgradable read lock: it waits like a reader and for the current upgrader, if any
+func (rw *rwLock) ULock() {
+	rw.mutex.Lock()
+	ticket := rw.nextTicket
+	rw.nextTicket++
+
+	for rw.upgrader || !rw.canRead(ticket) {
+		rw.cond.Wait()
+	}
+
+	rw.upgrader = true
+	if rw.policy == FairPolicy {
+		rw.advance()
+		rw.cond.Broadcast()
+	}
+	rw.mutex.Unlock()
+}
+
+// UUnlock unlocks the upgradable read lock
+func (rw *rwLock) UUnlock() {
+	rw.mutex.Lock()
+	rw.upgrader = false
+	// wake up the writers and the next upgrader
+	rw.cond.Broadcast()
+	rw.mutex.Unlock()
+}
+
+// Upgrade turns the upgradable read lock into the writer lock once the readers leave
+// Obs: writers and other upgraders wait while the upgrader holds the lock, so nobody writes in between
+func (rw *rwLock) Upgrade() {
+	rw.mutex.Lock()
+	// announce itself as a waiting writer, so that new readers wait (except with ReaderPreferred)
+	rw.writerCount++
+	rw.upgrading = true
+	for rw.readerCount > 0 {
+		rw.cond.Wait()
+	}
+
+	// obtain the lock
+	rw.writerWait = true
+	rw.upgrading = false
+	rw.upgrader = false
+	rw.mutex.Unlock()
+}
+
+// Downgrade turns the writer lock into a reader lock, letting the waiting readers in
+func (rw *rwLock) Downgrade() {
+	rw.mutex.Lock()
+	rw.writerCount--
+	rw.writerWait = false
+	rw.readerCount++
+	rw.cond.Broadcast()
+	rw.mutex.Unlock()
+}
+
+
 // GetGID returns the goroutine id of the caller
 func GetGID() uint64 {
     b := make([]byte, 64)
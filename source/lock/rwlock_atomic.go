@@ -0,0 +1,180 @@
+// A r/w lock whose whole state is kept in a single atomic word.
+// RLock, RUnlock, Lock and Unlock change the state with a compare-and-swap; uncontended, they never take a
+// mutex. A goroutine that cannot get the lock registers itself as a waiter in the same CAS that saw the lock
+// busy, and parks on a semaphore. Whoever changes the state so that the waiters may proceed takes them off the
+// word, again in the same CAS, and releases their semaphore; the woken goroutines retry from the beginning.
+// Obs: as the semaphores count, a release that happens before the waiter parks is not lost.
+// Obs2: writer-preferred, like NewRWLock: new readers wait while a writer waits for the lock. A writer is handed
+// the lock in the CAS that takes it off the word (the writer bit is set for it), so no reader gets in between.
+// Obs3: an earlier attempt split the state over two counters changed by separate atomic operations, so a reader
+// could see a writer in one and miss it in the other (and the count of pending readers went negative); here
+// every decision is made on one snapshot of the whole state and only applied if nothing changed in between.
+
+package lock
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Layout of the state word (low to high bits): readers holding the lock, readers waiting for it, writers waiting
+// for it (21 bits each) and the writer bit, set while a writer holds the lock
+const (
+	counterBits 	= 21
+	counterMask 	= 1<<counterBits - 1
+	readerOne 		= uint64(1) 						// one reader holding the lock
+	readerWaitOne 	= uint64(1) << counterBits 		// one waiting reader
+	writerWaitOne 	= uint64(1) << (2 * counterBits) 	// one waiting writer
+	writerBit 		= uint64(1) << 63 				// a writer holds the lock
+)
+
+// lockState is a snapshot of the state word
+type lockState uint64
+
+func (s lockState) readers() int 		{ return int(uint64(s) & counterMask) }
+func (s lockState) waitingReaders() int { return int(uint64(s) >> counterBits & counterMask) }
+func (s lockState) waitingWriters() int { return int(uint64(s) >> (2 * counterBits) & counterMask) }
+func (s lockState) writing() bool 		{ return uint64(s)&writerBit != 0 }
+
+// sema is a counting semaphore to park the goroutines waiting for a rwAtomicLock
+// Obs: package semaphore cannot be used here, since it imports this package
+type sema struct {
+	mutex 		sync.Mutex
+	cond 		*sync.Cond
+	permits 	int
+}
+
+func newSema() *sema {
+	s := &sema{}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// acquire waits for a permit and takes it
+func (s *sema) acquire() {
+	s.mutex.Lock()
+	for s.permits == 0 {
+		s.cond.Wait()
+	}
+	s.permits--
+	s.mutex.Unlock()
+}
+
+// release gives `n` permits, waking up as many waiting goroutines
+func (s *sema) release(n int) {
+	if n == 0 {
+		return
+	}
+	s.mutex.Lock()
+	s.permits += n
+	if n == 1 {
+		s.cond.Signal()
+	} else {
+		s.cond.Broadcast()
+	}
+	s.mutex.Unlock()
+}
+
+// rwAtomicLock is the internal representation of a r/w lock kept in an atomic word
+type rwAtomicLock struct {
+	state 		atomic.Uint64 	// see the layout above
+	readerSem 	*sema 			// parks the waiting readers
+	writerSem 	*sema 			// parks the waiting writers
+	maxReaders 	int
+}
+
+// NewRWLockAtomic creates and returns a new writer-preferred r/w lock kept in an atomic word, with at most
+// DefaultMaxReaders readers unless set with WithMaxReaders. The policy set with WithPolicy is ignored.
+func NewRWLockAtomic(opts ...Option) RWLock {
+	o := newOptions(opts)
+	if o.maxReaders > counterMask {
+		o.maxReaders = counterMask
+	}
+	return &rwAtomicLock{readerSem: newSema(), writerSem: newSema(), maxReaders: o.maxReaders}
+}
+
+// RLock acquires a reader lock when no writer holds or waits for the lock and there are less than `maxReaders`
+// readers
+func (rw *rwAtomicLock) RLock() {
+	for {
+		old := rw.state.Load()
+		s := lockState(old)
+		if !s.writing() && s.waitingWriters() == 0 && s.readers() < rw.maxReaders {
+			if rw.state.CompareAndSwap(old, old+readerOne) {
+				return
+			}
+		} else if rw.state.CompareAndSwap(old, old+readerWaitOne) {
+			// woken up when the lock may be available again; retry
+			rw.readerSem.acquire()
+		}
+	}
+}
+
+// RUnlock unlocks the reader lock
+func (rw *rwAtomicLock) RUnlock() {
+	for {
+		old := rw.state.Load()
+		s := lockState(old)
+		next := old - readerOne
+		wakeWriter, wakeReaders := false, 0
+		if s.readers() == 1 && s.waitingWriters() > 0 {
+			// the last reader leaves: hand over to a waiting writer, which holds the lock from now on
+			next = next - writerWaitOne | writerBit
+			wakeWriter = true
+		} else if s.readers() == rw.maxReaders && s.waitingWriters() == 0 {
+			// a reader leaves a full lock: let the waiting readers compete for the place
+			wakeReaders = s.waitingReaders()
+			next -= uint64(wakeReaders) * readerWaitOne
+		}
+		if rw.state.CompareAndSwap(old, next) {
+			if wakeWriter {
+				rw.writerSem.release(1)
+			}
+			rw.readerSem.release(wakeReaders)
+			return
+		}
+	}
+}
+
+// Lock acquires the writer lock once no reader or writer holds it, or once it is handed over to the writer
+func (rw *rwAtomicLock) Lock() {
+	for {
+		old := rw.state.Load()
+		s := lockState(old)
+		if !s.writing() && s.readers() == 0 {
+			if rw.state.CompareAndSwap(old, old|writerBit) {
+				return
+			}
+		} else if rw.state.CompareAndSwap(old, old+writerWaitOne) {
+			// woken up when the lock is handed over: the writer bit is already set
+			rw.writerSem.acquire()
+			return
+		}
+	}
+}
+
+// Unlock releases the writer lock, handing it over to a waiting writer if any, or else to the waiting readers
+func (rw *rwAtomicLock) Unlock() {
+	for {
+		old := rw.state.Load()
+		s := lockState(old)
+		next := old
+		wakeWriter, wakeReaders := false, 0
+		if s.waitingWriters() > 0 {
+			// hand over to a waiting writer: the writer bit stays set
+			next -= writerWaitOne
+			wakeWriter = true
+		} else {
+			next &^= writerBit
+			wakeReaders = s.waitingReaders()
+			next -= uint64(wakeReaders) * readerWaitOne
+		}
+		if rw.state.CompareAndSwap(old, next) {
+			if wakeWriter {
+				rw.writerSem.release(1)
+			}
+			rw.readerSem.release(wakeReaders)
+			return
+		}
+	}
+}
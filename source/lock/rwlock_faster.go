@@ -3,7 +3,9 @@
 package lock
 
 import (
+	"context"
 	"sync"
+	"time"
 )
 
 
@@ -23,7 +25,7 @@ type rwLockFaster struct {
 	
 }
 
-// NewRWLock creates and returns a new r/w lock
+// NewRWLock creates and returns a new r/w lock. The lock is also a TimedRWLock.
 func NewRWLockFaster() RWLock {
 	var mutex sync.Mutex
 	// dMutex := dummyLocker{}
@@ -37,15 +39,35 @@ func NewRWLockFaster() RWLock {
 
 // RLock acuires a reader if there is no writer using the lock and if there are less than `maxReaders` readers
 func (rw *rwLockFaster) RLock() {
+	rw.rLock(never)
+}
+
+// rLock acquires a reader lock like RLock, unless `expired` returns true while it has to wait.
+// Returns true if the lock was acquired.
+// Obs: a reader giving up may have been woken up by a Signal meant for the next reader, so it passes it on
+func (rw *rwLockFaster) rLock(expired func() bool) bool {
 	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
 
 	// if writer is writing, put itself in the queue
 	for rw.writerWriting || rw.writerWaiting {
+		if expired() {
+			rw.rCond.Signal()
+			return false
+		}
 		rw.rCond.Wait()		
 	}
 
 	// if more than `maxReaders` pending readers, update pending readers and wait
 	for rw.readingReaders > maxReaders {
+		if expired() {
+			rw.rCond.Signal()
+			// a waiting writer counted this reader among the readers to wait for: leave as if it read
+			if rw.writerWaiting {
+				rw.RUnlockSlow()
+			}
+			return false
+		}
 		rw.pendingReaders++
 		rw.rCond.Wait()
 		rw.pendingReaders--
@@ -53,7 +75,7 @@ func (rw *rwLockFaster) RLock() {
 
 	// update # active readers when unblocked
 	rw.readingReaders++
-	rw.mutex.Unlock()
+	return true
 }
 
 // RUnlock reader unlock
@@ -83,16 +105,29 @@ func (rw *rwLockFaster) RUnlockSlow() {
 		rw.rCond.Signal()
 	// the last reader that finishes reading wake up the writer
 	} else {
+		rw.waitForReaders = 0
 		rw.w2Cond.Signal()
 	}
 }
 
 // Lock writer lock: allows only one writer at a time to enter in critical section
 func (rw *rwLockFaster) Lock() {
+	rw.lock(nil)
+}
+
+// lock acquires the writer lock like Lock, unless `expired` returns true while it has to wait.
+// Returns true if the lock was acquired. A nil `expired` never expires.
+func (rw *rwLockFaster) lock(expired func() bool) bool {
 	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
 
 	// if other writers writing, wait
 	for rw.writerWaiting || rw.writerWriting {
+		if expired != nil && expired() {
+			// pass on the Signal of Unlock, in case it woke up this writer
+			rw.wCond.Signal()
+			return false
+		}
 		rw.wCond.Wait()
 	}
 	
@@ -102,14 +137,30 @@ func (rw *rwLockFaster) Lock() {
 		rw.writerWaiting = true
 		// take note of how many readers to wait for at this point in time
 		rw.waitForReaders = rw.readingReaders + rw.pendingReaders
-		// wait for readers to finish
-		rw.w2Cond.Wait()
+		// wait for readers to finish: the last one counted in `waitForReaders` signals the writer
+		// Obs: the readers may not be all gone by then (e.g., with more than `maxReaders` readers), so the writer
+		// waits for the signal, not for `readingReaders` and `pendingReaders` to be 0. A timed writer may also be
+		// woken up to give up: it waits until the signal sets `waitForReaders` to 0.
+		if expired == nil {
+			rw.w2Cond.Wait()
+		}
+		for expired != nil && rw.waitForReaders > 0 {
+			if expired() {
+				// withdraw: let in the readers waiting for this writer and the next writer
+				rw.writerWaiting = false
+				rw.waitForReaders = 0
+				rw.rCond.Broadcast()
+				rw.wCond.Signal()
+				return false
+			}
+			rw.w2Cond.Wait()
+		}
 	}
 
 	// update signals when unblocked
 	rw.writerWriting = true
 	rw.writerWaiting = false
-	rw.mutex.Unlock()
+	return true
 }
 
 // Unlock -> writer unlock the r/w lock
@@ -129,8 +180,61 @@ func (rw *rwLockFaster) Unlock() {
 	rw.mutex.Unlock()
 }
 
+// TryRLock acquires a reader lock only if it can be acquired without waiting. Returns true if acquired.
+func (rw *rwLockFaster) TryRLock() bool {
+	return rw.rLock(always)
+}
+
+// TryLock acquires the writer lock only if it can be acquired without waiting. Returns true if acquired.
+func (rw *rwLockFaster) TryLock() bool {
+	return rw.lock(always)
+}
+
+// RLockTimeout acquires a reader lock, waiting at most `d` for it. Returns true if acquired.
+func (rw *rwLockFaster) RLockTimeout(d time.Duration) bool {
+	expired := deadline(d)
+	stop := WakeAfter(rw.rCond, d)
+	defer stop()
+	return rw.rLock(expired)
+}
+
+// LockTimeout acquires the writer lock, waiting at most `d` for it. Returns true if acquired.
+// Obs: the writer waits on `wCond` for the other writers and then on `w2Cond` for the readers: wake up both
+func (rw *rwLockFaster) LockTimeout(d time.Duration) bool {
+	expired := deadline(d)
+	stopW := WakeAfter(rw.wCond, d)
+	defer stopW()
+	stopW2 := WakeAfter(rw.w2Cond, d)
+	defer stopW2()
+	return rw.lock(expired)
+}
+
+// RLockCtx acquires a reader lock, waiting for it until `ctx` is done.
+// Returns nil if acquired or else the context's error.
+func (rw *rwLockFaster) RLockCtx(ctx context.Context) error {
+	stop := WakeOnDone(ctx, rw.rCond)
+	defer stop()
+	if !rw.rLock(done(ctx)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// LockCtx acquires the writer lock, waiting for it until `ctx` is done.
+// Returns nil if acquired or else the context's error.
+func (rw *rwLockFaster) LockCtx(ctx context.Context) error {
+	stopW := WakeOnDone(ctx, rw.wCond)
+	defer stopW()
+	stopW2 := WakeOnDone(ctx, rw.w2Cond)
+	defer stopW2()
+	if !rw.lock(done(ctx)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
 // DummyLocker implements the Locker interface but does nothing. It is useful when the lock is not needed,
-// but we want to use condition variables for signaling. It is used in the consumer-producer in `server.go`.
+// but we want to use condition variables for signaling.
 type DummyLocker struct{
 }
 
@@ -0,0 +1,311 @@
+package lock
+
+// Tests and benchmarks shared by every r/w lock implementation
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rwLocks holds the constructors of the r/w locks; every test runs against each of them
+var rwLocks = map[string]func() RWLock{
+	"cond":   func() RWLock { return NewRWLock() },
+	"reader": func() RWLock { return NewRWLock(WithPolicy(ReaderPreferred)) },
+	"fair":   func() RWLock { return NewRWLock(WithPolicy(FairPolicy)) },
+	"faster": NewRWLockFaster,
+	"atomic": func() RWLock { return NewRWLockAtomic() },
+	// the instrumentation must not change the behavior of the lock it wraps
+	"instrumented": func() RWLock { return NewInstrumentedRWLock(NewRWLock(), NewStats()) },
+}
+
+// forEachLock runs `test` as a subtest for each r/w lock
+func forEachLock(t *testing.T, test func(t *testing.T, newLock func() RWLock)) {
+	for name, newLock := range rwLocks {
+		t.Run(name, func(t *testing.T) { test(t, newLock) })
+	}
+}
+
+// hammer makes `readers` readers and `writers` writers take `rw` `rounds` times each, checking that writers hold
+// it alone and that readers hold it with no writer. Returns the first violation found, if any.
+func hammer(rw RWLock, readers int, writers int, rounds int) error {
+	var holders atomic.Int64 	// # readers holding the lock, or -1 if a writer holds it
+	var group sync.WaitGroup
+	errs := make(chan error, readers+writers)
+
+	for i := 0; i < readers+writers; i++ {
+		group.Add(1)
+		go func(writer bool) {
+			defer group.Done()
+			for j := 0; j < rounds; j++ {
+				if writer {
+					rw.Lock()
+					if !holders.CompareAndSwap(0, -1) {
+						errs <- fmt.Errorf("a writer got the lock held by %d", holders.Load())
+					}
+					holders.Store(0)
+					rw.Unlock()
+				} else {
+					rw.RLock()
+					if holders.Add(1) < 1 {
+						errs <- fmt.Errorf("a reader got the lock held by a writer")
+					}
+					holders.Add(-1)
+					rw.RUnlock()
+				}
+			}
+		}(i < writers)
+	}
+	group.Wait()
+	close(errs)
+	return <-errs
+}
+
+func TestMutualExclusion(t *testing.T) {
+	forEachLock(t, func(t *testing.T, newLock func() RWLock) {
+		for _, writers := range []int{1, 4, 16} {
+			if err := hammer(newLock(), 16, writers, 2000); err != nil {
+				t.Errorf("%d writers: %v", writers, err)
+			}
+		}
+	})
+}
+
+func TestOnlyWriters(t *testing.T) {
+	// a plain mutex: many writers and no readers (the case that broke the first atomic attempt)
+	forEachLock(t, func(t *testing.T, newLock func() RWLock) {
+		if err := hammer(newLock(), 0, 32, 2000); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestReadersShare(t *testing.T) {
+	forEachLock(t, func(t *testing.T, newLock func() RWLock) {
+		rw := newLock()
+		rw.RLock()
+		if blocked, _ := waits(func() { rw.RLock(); rw.RUnlock() }); blocked {
+			t.Error("A reader waited for another reader")
+		}
+		// a writer waits for the reader, and readers wait for the writer
+		blocked, done := waits(rw.Lock)
+		if !blocked {
+			t.Fatal("A writer got the lock held by a reader")
+		}
+		rw.RUnlock()
+		<-done
+		if blocked, done := waits(rw.RLock); !blocked {
+			t.Error("A reader got the lock held by a writer")
+		} else {
+			rw.Unlock()
+			<-done
+			rw.RUnlock()
+		}
+	})
+}
+
+func TestScenario(t *testing.T) {
+	// the scenario of `zzzz_test_rwlock`, shortened: 200 readers and a few writers arriving at random,
+	// each holding the lock for 1-3ms
+	forEachLock(t, func(t *testing.T, newLock func() RWLock) {
+		rw := newLock()
+		var group sync.WaitGroup
+		writers := 0
+		for i := 0; i < 200; i++ {
+			group.Add(1)
+			hold := time.Duration(1+rand.Intn(3)) * time.Millisecond
+			if rand.Intn(5) == 0 && writers < 2 {
+				writers++
+				go func() {
+					defer group.Done()
+					rw.Lock()
+					time.Sleep(hold)
+					rw.Unlock()
+				}()
+			} else {
+				go func() {
+					defer group.Done()
+					rw.RLock()
+					time.Sleep(hold)
+					rw.RUnlock()
+				}()
+			}
+		}
+
+		done := make(chan bool)
+		go func() {
+			group.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			t.Fatal("The readers and writers did not finish: deadlock")
+		}
+	})
+}
+
+func TestAtomicMaxReaders(t *testing.T) {
+	rw := NewRWLockAtomic(WithMaxReaders(2))
+	rw.RLock()
+	rw.RLock()
+	// a third reader waits until one of the readers leaves
+	blocked, done := waits(rw.RLock)
+	if !blocked {
+		t.Fatal("More than 2 readers got the lock")
+	}
+	rw.RUnlock()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The waiting reader was not woken up")
+	}
+	rw.RUnlock()
+	rw.RUnlock()
+}
+
+func TestAtomicWriterPreferred(t *testing.T) {
+	order := acquireInTurn(NewRWLockAtomic())
+	if order[0] != "w2" {
+		t.Errorf("Expected the writer first. Got:%v", order)
+	}
+}
+
+func TestAtomicHandOver(t *testing.T) {
+	// the last reader (or the writer) hands the lock over to the waiting writer: readers arriving right after,
+	// before the writer runs, wait for it
+	for _, last := range []string{"reader", "writer"} {
+		rw := NewRWLockAtomic().(*rwAtomicLock)
+		if last == "reader" {
+			rw.RLock()
+		} else {
+			rw.Lock()
+		}
+		var wrote atomic.Bool
+		blocked, done := waits(func() {
+			rw.Lock()
+			wrote.Store(true)
+			rw.Unlock()
+		})
+		if !blocked {
+			t.Fatalf("A writer got the lock held by a %s", last)
+		}
+		if last == "reader" {
+			rw.RUnlock()
+		} else {
+			rw.Unlock()
+		}
+		if s := lockState(rw.state.Load()); !s.writing() || s.waitingWriters() != 0 {
+			t.Errorf("Expected the lock handed over by the %s to the writer. Got state %x", last, uint64(s))
+		}
+		var readers sync.WaitGroup
+		var ahead atomic.Int32
+		for i := 0; i < 10; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				rw.RLock()
+				if !wrote.Load() {
+					ahead.Add(1)
+				}
+				rw.RUnlock()
+			}()
+		}
+		readers.Wait()
+		<-done
+		if ahead.Load() != 0 {
+			t.Errorf("%d readers got ahead of the writer the lock was handed over to by the %s", ahead.Load(), last)
+		}
+	}
+}
+
+func TestFasterWriterAfterMaxReaders(t *testing.T) {
+	// more than `maxReaders` readers, some of them pending, then a writer and more readers: the writer gets the
+	// lock once the first readers leave, untimed or timed
+	for _, timed := range []bool{false, true} {
+		rw := NewRWLockFaster().(*rwLockFaster)
+		release := make(chan bool)
+		var readers sync.WaitGroup
+		for i := 0; i < 2*maxReaders; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				rw.RLock()
+				<-release
+				rw.RUnlock()
+			}()
+		}
+		for !waitsForReaders(rw) {
+			time.Sleep(time.Millisecond)
+		}
+		blocked, done := waits(func() {
+			if timed {
+				rw.LockTimeout(time.Minute)
+			} else {
+				rw.Lock()
+			}
+		})
+		if !blocked {
+			t.Fatal("The writer got the lock held by readers")
+		}
+		// readers arriving after the writer wait on the same condition variable as the pending readers
+		for i := 0; i < maxReaders; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				rw.RLock()
+				rw.RUnlock()
+			}()
+		}
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("The writer (timed: %v) did not get the lock after the readers left", timed)
+		}
+		rw.Unlock()
+		readers.Wait()
+	}
+}
+
+// waitsForReaders returns true once the readers holding `rw` fill it up and others are pending
+func waitsForReaders(rw *rwLockFaster) bool {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+	return rw.pendingReaders > 0
+}
+
+// BenchmarkRWLock compares the r/w locks (and sync.RWMutex) with every goroutine taking the lock in a loop,
+// for several shares of writers
+func BenchmarkRWLock(b *testing.B) {
+	locks := map[string]func() RWLock{"sync": func() RWLock { return &sync.RWMutex{} }}
+	for name, newLock := range rwLocks {
+		locks[name] = newLock
+	}
+	for _, writePercent := range []int{0, 10, 50} {
+		for _, name := range []string{"sync", "cond", "reader", "fair", "faster", "atomic", "instrumented"} {
+			newLock := locks[name]
+			b.Run(fmt.Sprintf("writes=%d%%/%s", writePercent, name), func(b *testing.B) {
+				rw := newLock()
+				shared := 0
+				b.RunParallel(func(pb *testing.PB) {
+					for i := 0; pb.Next(); i++ {
+						if i%100 < writePercent {
+							rw.Lock()
+							shared++
+							rw.Unlock()
+						} else {
+							rw.RLock()
+							_ = shared
+							rw.RUnlock()
+						}
+					}
+				})
+			})
+		}
+	}
+}
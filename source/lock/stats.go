@@ -0,0 +1,242 @@
+// Contention statistics of r/w locks.
+// NewInstrumentedRWLock wraps a r/w lock and records, for its readers and writers, how many times the lock was
+// acquired, how long they waited for it (as a histogram) and how long they held it, as well as how many readers
+// and writers hold it right now and the most readers that ever held it at once. Many locks may share the same
+// Stats (e.g., the locks of the feeds of every user), which then adds up the numbers of all of them.
+// Obs: everything is counted with atomics, so the statistics do not add a lock of their own. The cost is two
+// reads of the clock per acquisition.
+// Obs2: hold times are kept as (sum of the release times) - (sum of the acquisition times), so that a reader
+// does not have to remember when it got the lock. A Snapshot taken while the lock is held counts the time held
+// so far, but may be slightly off, as the counters are not read all at once.
+
+package lock
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// WaitBuckets is the number of buckets of a wait time histogram: bucket 0 counts the waits shorter than 1µs,
+// bucket i the waits in [2^(i-1), 2^i) µs and the last bucket the waits of 2^(WaitBuckets-2) µs (~0.5s) or more
+const WaitBuckets = 21
+
+// histogram represents a wait time histogram
+type histogram struct {
+	buckets 	[WaitBuckets]atomic.Uint64
+	total 		atomic.Int64 		// total wait time, in ns
+}
+
+// add records a wait of `d`
+func (h *histogram) add(d time.Duration) {
+	bucket := 0
+	for us := d / time.Microsecond; us > 0 && bucket < WaitBuckets-1; us >>= 1 {
+		bucket++
+	}
+	h.buckets[bucket].Add(1)
+	h.total.Add(int64(d))
+}
+
+// WaitHistogram is a snapshot of a wait time histogram
+type WaitHistogram struct {
+	Buckets 	[WaitBuckets]uint64 	`json:"buckets"` 		// see WaitBuckets
+	TotalNs 	int64 					`json:"totalNs"` 		// total wait time
+}
+
+// snapshot returns the current values of the histogram
+func (h *histogram) snapshot() WaitHistogram {
+	var s WaitHistogram
+	for i := range h.buckets {
+		s.Buckets[i] = h.buckets[i].Load()
+	}
+	s.TotalNs = h.total.Load()
+	return s
+}
+
+// Stats collects the statistics of the r/w locks wrapped by NewInstrumentedRWLock
+type Stats struct {
+	epoch 		time.Time 		// times are measured from the creation of the Stats
+	reads 		atomic.Uint64 	// # read acquisitions
+	writes 		atomic.Uint64 	// # write acquisitions
+	readWait 	histogram
+	writeWait 	histogram
+	readHold 	atomic.Int64 	// sum of the release times - sum of the acquisition times of the readers, in ns
+	writeHold 	atomic.Int64 	// same for the writers
+	readers 	atomic.Int64 	// # readers holding a lock
+	writers 	atomic.Int64 	// # writers holding a lock
+	maxReaders 	atomic.Int64 	// the most readers holding the same lock at once
+}
+
+// NewStats creates empty lock statistics
+func NewStats() *Stats {
+	return &Stats{epoch: time.Now()}
+}
+
+// now returns the time elapsed since the creation of the statistics
+func (s *Stats) now() time.Duration {
+	return time.Since(s.epoch)
+}
+
+// StatsSnapshot represents the statistics of the locks at a point in time
+type StatsSnapshot struct {
+	ReadAcquisitions 		uint64 			`json:"readAcquisitions"`
+	WriteAcquisitions 		uint64 			`json:"writeAcquisitions"`
+	ReadWait 				WaitHistogram 	`json:"readWait"`
+	WriteWait 				WaitHistogram 	`json:"writeWait"`
+	ReadHoldNs 				int64 			`json:"readHoldNs"` 		// total time held by readers
+	WriteHoldNs 			int64 			`json:"writeHoldNs"` 		// total time held by writers
+	Readers 				int64 			`json:"readers"` 			// # readers holding a lock now
+	Writers 				int64 			`json:"writers"` 			// # writers holding a lock now
+	MaxConcurrentReaders 	int64 			`json:"maxConcurrentReaders"`
+}
+
+// Snapshot returns the current statistics
+func (s *Stats) Snapshot() StatsSnapshot {
+	now := int64(s.now())
+	readers, writers := s.readers.Load(), s.writers.Load()
+	return StatsSnapshot{
+		ReadAcquisitions: s.reads.Load(),
+		WriteAcquisitions: s.writes.Load(),
+		ReadWait: s.readWait.snapshot(),
+		WriteWait: s.writeWait.snapshot(),
+		// the holders of a lock have not released it yet: count their time up to now
+		ReadHoldNs: s.readHold.Load() + readers*now,
+		WriteHoldNs: s.writeHold.Load() + writers*now,
+		Readers: readers,
+		Writers: writers,
+		MaxConcurrentReaders: s.maxReaders.Load(),
+	}
+}
+
+// instrumentedRWLock is the internal representation of a r/w lock recording its statistics
+type instrumentedRWLock struct {
+	rw 			RWLock 			// the lock being instrumented
+	stats 		*Stats
+	readers 	atomic.Int64 	// # readers holding this lock
+}
+
+// NewInstrumentedRWLock returns `rw` recording its statistics in `stats`.
+// If `rw` is a TimedRWLock, so is the returned lock; an acquisition that gives up is not recorded.
+func NewInstrumentedRWLock(rw RWLock, stats *Stats) RWLock {
+	l := &instrumentedRWLock{rw: rw, stats: stats}
+	if timed, ok := rw.(TimedRWLock); ok {
+		return &timedInstrumentedRWLock{instrumentedRWLock: l, timed: timed}
+	}
+	return l
+}
+
+// RLock acquires the reader lock, recording the wait
+func (l *instrumentedRWLock) RLock() {
+	l.rLock(func() bool {
+		l.rw.RLock()
+		return true
+	})
+}
+
+// rLock acquires the reader lock with `acquire`, recording the wait if it returns true, i.e., if the lock was
+// acquired. Returns the result of `acquire`.
+func (l *instrumentedRWLock) rLock(acquire func() bool) bool {
+	start := l.stats.now()
+	if !acquire() {
+		return false
+	}
+	acquired := l.stats.now()
+
+	l.stats.reads.Add(1)
+	l.stats.readWait.add(acquired - start)
+	l.stats.readHold.Add(-int64(acquired))
+	l.stats.readers.Add(1)
+	// update the most readers at once, unless another reader already raised it
+	readers := l.readers.Add(1)
+	for max := l.stats.maxReaders.Load(); readers > max; max = l.stats.maxReaders.Load() {
+		if l.stats.maxReaders.CompareAndSwap(max, readers) {
+			break
+		}
+	}
+	return true
+}
+
+// RUnlock releases the reader lock, recording the time it was held
+func (l *instrumentedRWLock) RUnlock() {
+	l.readers.Add(-1)
+	l.stats.readers.Add(-1)
+	l.stats.readHold.Add(int64(l.stats.now()))
+	l.rw.RUnlock()
+}
+
+// Lock acquires the writer lock, recording the wait
+func (l *instrumentedRWLock) Lock() {
+	l.lock(func() bool {
+		l.rw.Lock()
+		return true
+	})
+}
+
+// lock acquires the writer lock with `acquire`, recording the wait if it returns true. Returns the result of
+// `acquire`.
+func (l *instrumentedRWLock) lock(acquire func() bool) bool {
+	start := l.stats.now()
+	if !acquire() {
+		return false
+	}
+	acquired := l.stats.now()
+
+	l.stats.writes.Add(1)
+	l.stats.writeWait.add(acquired - start)
+	l.stats.writeHold.Add(-int64(acquired))
+	l.stats.writers.Add(1)
+	return true
+}
+
+// Unlock releases the writer lock, recording the time it was held
+func (l *instrumentedRWLock) Unlock() {
+	l.stats.writers.Add(-1)
+	l.stats.writeHold.Add(int64(l.stats.now()))
+	l.rw.Unlock()
+}
+
+// timedInstrumentedRWLock is an instrumented lock wrapping a TimedRWLock, which gives up like the lock it wraps
+type timedInstrumentedRWLock struct {
+	*instrumentedRWLock
+	timed 		TimedRWLock 	// the lock being instrumented
+}
+
+// TryRLock acquires the reader lock only if it can be acquired without waiting, recording it if acquired
+func (l *timedInstrumentedRWLock) TryRLock() bool {
+	return l.rLock(l.timed.TryRLock)
+}
+
+// TryLock acquires the writer lock only if it can be acquired without waiting, recording it if acquired
+func (l *timedInstrumentedRWLock) TryLock() bool {
+	return l.lock(l.timed.TryLock)
+}
+
+// RLockTimeout acquires the reader lock, waiting at most `d` for it, and records the wait if acquired
+func (l *timedInstrumentedRWLock) RLockTimeout(d time.Duration) bool {
+	return l.rLock(func() bool { return l.timed.RLockTimeout(d) })
+}
+
+// LockTimeout acquires the writer lock, waiting at most `d` for it, and records the wait if acquired
+func (l *timedInstrumentedRWLock) LockTimeout(d time.Duration) bool {
+	return l.lock(func() bool { return l.timed.LockTimeout(d) })
+}
+
+// RLockCtx acquires the reader lock, waiting for it until `ctx` is done, and records the wait if acquired
+func (l *timedInstrumentedRWLock) RLockCtx(ctx context.Context) error {
+	var err error
+	l.rLock(func() bool {
+		err = l.timed.RLockCtx(ctx)
+		return err == nil
+	})
+	return err
+}
+
+// LockCtx acquires the writer lock, waiting for it until `ctx` is done, and records the wait if acquired
+func (l *timedInstrumentedRWLock) LockCtx(ctx context.Context) error {
+	var err error
+	l.lock(func() bool {
+		err = l.timed.LockCtx(ctx)
+		return err == nil
+	})
+	return err
+}
@@ -0,0 +1,124 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStatsCounts(t *testing.T) {
+	stats := NewStats()
+	rw := NewInstrumentedRWLock(NewRWLock(), stats)
+	var group sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			for j := 0; j < 100; j++ {
+				if i%2 == 0 {
+					rw.Lock()
+					rw.Unlock()
+				} else {
+					rw.RLock()
+					rw.RUnlock()
+				}
+			}
+		}(i)
+	}
+	group.Wait()
+
+	s := stats.Snapshot()
+	if s.ReadAcquisitions != 400 || s.WriteAcquisitions != 400 {
+		t.Errorf("Expected 400 reads and 400 writes. Got:%v reads and %v writes", s.ReadAcquisitions, s.WriteAcquisitions)
+	}
+	var reads, writes uint64
+	for i := 0; i < WaitBuckets; i++ {
+		reads += s.ReadWait.Buckets[i]
+		writes += s.WriteWait.Buckets[i]
+	}
+	if reads != 400 || writes != 400 {
+		t.Errorf("Expected 400 waits of each kind in the histograms. Got:%v and %v", reads, writes)
+	}
+	if s.Readers != 0 || s.Writers != 0 {
+		t.Errorf("Expected no holders. Got:%v readers and %v writers", s.Readers, s.Writers)
+	}
+}
+
+func TestStatsTimed(t *testing.T) {
+	// the instrumented lock gives up like the lock it wraps, and does not record the acquisitions given up
+	stats := NewStats()
+	rw, ok := NewInstrumentedRWLock(NewRWLock(), stats).(TimedRWLock)
+	if !ok {
+		t.Fatal("Expected the instrumented lock of a TimedRWLock to be a TimedRWLock")
+	}
+	if _, ok := NewInstrumentedRWLock(NewRWLockAtomic(), stats).(TimedRWLock); ok {
+		t.Error("Expected the instrumented lock of a lock that cannot give up not to be a TimedRWLock")
+	}
+	rw.Lock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if rw.TryRLock() || rw.TryLock() || rw.RLockTimeout(time.Millisecond) || rw.LockTimeout(time.Millisecond) ||
+		rw.RLockCtx(ctx) == nil || rw.LockCtx(ctx) == nil {
+		t.Error("An acquisition of the lock held by a writer did not give up")
+	}
+	if s := stats.Snapshot(); s.ReadAcquisitions != 0 || s.WriteAcquisitions != 1 || s.Writers != 1 {
+		t.Errorf("Expected only the writer holding the lock. Got:%+v", s)
+	}
+	rw.Unlock()
+	if !rw.TryRLock() || !rw.RLockTimeout(0) || rw.RLockCtx(context.Background()) != nil {
+		t.Fatal("A reader did not get the free lock")
+	}
+	if s := stats.Snapshot(); s.ReadAcquisitions != 3 || s.Readers != 3 {
+		t.Errorf("Expected 3 readers. Got:%+v", s)
+	}
+	rw.RUnlock()
+	rw.RUnlock()
+	rw.RUnlock()
+}
+
+func TestStatsTimes(t *testing.T) {
+	stats := NewStats()
+	rw := NewInstrumentedRWLock(NewRWLock(), stats)
+
+	// two readers hold the lock together for 20ms; a writer waits for them
+	rw.RLock()
+	rw.RLock()
+	blocked, done := waits(rw.Lock)
+	if !blocked {
+		t.Fatal("A writer got the lock held by readers")
+	}
+	if s := stats.Snapshot(); s.Readers != 2 || s.MaxConcurrentReaders != 2 {
+		t.Errorf("Expected 2 readers holding the lock. Got:%v (at most %v)", s.Readers, s.MaxConcurrentReaders)
+	}
+	rw.RUnlock()
+	rw.RUnlock()
+	<-done
+	time.Sleep(10 * time.Millisecond)
+	rw.Unlock()
+
+	s := stats.Snapshot()
+	if s.ReadHoldNs < int64(2*20*time.Millisecond) {
+		t.Errorf("Expected the readers to hold the lock for 40ms or more. Got:%v", time.Duration(s.ReadHoldNs))
+	}
+	if s.WriteHoldNs < int64(10*time.Millisecond) {
+		t.Errorf("Expected the writer to hold the lock for 10ms or more. Got:%v", time.Duration(s.WriteHoldNs))
+	}
+	if s.WriteWait.TotalNs < int64(20*time.Millisecond) || s.WriteWait.Buckets[0] != 0 {
+		t.Errorf("Expected the writer to wait for 20ms or more. Got:%v", s.WriteWait)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	var h histogram
+	for _, d := range []time.Duration{0, 999 * time.Nanosecond, time.Microsecond, 3 * time.Microsecond, time.Hour} {
+		h.add(d)
+	}
+	s := h.snapshot()
+	expected := map[int]uint64{0: 2, 1: 1, 2: 1, WaitBuckets - 1: 1}
+	for i, count := range s.Buckets {
+		if count != expected[i] {
+			t.Errorf("Bucket %d: expected %d waits. Got:%d", i, expected[i], count)
+		}
+	}
+}
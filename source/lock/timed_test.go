@@ -0,0 +1,146 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// timedLocks holds the constructors of the r/w locks with timed acquisitions
+var timedLocks = map[string]func() TimedRWLock{
+	"cond":   func() TimedRWLock { return NewRWLock().(TimedRWLock) },
+	"reader": func() TimedRWLock { return NewRWLock(WithPolicy(ReaderPreferred)).(TimedRWLock) },
+	"fair":   func() TimedRWLock { return NewRWLock(WithPolicy(FairPolicy)).(TimedRWLock) },
+	"faster": func() TimedRWLock { return NewRWLockFaster().(TimedRWLock) },
+}
+
+func TestTryLock(t *testing.T) {
+	for name, newLock := range timedLocks {
+		rw := newLock()
+		if !rw.TryRLock() || !rw.TryRLock() {
+			t.Fatalf("%s: TryRLock failed on a lock held by readers", name)
+		}
+		if rw.TryLock() {
+			t.Fatalf("%s: TryLock got a lock held by readers", name)
+		}
+		rw.RUnlock()
+		rw.RUnlock()
+		if !rw.TryLock() {
+			t.Fatalf("%s: TryLock failed on a free lock", name)
+		}
+		if rw.TryRLock() || rw.TryLock() {
+			t.Fatalf("%s: a Try got a lock held by a writer", name)
+		}
+		rw.Unlock()
+
+		// the failed attempts left the lock usable
+		if blocked, _ := waits(func() { rw.Lock(); rw.Unlock(); rw.RLock(); rw.RUnlock() }); blocked {
+			t.Errorf("%s: the lock was not released after failed Try attempts", name)
+		}
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	for name, newLock := range timedLocks {
+		rw := newLock()
+		rw.Lock()
+		start := time.Now()
+		if rw.RLockTimeout(20*time.Millisecond) || rw.LockTimeout(20*time.Millisecond) {
+			t.Fatalf("%s: got a lock held by a writer", name)
+		}
+		if elapsed := time.Since(start); elapsed < 40*time.Millisecond || elapsed > 5*time.Second {
+			t.Errorf("%s: expected to wait for 2 x 20ms. Got:%v", name, elapsed)
+		}
+
+		// a waiter gets the lock if it is released before its timeout
+		got := make(chan bool)
+		go func() { got <- rw.RLockTimeout(10 * time.Second) }()
+		time.Sleep(20 * time.Millisecond)
+		rw.Unlock()
+		if !<-got {
+			t.Fatalf("%s: the reader timed out on a released lock", name)
+		}
+		rw.RUnlock()
+	}
+}
+
+func TestWriterTimeoutLetsReadersIn(t *testing.T) {
+	// a writer waiting for a reader blocks the readers coming after it (except with ReaderPreferred);
+	// once it gives up, they get the lock
+	for name, newLock := range timedLocks {
+		rw := newLock()
+		rw.RLock()
+		writerDone := make(chan bool)
+		go func() { writerDone <- rw.LockTimeout(50 * time.Millisecond) }()
+		time.Sleep(20 * time.Millisecond)
+
+		readerDone := make(chan bool)
+		go func() {
+			rw.RLock()
+			rw.RUnlock()
+			close(readerDone)
+		}()
+		if <-writerDone {
+			t.Fatalf("%s: the writer got a lock held by a reader", name)
+		}
+		select {
+		case <-readerDone:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: the reader was still waiting after the writer gave up", name)
+		}
+		rw.RUnlock()
+
+		// and the next writer is not blocked by the one that gave up
+		if !rw.LockTimeout(10 * time.Second) {
+			t.Fatalf("%s: a writer could not get the free lock", name)
+		}
+		rw.Unlock()
+	}
+}
+
+func TestLockCtx(t *testing.T) {
+	for name, newLock := range timedLocks {
+		rw := newLock()
+		rw.Lock()
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 2)
+		go func() { errs <- rw.RLockCtx(ctx) }()
+		go func() { errs <- rw.LockCtx(ctx) }()
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		for i := 0; i < 2; i++ {
+			select {
+			case err := <-errs:
+				if err != context.Canceled {
+					t.Errorf("%s: expected the context's error. Got:%v", name, err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("%s: the cancellation did not wake up the waiters", name)
+			}
+		}
+		rw.Unlock()
+		if err := rw.LockCtx(context.Background()); err != nil {
+			t.Fatalf("%s: expected to get the free lock. Got:%v", name, err)
+		}
+		rw.Unlock()
+	}
+}
+
+func TestFairTimeoutSkipsTurn(t *testing.T) {
+	// readers behind a fair writer that gives up get their turn
+	rw := NewRWLock(WithPolicy(FairPolicy)).(TimedRWLock)
+	rw.RLock()
+	go rw.LockTimeout(100 * time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if blocked, done := waits(rw.RLock); !blocked {
+		t.Fatal("A reader went before the waiting writer under the fair policy")
+	} else {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("The reader did not get the lock after the writer gave up")
+		}
+	}
+	rw.RUnlock()
+	rw.RUnlock()
+}
@@ -0,0 +1,76 @@
+package lock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestULockSharesWithReaders(t *testing.T) {
+	rw := NewUpgradableRWLock()
+	rw.ULock()
+	if blocked, _ := waits(func() { rw.RLock(); rw.RUnlock() }); blocked {
+		t.Error("A reader waited for the upgradable reader")
+	}
+	// but not with writers or other upgraders
+	if blocked, done := waits(rw.Lock); !blocked {
+		t.Error("A writer got the lock held by the upgradable reader")
+	} else {
+		rw.UUnlock()
+		<-done
+		rw.Unlock()
+	}
+	rw.ULock()
+	if blocked, done := waits(rw.ULock); !blocked {
+		t.Error("Two upgradable readers got the lock")
+	} else {
+		rw.UUnlock()
+		<-done
+		rw.UUnlock()
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	for _, policy := range []Policy{WriterPreferred, ReaderPreferred, FairPolicy} {
+		rw := NewUpgradableRWLock(WithPolicy(policy))
+		rw.RLock()
+		rw.ULock()
+
+		// the upgrade waits for the reader to leave
+		blocked, done := waits(rw.Upgrade)
+		if !blocked {
+			t.Fatalf("Policy %v: the upgrade did not wait for the reader", policy)
+		}
+		rw.RUnlock()
+		<-done
+
+		// the upgraded lock is a writer lock
+		if blocked, _ := waits(func() { rw.RLock(); rw.RUnlock() }); !blocked {
+			t.Fatalf("Policy %v: a reader got the upgraded lock", policy)
+		}
+		rw.Unlock()
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	rw := NewUpgradableRWLock()
+	rw.Lock()
+	blocked, readerDone := waits(func() { rw.RLock(); rw.RUnlock() })
+	if !blocked {
+		t.Fatal("A reader got the writer lock")
+	}
+
+	// after downgrading, the waiting reader shares the lock, but writers still wait
+	rw.Downgrade()
+	select {
+	case <-readerDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The reader was not let in after the downgrade")
+	}
+	blocked, writerDone := waits(rw.Lock)
+	if !blocked {
+		t.Fatal("A writer got the downgraded lock")
+	}
+	rw.RUnlock()
+	<-writerDone
+	rw.Unlock()
+}
@@ -0,0 +1,70 @@
+package lock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Helpers for giving up waiting on a condition variable.
+// sync.Cond has no timed wait: a goroutine waiting on it only wakes up when signaled. These helpers broadcast
+// on the condition variable once a deadline passes or a context is done, so that the waiting goroutines wake up,
+// notice it and give up. The typical use, with the cond's lock held:
+//	stop := WakeAfter(cond, d)
+//	defer stop()
+//	for !condition {
+//		if time.Now().After(deadline) { give up }
+//		cond.Wait()
+//	}
+// Obs: the broadcast is done while holding the cond's lock, so it cannot happen between a waiter checking the
+// deadline and starting to wait.
+
+// WakeAfter broadcasts on `cond` after `d`. The returned function cancels the broadcast if it did not happen yet.
+func WakeAfter(cond *sync.Cond, d time.Duration) (stop func()) {
+	timer := time.AfterFunc(d, func() { broadcast(cond) })
+	return func() { timer.Stop() }
+}
+
+// WakeOnDone broadcasts on `cond` when `ctx` is done. The returned function cancels the broadcast if it did not
+// happen yet; it must be called to release the goroutine waiting for `ctx`.
+func WakeOnDone(ctx context.Context, cond *sync.Cond) (stop func()) {
+	// a context that is never done does not need a goroutine
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			broadcast(cond)
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// broadcast wakes up all goroutines waiting on `cond`
+func broadcast(cond *sync.Cond) {
+	cond.L.Lock()
+	cond.Broadcast()
+	cond.L.Unlock()
+}
+
+// Functions telling a waiting goroutine whether to give up (the `expired` argument of the r/w locks' acquisitions)
+
+// never never gives up: the goroutine waits as long as needed
+func never() bool { return false }
+
+// always gives up right away: the goroutine does not wait
+func always() bool { return true }
+
+// deadline gives up once `d` has passed since it was called
+func deadline(d time.Duration) func() bool {
+	at := time.Now().Add(d)
+	return func() bool { return !time.Now().Before(at) }
+}
+
+// done gives up once `ctx` is done
+func done(ctx context.Context) func() bool {
+	return func() bool { return ctx.Err() != nil }
+}
@@ -0,0 +1,123 @@
+// This script implements a bounded multi-producer multi-consumer queue a la Vyukov
+// The queue is a ring buffer of cells. Each cell has a sequence number telling whether it is ready to be
+// written (seq == position of the enqueuer) or read (seq == position of the dequeuer + 1). Enqueuers and
+// dequeuers claim positions with a CAS on `tail` and `head` and then write/read their cell, so operations on
+// different cells proceed in parallel and no node is allocated per request.
+// When the queue is full, Enqueue waits until a consumer dequeues a request: a producer faster than the
+// consumers is slowed down to their speed instead of growing the queue without limit.
+
+package queue
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// cell is a slot of the ring buffer
+type cell struct {
+	seq 		atomic.Uint64 	// sequence number; see the description above
+	request 	*Request 		// the request stored in the cell; guarded by `seq`
+}
+
+// BoundedQueue represents a FIFO structure with a maximum capacity
+// Obs: `tail` and `head` are padded to be in different cache lines, as they are updated by different threads
+type BoundedQueue struct {
+	tail 		atomic.Uint64 	// position of the next enqueue
+	_ 			[56]byte
+	head 		atomic.Uint64 	// position of the next dequeue
+	_ 			[56]byte
+	mask 		uint64 			// capacity - 1; the cell of position `pos` is cells[pos & mask]
+	cells 		[]cell 			// the ring buffer
+	notFull 	eventCount 		// signals waiting producers that a request was dequeued
+	dequeueWaiters 				// consumers waiting for requests
+}
+
+// NewBoundedQueue creates a queue holding at most `capacity` requests, rounded up to a power of two
+func NewBoundedQueue(capacity int) Queue {
+	size := uint64(1)
+	for size < uint64(capacity) {
+		size <<= 1
+	}
+	q := &BoundedQueue{mask: size - 1, cells: make([]cell, size)}
+	// initially every cell is ready to be written at its first lap
+	for i := range q.cells {
+		q.cells[i].seq.Store(uint64(i))
+	}
+	q.notFull.init()
+	q.notEmpty.init()
+	return q
+}
+
+// Enqueue adds a Request to the queue, waiting while the queue is full
+func (q *BoundedQueue) Enqueue(task *Request) {
+	for !q.TryEnqueue(task) {
+		// announce the wait and check once more before waiting (see eventcount.go)
+		key := q.notFull.prepareWait()
+		if q.TryEnqueue(task) {
+			q.notFull.cancelWait()
+			return
+		}
+		q.notFull.wait(context.Background(), key)
+	}
+}
+
+// TryEnqueue adds a Request to the queue if it is not full. Returns true if the request was added.
+func (q *BoundedQueue) TryEnqueue(task *Request) bool {
+	pos := q.tail.Load()
+	for {
+		c := &q.cells[pos&q.mask]
+		seq := c.seq.Load()
+		switch dif := int64(seq - pos); {
+		// the cell is free at this lap: try to claim the position
+		case dif == 0:
+			if q.tail.CompareAndSwap(pos, pos+1) {
+				c.request = task
+				// publish the request: the cell is now ready to be read at position `pos`
+				c.seq.Store(pos + 1)
+				q.notEmpty.notify()
+				return true
+			}
+			pos = q.tail.Load()
+		// the cell still holds the request of the previous lap => the queue is full
+		case dif < 0:
+			return false
+		// another enqueuer claimed the position; retry with the new tail
+		default:
+			pos = q.tail.Load()
+		}
+	}
+}
+
+// DequeueWait removes a Request from the queue, waiting while the queue is empty.
+// Returns nil once the queue is closed and empty, or if `ctx` is done.
+func (q *BoundedQueue) DequeueWait(ctx context.Context) *Request {
+	return q.dequeueWait(ctx, q.Dequeue)
+}
+
+// Dequeue removes a Request from the queue. Returns nil if the queue is empty.
+func (q *BoundedQueue) Dequeue() *Request {
+	pos := q.head.Load()
+	for {
+		c := &q.cells[pos&q.mask]
+		seq := c.seq.Load()
+		switch dif := int64(seq - (pos + 1)); {
+		// the cell holds the request of this position: try to claim it
+		case dif == 0:
+			if q.head.CompareAndSwap(pos, pos+1) {
+				request := c.request
+				c.request = nil
+				// free the cell for the enqueuer of the next lap
+				c.seq.Store(pos + q.mask + 1)
+				q.notFull.notify()
+				return request
+			}
+			pos = q.head.Load()
+		// the cell was not written yet => the queue is empty
+		case dif < 0:
+			return nil
+		// another dequeuer claimed the position; retry with the new head
+		default:
+			pos = q.head.Load()
+		}
+	}
+}
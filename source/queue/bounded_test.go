@@ -0,0 +1,152 @@
+package queue
+
+// Tests for correctness of the bounded queue implementation
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBoundedSequential(t *testing.T) {
+	q := NewBoundedQueue(4)
+
+	// wraps around the ring buffer several times
+	for lap := 0; lap < 3; lap++ {
+		for i := 0; i < 4; i++ {
+			if !q.(*BoundedQueue).TryEnqueue(&Request{Id: i}) {
+				t.Fatalf("Expected room for %d requests", i+1)
+			}
+		}
+		if q.(*BoundedQueue).TryEnqueue(&Request{Id: 4}) {
+			t.Fatal("Expected the queue to be full")
+		}
+		for i := 0; i < 4; i++ {
+			result := q.Dequeue()
+			if result == nil || result.Id != i {
+				t.Errorf("Expected %d, got %v", i, result)
+			}
+		}
+		if q.Dequeue() != nil {
+			t.Fatal("Expected the queue to be empty")
+		}
+	}
+}
+
+func TestBoundedCapacityRounding(t *testing.T) {
+	q := NewBoundedQueue(5).(*BoundedQueue)
+	if len(q.cells) != 8 {
+		t.Errorf("Expected capacity 5 to be rounded up to 8. Got:%v", len(q.cells))
+	}
+}
+
+func TestBoundedEnqueueWaitsWhenFull(t *testing.T) {
+	q := NewBoundedQueue(2)
+	q.Enqueue(&Request{Id: 0})
+	q.Enqueue(&Request{Id: 1})
+
+	enqueued := make(chan bool, 1)
+	go func() {
+		q.Enqueue(&Request{Id: 2})
+		enqueued <- true
+	}()
+	select {
+	case <-enqueued:
+		t.Fatal("Enqueue did not wait for room in a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if result := q.Dequeue(); result == nil || result.Id != 0 {
+		t.Fatalf("Expected 0, got %v", result)
+	}
+	select {
+	case <-enqueued:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Enqueue was not woken up after a dequeue")
+	}
+}
+
+func TestBoundedFIFO(t *testing.T) {
+	// producers enqueue through a small queue while a consumer dequeues; each producer's requests
+	// must come out in the order they were enqueued
+	nthreads := 10
+	nvals := 200
+	result := make([]int, 0, nthreads*nvals)
+
+	q := NewBoundedQueue(8)
+
+	var wg sync.WaitGroup
+	wg.Add(nthreads)
+	for tid := 0; tid < nthreads; tid++ {
+		go func(tid int) {
+			for i := 0; i < nvals; i++ {
+				q.Enqueue(&Request{Id: i + tid*nvals})
+			}
+			wg.Done()
+		}(tid)
+	}
+
+	for len(result) < nthreads*nvals {
+		if r := q.Dequeue(); r != nil {
+			result = append(result, r.Id)
+		} else {
+			runtime.Gosched()
+		}
+	}
+	wg.Wait()
+
+	if !assertFIFO(nthreads, nvals, result) {
+		t.Errorf("Expected FIFO, got %v", result)
+	}
+}
+
+func TestBoundedMultiGoroutine(t *testing.T) {
+	// several producers and consumers; every request is dequeued exactly once
+	q := NewBoundedQueue(16)
+	n := 1000
+	goroutines := 10
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+
+	var producers, consumers sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		producers.Add(1)
+		go func(i int) {
+			defer producers.Done()
+			for j := 0; j < n; j++ {
+				q.Enqueue(&Request{Id: i*n + j})
+			}
+		}(i)
+	}
+	for i := 0; i < goroutines; i++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			for {
+				mu.Lock()
+				done := len(seen) == n*goroutines
+				mu.Unlock()
+				if done {
+					return
+				}
+				req := q.Dequeue()
+				if req == nil {
+					runtime.Gosched()
+					continue
+				}
+				mu.Lock()
+				if seen[req.Id] {
+					t.Errorf("Dequeued duplicate request with ID: %d", req.Id)
+				}
+				seen[req.Id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	producers.Wait()
+	consumers.Wait()
+	if len(seen) != n*goroutines {
+		t.Errorf("Expected %d requests, got %d", n*goroutines, len(seen))
+	}
+}
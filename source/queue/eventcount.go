@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"context"
+	"proj2/lock"
+	"sync"
+	"sync/atomic"
+)
+
+// eventCount lets goroutines wait for a condition on a lock-free structure (e.g., "the queue is not full")
+// without making the goroutines that change it take a lock when no one is waiting.
+// A waiter announces itself, reads the current epoch, checks the condition once more and only then waits for
+// the epoch to change:
+//	key := ec.prepareWait()
+//	if condition { ec.cancelWait(); ... } else { ec.wait(ctx, key) }
+// A goroutine that makes the condition true calls notify, which only locks the mutex if someone is waiting.
+// Obs: a waiter increments `waiters` before checking the condition and a notifier makes the condition true before
+// reading `waiters`, so either the waiter sees the condition true or the notifier sees the waiter and bumps the epoch.
+// The epoch is bumped while holding the mutex, so it cannot change between a waiter checking it and starting to wait.
+type eventCount struct {
+	mux 		sync.Mutex 		// used with `cond` by waiting goroutines
+	cond 		*sync.Cond 		// signals waiting goroutines that the epoch changed
+	epoch 		atomic.Uint64 	// incremented on every notification with waiters
+	waiters 	atomic.Int32 	// number of goroutines between prepareWait and the end of wait/cancelWait
+}
+
+// init initializes the condition variable of an eventCount
+func (ec *eventCount) init() {
+	ec.cond = sync.NewCond(&ec.mux)
+}
+
+// prepareWait announces a waiter and returns the epoch it must wait to change
+func (ec *eventCount) prepareWait() uint64 {
+	ec.waiters.Add(1)
+	return ec.epoch.Load()
+}
+
+// cancelWait withdraws a waiter announced by prepareWait that found the condition true
+func (ec *eventCount) cancelWait() {
+	ec.waiters.Add(-1)
+}
+
+// wait waits until the epoch is no longer `key` or `ctx` is done
+func (ec *eventCount) wait(ctx context.Context, key uint64) {
+	stop := lock.WakeOnDone(ctx, ec.cond)
+	defer stop()
+	ec.mux.Lock()
+	for ec.epoch.Load() == key && ctx.Err() == nil {
+		ec.cond.Wait()
+	}
+	ec.mux.Unlock()
+	ec.waiters.Add(-1)
+}
+
+// notify wakes up the waiters, if any
+func (ec *eventCount) notify() {
+	if ec.waiters.Load() > 0 {
+		ec.mux.Lock()
+		ec.epoch.Add(1)
+		ec.cond.Broadcast()
+		ec.mux.Unlock()
+	}
+}
+
+// dequeueWaiters implements DequeueWait and Close for a queue with a non-blocking Dequeue.
+// The queue must call `notEmpty.notify()` after every enqueue.
+type dequeueWaiters struct {
+	notEmpty 	eventCount 		// signals waiting consumers that a request was enqueued or the queue was closed
+	closed 		atomic.Bool 	// no more requests will be enqueued
+	waits 		atomic.Uint64 	// # times a consumer waited for a request; see stats.go
+}
+
+// dequeueWait returns the next request given by `dequeue`, waiting while there is none. Returns nil once the
+// queue is closed and empty, or if `ctx` is done.
+func (w *dequeueWaiters) dequeueWait(ctx context.Context, dequeue func() *Request) *Request {
+	for {
+		if request := dequeue(); request != nil {
+			return request
+		}
+		// announce the wait and check once more before waiting (see eventCount)
+		// Obs: `closed` is read before dequeueing: if the queue was already closed, every request was
+		// already enqueued, so an empty queue means there will be no more requests
+		key := w.notEmpty.prepareWait()
+		closed := w.closed.Load()
+		if request := dequeue(); request != nil {
+			w.notEmpty.cancelWait()
+			return request
+		}
+		if closed || ctx.Err() != nil {
+			w.notEmpty.cancelWait()
+			return nil
+		}
+		w.waits.Add(1)
+		w.notEmpty.wait(ctx, key)
+	}
+}
+
+// Close signals that no more requests will be enqueued, waking up the waiting consumers.
+// Requests already in the queue can still be dequeued.
+func (w *dequeueWaiters) Close() {
+	w.closed.Store(true)
+	w.notEmpty.notify()
+}
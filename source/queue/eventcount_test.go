@@ -0,0 +1,108 @@
+package queue
+
+// Tests for the blocking dequeue of the concurrent queues
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingQueues returns a fresh instance of every queue with a blocking DequeueWait
+func blockingQueues() map[string]Queue {
+	return map[string]Queue{
+		"lockfree": NewLockFreeQueue(),
+		"bounded":  NewBoundedQueue(16),
+		"pooled":   NewPooledQueue(),
+		"priority": NewPriorityQueue(DefaultWeights),
+		"stealing": NewStealingQueue(4),
+	}
+}
+
+func TestDequeueWaitWakesOnEnqueue(t *testing.T) {
+	for name, q := range blockingQueues() {
+		dequeued := make(chan *Request, 1)
+		go func() {
+			dequeued <- q.DequeueWait(context.Background())
+		}()
+		select {
+		case <-dequeued:
+			t.Fatalf("%s: DequeueWait did not wait on an empty queue", name)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		q.Enqueue(&Request{Id: 7})
+		select {
+		case result := <-dequeued:
+			if result == nil || result.Id != 7 {
+				t.Errorf("%s: Expected 7, got %v", name, result)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: DequeueWait was not woken up by an enqueue", name)
+		}
+	}
+}
+
+func TestDequeueWaitClose(t *testing.T) {
+	for name, q := range blockingQueues() {
+		// waiting consumers are released by Close
+		var group sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			group.Add(1)
+			go func() {
+				defer group.Done()
+				if result := q.DequeueWait(context.Background()); result != nil {
+					t.Errorf("%s: Expected nil from an empty closed queue, got %v", name, result)
+				}
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		q.Close()
+
+		done := make(chan bool)
+		go func() {
+			group.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: Close did not wake up the waiting consumers", name)
+		}
+	}
+}
+
+func TestDequeueWaitDrainsAfterClose(t *testing.T) {
+	for name, q := range blockingQueues() {
+		// requests enqueued before Close are still dequeued
+		for i := 0; i < 3; i++ {
+			q.Enqueue(&Request{Id: i})
+		}
+		q.Close()
+		for i := 0; i < 3; i++ {
+			if result := q.DequeueWait(context.Background()); result == nil || result.Id != i {
+				t.Errorf("%s: Expected %d, got %v", name, i, result)
+			}
+		}
+		if result := q.DequeueWait(context.Background()); result != nil {
+			t.Errorf("%s: Expected nil from an empty closed queue, got %v", name, result)
+		}
+	}
+}
+
+func TestDequeueWaitCtx(t *testing.T) {
+	for name, q := range blockingQueues() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if result := q.DequeueWait(ctx); result != nil {
+			t.Errorf("%s: Expected nil after the context is done, got %v", name, result)
+		}
+		cancel()
+
+		// the queue is still usable by other consumers
+		q.Enqueue(&Request{Id: 1})
+		if result := q.DequeueWait(context.Background()); result == nil || result.Id != 1 {
+			t.Errorf("%s: Expected 1, got %v", name, result)
+		}
+	}
+}
@@ -1,26 +1,49 @@
 // This script implements a lock-free queue a la Michael and Scott
 // Obs: the ABA problem is not addressed in this implementation due to the limitations
 // of Go's atomic operation. For more details on that, see https://stackoverflow.com/questions/11525406/atomic-compare-and-swap-with-struct-in-go
+// PooledQueue (pooled.go) addresses it with tagged indices instead of pointers
 
 package queue
 
 import (
+	"context"
 	"sync/atomic"
 	"unsafe"
 )
 
 // Interface Queue represents a FIFO structure with operations to enqueue and dequeue Requests
+// @Enqueue: adds a request to the queue
+// @Dequeue: removes a request from the queue; returns nil if the queue is empty
+// @DequeueWait: removes a request from the queue, waiting while it is empty; returns nil once the queue
+// is closed and empty, or if the context is done
+// @Close: signals that no more requests will be enqueued, waking up the goroutines in DequeueWait
 type Queue interface {
 	Enqueue(*Request)
 	Dequeue() *Request
+	DequeueWait(ctx context.Context) *Request
+	Close()
 }
 
 // Request represents a client request to be processed by the server
 type Request struct {
-	Command  	string   	`json:"command"` 	// "ADD", "REMOVE", "CONTAINS", "FEED"
+	Command  	string   	`json:"command"` 	// "ADD", "REMOVE", "CONTAINS", "FEED", "FOLLOW", "UNFOLLOW", "TIMELINE", "STATS"
 	Id 			int   		`json:"id"`			// unique id for the request
+	User 		string 		`json:"user"`		// the user whose feed the request refers to ("" = default user)
+	Followee 	string 		`json:"followee"`	// the user to follow/unfollow ("FOLLOW" and "UNFOLLOW" only)
 	Body 		string 		`json:"body"`		// the text of the post
 	TimeStamp 	float64 	`json:"timestamp"`	// the timestamp of the post
+	Since 		*float64 	`json:"since"`		// "FEED" only: return posts newer than `since`
+	Until 		*float64 	`json:"until"`		// "FEED" only: return posts older than `until`
+	Limit 		int 		`json:"limit"`		// "FEED" only: maximum number of posts to return (0 = no limit)
+	Cursor 		string 		`json:"cursor"`		// "FEED" only: resume from the `cursor` of the previous page
+	Timeout 	int 		`json:"timeout"`		// "FEED" only: milliseconds to wait for the lock of the feed (0 = the server default)
+	Meta 		interface{} `json:"-"` 			// bookkeeping attached by the server to the request; not sent by clients
+}
+
+// IsPaged returns true if a "FEED" request asks for a range or a page of the feed
+// instead of the whole feed
+func (r *Request) IsPaged() bool {
+	return r.Since != nil || r.Until != nil || r.Limit > 0 || r.Cursor != ""
 }
 
 // node represents a node in the queue
@@ -38,6 +61,8 @@ type node struct{
 type LockFreeQueue struct {
 	head	unsafe.Pointer
 	tail 	unsafe.Pointer
+	dequeueWaiters 			// consumers waiting for requests; see eventcount.go
+	contention 				// retries of the enqueues and dequeues; see stats.go
 }
 
 // NewQueue creates and initializes a LockFreeQueue
@@ -45,7 +70,9 @@ func NewLockFreeQueue() Queue {
 	// creates a dummy node and pointer to it
 	nod := &node{request: nil, next:nil}
 	// initial queue: dummy node and head = tail = pointer to dummy node
-	return &LockFreeQueue{head:unsafe.Pointer(nod), tail: unsafe.Pointer(nod)}
+	queue := &LockFreeQueue{head:unsafe.Pointer(nod), tail: unsafe.Pointer(nod)}
+	queue.notEmpty.init()
+	return queue
 }
 
 
@@ -65,8 +92,11 @@ func (queue *LockFreeQueue) Enqueue(task *Request) {
 		if next == nil {
 			// compare 'nil' node from candidate tail to current tail again; if succeeds enqueue the new node
 			if atomic.CompareAndSwapPointer(&tail.next, next, unsafe.Pointer(nod)){
+				// wake up the consumers waiting for a request, if any
+				queue.notEmpty.notify()
 				return
 			}
+			queue.enqueueRetries.Add(1)
 		// if next is not nil, candidate tail is lagging behind; try to update the tail 
 		// (i.e., another thread enqueued successfully but was not able to update the tail poiner; try do the job for him)
 		// obs: threads help each other to update the tail 
@@ -80,6 +110,12 @@ func (queue *LockFreeQueue) Enqueue(task *Request) {
 }
 
 
+// DequeueWait removes a Request from the queue, waiting while the queue is empty.
+// Returns nil once the queue is closed and empty, or if `ctx` is done.
+func (queue *LockFreeQueue) DequeueWait(ctx context.Context) *Request {
+	return queue.dequeueWait(ctx, queue.Dequeue)
+}
+
 // Dequeue removes a Request from the queue
 func (queue *LockFreeQueue) Dequeue() *Request {
 	for{
@@ -106,6 +142,12 @@ func (queue *LockFreeQueue) Dequeue() *Request {
 			if atomic.CompareAndSwapPointer(&queue.head, head, next){
 				return request
 			}
+			queue.dequeueRetries.Add(1)
 		}
 	}
 }
+
+// Stats returns the contention counters of the queue
+func (queue *LockFreeQueue) Stats() Stats {
+	return queue.contention.stats(&queue.dequeueWaiters)
+}
@@ -1,14 +1,28 @@
 package queue
 
-// Tests for correctness of the lockfree queue implementation
+// Tests for correctness of the lockfree queue implementations
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 )
 
 
+// lockFreeQueues holds the constructors of the lock-free queues; every test runs against each of them
+var lockFreeQueues = map[string]func() Queue{
+	"lockfree": NewLockFreeQueue,
+	"pooled":   NewPooledQueue,
+}
+
+// forEachQueue runs `test` as a subtest for each lock-free queue
+func forEachQueue(t *testing.T, test func(t *testing.T, newQueue func() Queue)) {
+	for name, newQueue := range lockFreeQueues {
+		t.Run(name, func(t *testing.T) { test(t, newQueue) })
+	}
+}
 
 func isPermutation(n int, data []int) bool {
 	seen := make([]bool, n)
@@ -28,59 +42,63 @@ func isPermutation(n int, data []int) bool {
 }
 
 func TestSequential(t *testing.T) {
-	q := NewLockFreeQueue()
+	forEachQueue(t, func(t *testing.T, newQueue func() Queue) {
+		q := newQueue()
 
-	for i := 0; i < 10; i++ {
-		q.Enqueue(&Request{Id: i})
-	}
-	for i := 0; i < 10; i++ {
-		result := q.Dequeue()
+		for i := 0; i < 10; i++ {
+			q.Enqueue(&Request{Id: i})
+		}
+		for i := 0; i < 10; i++ {
+			result := q.Dequeue()
 
-		if result == nil || result.Id != i {
-			t.Errorf("Expected %d, got %v", i, result)
+			if result == nil || result.Id != i {
+				t.Errorf("Expected %d, got %v", i, result)
+			}
 		}
-	}
+	})
 }
 
 func TestPermute(t *testing.T) {
-	n := 100
-	q := NewLockFreeQueue()
-	data := make([]int, n)
-
-	var wg sync.WaitGroup
-	wg.Add(n)
-
-	for i := 0; i < n; i++ {
-		go func(i int) {
-			q.Enqueue(&Request{Id: i})
-			wg.Done()
-		}(i)
-	}
+	forEachQueue(t, func(t *testing.T, newQueue func() Queue) {
+		n := 100
+		q := newQueue()
+		data := make([]int, n)
+
+		var wg sync.WaitGroup
+		wg.Add(n)
+
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				q.Enqueue(&Request{Id: i})
+				wg.Done()
+			}(i)
+		}
 
-	wg.Wait()
+		wg.Wait()
 
-	wg.Add(n)
+		wg.Add(n)
 
-	for i := 0; i < n; i++ {
-		go func(i int) {
-			result := q.Dequeue()
-			if result != nil {
-				data[i] = result.Id
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				result := q.Dequeue()
+				if result != nil {
+					data[i] = result.Id
 				
-			} else {
-				fmt.Println("\nNil value!")
-			}
+				} else {
+					fmt.Println("\nNil value!")
+				}
 
-			wg.Done()
-		}(i)
-	}
+				wg.Done()
+			}(i)
+		}
 
-	wg.Wait()
-	fmt.Printf("\nData: %v, len %d", data, len(data))
+		wg.Wait()
+		fmt.Printf("\nData: %v, len %d", data, len(data))
 
-	if !isPermutation(n, data) {
-		t.Errorf("Expected permutation, got %v", data)
-	}
+		if !isPermutation(n, data) {
+			t.Errorf("Expected permutation, got %v", data)
+		}
+	})
 }
 
 func assertFIFO(nthreads, nvals int, data []int) bool {
@@ -102,104 +120,135 @@ func assertFIFO(nthreads, nvals int, data []int) bool {
 }
 
 func TestFIFO(t *testing.T) {
-	nthreads := 10
-	nvals := 200
-	result := make([]int, nthreads*nvals)
+	forEachQueue(t, func(t *testing.T, newQueue func() Queue) {
+		nthreads := 10
+		nvals := 200
+		result := make([]int, nthreads*nvals)
 
-	q := NewLockFreeQueue()
+		q := newQueue()
 
-	var wg sync.WaitGroup
-	wg.Add(nthreads)
+		var wg sync.WaitGroup
+		wg.Add(nthreads)
 
-	for tid := 0; tid < nthreads; tid++ {
-		go func(tid int) {
-			for i := 0; i < nvals; i++ {
-				q.Enqueue(&Request{Id: i + tid*nvals})
-			}
-			wg.Done()
-		}(tid)
-	}
+		for tid := 0; tid < nthreads; tid++ {
+			go func(tid int) {
+				for i := 0; i < nvals; i++ {
+					q.Enqueue(&Request{Id: i + tid*nvals})
+				}
+				wg.Done()
+			}(tid)
+		}
 
-	wg.Wait()
+		wg.Wait()
 
-	for i := 0; i < nthreads*nvals; i++ {
-		r := q.Dequeue()
-		if r != nil {
-			result[i] = r.Id
+		for i := 0; i < nthreads*nvals; i++ {
+			r := q.Dequeue()
+			if r != nil {
+				result[i] = r.Id
+			}
 		}
-	}
 
-	if !assertFIFO(nthreads, nvals, result) {
-		t.Errorf("Expected FIFO, got %v", result)
-	}
+		if !assertFIFO(nthreads, nvals, result) {
+			t.Errorf("Expected FIFO, got %v", result)
+		}
+	})
 }
 
 
 func TestMultiGoroutineEnqueue(t *testing.T) {
-	q := NewLockFreeQueue()
-	wg := &sync.WaitGroup{}
-	n := 1000
-	goroutines := 10
-
-	for i := 0; i < goroutines; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for j := 0; j < n; j++ {
-				req := &Request{Id: j}
-				q.Enqueue(req)
-			}
-		}()
-	}
-	wg.Wait()
+	forEachQueue(t, func(t *testing.T, newQueue func() Queue) {
+		q := newQueue()
+		wg := &sync.WaitGroup{}
+		n := 1000
+		goroutines := 10
+
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < n; j++ {
+					req := &Request{Id: j}
+					q.Enqueue(req)
+				}
+			}()
+		}
+		wg.Wait()
 
-	for i := 0; i < n*goroutines; i++ {
-		if q.Dequeue() == nil {
-			t.Errorf("Queue should have %d elements but got less", n*goroutines)
+		for i := 0; i < n*goroutines; i++ {
+			if q.Dequeue() == nil {
+				t.Errorf("Queue should have %d elements but got less", n*goroutines)
+			}
 		}
-	}
 
-	if q.Dequeue() != nil {
-		t.Errorf("Queue should be empty, but got more elements")
-	}
+		if q.Dequeue() != nil {
+			t.Errorf("Queue should be empty, but got more elements")
+		}
+	})
 }
 
 
 func TestMultiGoroutineDequeue(t *testing.T) {
-	q := NewLockFreeQueue()
-	wg := &sync.WaitGroup{}
-	n := 1000
-	goroutines := 10
-	var mu sync.Mutex
-	seen := make(map[int]bool)
-
-	for i := 0; i < n*goroutines; i++ {
-		req := &Request{Id: i}
-		q.Enqueue(req)
-	}
+	forEachQueue(t, func(t *testing.T, newQueue func() Queue) {
+		q := newQueue()
+		wg := &sync.WaitGroup{}
+		n := 1000
+		goroutines := 10
+		var mu sync.Mutex
+		seen := make(map[int]bool)
+
+		for i := 0; i < n*goroutines; i++ {
+			req := &Request{Id: i}
+			q.Enqueue(req)
+		}
 
-	for i := 0; i < goroutines; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for {
-				req := q.Dequeue()
-				if req == nil {
-					break
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					req := q.Dequeue()
+					if req == nil {
+						break
+					}
+					mu.Lock()
+					if seen[req.Id] {
+						t.Errorf("Dequeued duplicate request with ID: %d", req.Id)
+					}
+					seen[req.Id] = true
+					mu.Unlock()
 				}
-				mu.Lock()
-				if seen[req.Id] {
-					t.Errorf("Dequeued duplicate request with ID: %d", req.Id)
-				}
-				seen[req.Id] = true
-				mu.Unlock()
-			}
-		}()
-	}
-	wg.Wait()
+			}()
+		}
+		wg.Wait()
 
-	if len(seen) != n*goroutines {
-		t.Errorf("Should have dequeued %d unique items, but got %d", n*goroutines, len(seen))
-	}
+		if len(seen) != n*goroutines {
+			t.Errorf("Should have dequeued %d unique items, but got %d", n*goroutines, len(seen))
+		}
+	})
 }
 
+
+func TestStats(t *testing.T) {
+	forEachQueue(t, func(t *testing.T, newQueue func() Queue) {
+		q := newQueue()
+		// uncontended operations are not counted, even with a lagging tail
+		for i := 0; i < 10; i++ {
+			q.Enqueue(&Request{Id: i})
+		}
+		for q.Dequeue() != nil {
+		}
+		if s := q.(Instrumented).Stats(); s != (Stats{}) {
+			t.Errorf("Expected no retries nor waits. Got:%+v", s)
+		}
+
+		// a consumer waiting on the empty queue
+		dequeued := make(chan *Request)
+		go func() { dequeued <- q.DequeueWait(context.Background()) }()
+		time.Sleep(20 * time.Millisecond)
+		q.Enqueue(&Request{Id: 2})
+		<-dequeued
+		if s := q.(Instrumented).Stats(); s.Waits != 1 {
+			t.Errorf("Expected 1 wait. Got:%+v", s)
+		}
+	})
+}
@@ -0,0 +1,193 @@
+// This script implements a lock-free queue a la Michael and Scott that recycles its nodes
+// LockFreeQueue allocates a node per request and relies on Go's garbage collector to never reuse a node
+// another thread may still be looking at. PooledQueue keeps its nodes in an arena and reuses the dequeued ones,
+// so a server in steady state does not allocate per request.
+// Reusing nodes exposes the queue to the ABA problem: a thread reads the head, another thread dequeues it,
+// frees the node and enqueues it again, and the CAS of the first thread succeeds on a different node.
+// As in Michael and Scott's paper, every link (head, tail, the `next` of each node and the free list) is a
+// "tagged index": the index of a node in the arena plus a counter incremented on every update, packed in a
+// single uint64 so it can be CASed. A CAS with a stale snapshot fails because the counter changed, even
+// if the node is the same.
+// Obs: the counter has 32 bits; a CAS could only succeed wrongly if a thread is preempted for exactly
+// 2^32 updates of the same link.
+
+package queue
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+const (
+	chunkBits 	= 12 					// each chunk of the arena holds 2^chunkBits nodes
+	chunkSize 	= 1 << chunkBits
+	maxChunks 	= 1 << 12 				// the arena holds at most maxChunks * chunkSize nodes
+	nilIndex 	= uint32(1<<32 - 1) 	// index representing the absence of a node
+)
+
+// tagged packs the index of a node (low 32 bits) and a counter (high 32 bits)
+type tagged uint64
+
+func pack(index uint32, tag uint32) uint64 { return uint64(tag)<<32 | uint64(index) }
+func (t tagged) index() uint32             { return uint32(t) }
+func (t tagged) tag() uint32               { return uint32(t >> 32) }
+
+// pooledNode represents a node in the queue or in the free list
+// Obs: a recycled node may be read by a thread holding a stale snapshot (its CAS will fail), so the fields
+// are accessed atomically
+type pooledNode struct {
+	request 	atomic.Pointer[Request] 	// the request; nil for the free nodes
+	next 		atomic.Uint64 				// tagged index of the next node in the queue or in the free list
+}
+
+// PooledQueue represents a FIFO structure with operations to enqueue and dequeue tasks represented as Request,
+// recycling its nodes
+type PooledQueue struct {
+	head 		atomic.Uint64 		// tagged index of the dummy node; the first request is in its next node
+	_ 			[56]byte
+	tail 		atomic.Uint64 		// tagged index of the last node (or of a node lagging behind it)
+	_ 			[56]byte
+	free 		atomic.Uint64 		// tagged index of the top of the free list (a Treiber stack)
+	allocated 	atomic.Uint32 		// number of nodes taken from the arena so far
+	chunks 		[maxChunks]atomic.Pointer[[chunkSize]pooledNode] 	// the arena; chunks are allocated on demand
+	dequeueWaiters 					// consumers waiting for requests; see eventcount.go
+	contention 						// retries of the enqueues and dequeues; see stats.go
+}
+
+// NewPooledQueue creates and initializes a PooledQueue
+func NewPooledQueue() Queue {
+	queue := &PooledQueue{}
+	queue.free.Store(pack(nilIndex, 0))
+	// initial queue: dummy node and head = tail = index of the dummy node
+	dummy := queue.alloc()
+	queue.head.Store(pack(dummy, 0))
+	queue.tail.Store(pack(dummy, 0))
+	queue.notEmpty.init()
+	return queue
+}
+
+// node returns the node of the arena at `index`
+func (queue *PooledQueue) node(index uint32) *pooledNode {
+	return &queue.chunks[index>>chunkBits].Load()[index&(chunkSize-1)]
+}
+
+// alloc returns the index of a node that is not in use, taken from the free list or else from the arena
+func (queue *PooledQueue) alloc() uint32 {
+	for {
+		top := tagged(queue.free.Load())
+		if top.index() == nilIndex {
+			break
+		}
+		// `next` may be stale if another thread popped the node meanwhile; then the tag of `free` changed
+		next := tagged(queue.node(top.index()).next.Load())
+		if queue.free.CompareAndSwap(uint64(top), pack(next.index(), top.tag()+1)) {
+			return top.index()
+		}
+	}
+
+	// the free list is empty: take a new node from the arena, allocating its chunk if needed
+	index := queue.allocated.Add(1) - 1
+	if index >= maxChunks*chunkSize {
+		panic("queue: PooledQueue node arena exhausted")
+	}
+	chunk := &queue.chunks[index>>chunkBits]
+	if chunk.Load() == nil {
+		// only one of the threads allocating the chunk concurrently succeeds; the others use its chunk
+		chunk.CompareAndSwap(nil, new([chunkSize]pooledNode))
+	}
+	// a new node links to no node (the zero value would be a link to the node at index 0)
+	queue.node(index).next.Store(pack(nilIndex, 0))
+	return index
+}
+
+// release pushes the node at `index` onto the free list
+func (queue *PooledQueue) release(index uint32) {
+	nod := queue.node(index)
+	// drop the request so it can be garbage collected
+	// Obs: this cannot be done when the node becomes the dummy node: by then another thread may have
+	// dequeued past it and recycled it for a new request
+	nod.request.Store(nil)
+	for {
+		top := tagged(queue.free.Load())
+		// the tag of `next` is bumped on every update, so stale snapshots of it held by enqueuers fail
+		nod.next.Store(pack(top.index(), tagged(nod.next.Load()).tag()+1))
+		if queue.free.CompareAndSwap(uint64(top), pack(index, top.tag()+1)) {
+			return
+		}
+	}
+}
+
+// Enqueue adds a Request to the queue
+func (queue *PooledQueue) Enqueue(task *Request) {
+	index := queue.alloc()
+	nod := queue.node(index)
+	nod.request.Store(task)
+	nod.next.Store(pack(nilIndex, tagged(nod.next.Load()).tag()+1))
+
+	// repeatedly try to link the node after the tail; see LockFreeQueue.Enqueue
+	var tail tagged
+	for {
+		tail = tagged(queue.tail.Load())
+		next := tagged(queue.node(tail.index()).next.Load())
+		// the snapshot is inconsistent if the tail moved meanwhile
+		if uint64(tail) != queue.tail.Load() {
+			queue.enqueueRetries.Add(1)
+			continue
+		}
+		if next.index() == nilIndex {
+			if queue.node(tail.index()).next.CompareAndSwap(uint64(next), pack(index, next.tag()+1)) {
+				break
+			}
+			queue.enqueueRetries.Add(1)
+		// the tail is lagging behind; help to update it
+		} else {
+			queue.tail.CompareAndSwap(uint64(tail), pack(next.index(), tail.tag()+1))
+		}
+	}
+	// swing the tail to the new node; if this fails, another thread already did it
+	queue.tail.CompareAndSwap(uint64(tail), pack(index, tail.tag()+1))
+	// wake up the consumers waiting for a request, if any
+	queue.notEmpty.notify()
+}
+
+// DequeueWait removes a Request from the queue, waiting while the queue is empty.
+// Returns nil once the queue is closed and empty, or if `ctx` is done.
+func (queue *PooledQueue) DequeueWait(ctx context.Context) *Request {
+	return queue.dequeueWait(ctx, queue.Dequeue)
+}
+
+// Dequeue removes a Request from the queue. Returns nil if the queue is empty.
+func (queue *PooledQueue) Dequeue() *Request {
+	for {
+		head := tagged(queue.head.Load())
+		tail := tagged(queue.tail.Load())
+		next := tagged(queue.node(head.index()).next.Load())
+		// the snapshot is inconsistent if the head moved meanwhile
+		if uint64(head) != queue.head.Load() {
+			queue.dequeueRetries.Add(1)
+			continue
+		}
+
+		// head == tail => queue is empty OR tail is lagging behind
+		if head.index() == tail.index() {
+			if next.index() == nilIndex {
+				return nil
+			}
+			queue.tail.CompareAndSwap(uint64(tail), pack(next.index(), tail.tag()+1))
+		} else {
+			// read the request before the CAS: once the head moves, the node may be recycled
+			request := queue.node(next.index()).request.Load()
+			if queue.head.CompareAndSwap(uint64(head), pack(next.index(), head.tag()+1)) {
+				// the old dummy node is no longer reachable from the queue; recycle it
+				queue.release(head.index())
+				return request
+			}
+			queue.dequeueRetries.Add(1)
+		}
+	}
+}
+
+// Stats returns the contention counters of the queue
+func (queue *PooledQueue) Stats() Stats {
+	return queue.contention.stats(&queue.dequeueWaiters)
+}
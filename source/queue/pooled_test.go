@@ -0,0 +1,80 @@
+package queue
+
+// Tests for the node recycling of the pooled queue
+// Obs: the FIFO and permutation tests in lockfree_test.go also run against the pooled queue
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestPooledRecyclesNodes(t *testing.T) {
+	q := NewPooledQueue().(*PooledQueue)
+
+	// alternating enqueues and dequeues keep reusing the same two nodes
+	for i := 0; i < 10*chunkSize; i++ {
+		q.Enqueue(&Request{Id: i})
+		if result := q.Dequeue(); result == nil || result.Id != i {
+			t.Fatalf("Expected %d, got %v", i, result)
+		}
+	}
+	if allocated := q.allocated.Load(); allocated > 2 {
+		t.Errorf("Expected the nodes to be recycled. Got %v nodes allocated", allocated)
+	}
+
+	// the arena only grows to the largest number of requests in the queue at once
+	for lap := 0; lap < 3; lap++ {
+		for i := 0; i < 100; i++ {
+			q.Enqueue(&Request{Id: i})
+		}
+		for i := 0; i < 100; i++ {
+			if result := q.Dequeue(); result == nil || result.Id != i {
+				t.Fatalf("Expected %d, got %v", i, result)
+			}
+		}
+	}
+	if allocated := q.allocated.Load(); allocated > 101 {
+		t.Errorf("Expected at most 101 nodes allocated. Got:%v", allocated)
+	}
+}
+
+func TestPooledConcurrentRecycling(t *testing.T) {
+	// goroutines enqueue and dequeue concurrently on an almost empty queue, so the same nodes are freed and
+	// reused over and over while other goroutines hold snapshots of them; every request is dequeued exactly once
+	q := NewPooledQueue()
+	n := 2000
+	goroutines := 8
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+
+	var group sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			for j := 0; j < n; j++ {
+				q.Enqueue(&Request{Id: i*n + j})
+				req := q.Dequeue()
+				for req == nil {
+					runtime.Gosched()
+					req = q.Dequeue()
+				}
+				mu.Lock()
+				if seen[req.Id] {
+					t.Errorf("Dequeued duplicate request with ID: %d", req.Id)
+				}
+				seen[req.Id] = true
+				mu.Unlock()
+			}
+		}(i)
+	}
+	group.Wait()
+
+	if len(seen) != n*goroutines {
+		t.Errorf("Expected %d requests, got %d", n*goroutines, len(seen))
+	}
+	if q.Dequeue() != nil {
+		t.Error("Expected the queue to be empty")
+	}
+}
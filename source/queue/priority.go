@@ -0,0 +1,126 @@
+// This script implements a multi-class queue scheduling requests by command class
+// In a FIFO queue, a "CONTAINS" sent after 50,000 "ADD"s waits until every "ADD" is dequeued. PriorityQueue keeps
+// one lock-free FIFO queue per class of command (reads, writes, feeds) and dequeues from the classes by
+// weighted round robin: out of every Read+Write+Feed dequeues with all classes busy, `Read` take a read, `Write`
+// take a write and `Feed` take a feed. A class with no requests gives its turn to the next class.
+// Obs: starvation protection: every weight is at least 1, so a class with requests is served at least once
+// every Read+Write+Feed dequeues, however many requests the other classes have.
+// Obs2: requests of the same class are dequeued in FIFO order; requests of different classes are not.
+
+package queue
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Class is the scheduling class of a request
+type Class int
+
+const (
+	ReadClass 	Class = iota 	// "CONTAINS", "STATS"
+	WriteClass 					// "ADD", "REMOVE", "FOLLOW", "UNFOLLOW" and unknown commands
+	FeedClass 					// "FEED", "TIMELINE"
+	numClasses
+)
+
+// ClassOf returns the scheduling class of a request
+func ClassOf(r *Request) Class {
+	switch r.Command {
+	case "CONTAINS", "STATS":
+		return ReadClass
+	case "FEED", "TIMELINE":
+		return FeedClass
+	}
+	return WriteClass
+}
+
+// Weights represents the share of the dequeues given to each class when all classes have requests
+// Obs: weights < 1 are replaced by the default weights (see DefaultWeights)
+type Weights struct {
+	Read 	int
+	Write 	int
+	Feed 	int
+}
+
+// DefaultWeights favors the cheap reads over the writes, and the writes over the feeds
+var DefaultWeights = Weights{Read: 4, Write: 2, Feed: 1}
+
+// PriorityQueue represents a queue of Requests dequeued by weighted round robin among their classes
+type PriorityQueue struct {
+	classes 	[numClasses]Queue 	// one FIFO queue per class
+	schedule 	[]Class 			// the turns of the round robin; each class appears as many times as its weight
+	turn 		atomic.Uint64 		// the next turn of the schedule
+	dequeueWaiters 					// consumers waiting for requests; see eventcount.go
+}
+
+// NewPriorityQueue creates and initializes a PriorityQueue with the given weights
+func NewPriorityQueue(weights Weights) Queue {
+	if weights.Read < 1 {
+		weights.Read = DefaultWeights.Read
+	}
+	if weights.Write < 1 {
+		weights.Write = DefaultWeights.Write
+	}
+	if weights.Feed < 1 {
+		weights.Feed = DefaultWeights.Feed
+	}
+
+	q := &PriorityQueue{schedule: smoothSchedule([numClasses]int{weights.Read, weights.Write, weights.Feed})}
+	for i := range q.classes {
+		q.classes[i] = NewLockFreeQueue()
+	}
+	q.notEmpty.init()
+	return q
+}
+
+// smoothSchedule returns the turns of a weighted round robin, spreading the turns of each class over the
+// schedule (e.g., weights 2, 1, 1 give R W F R instead of R R W F) so that no class waits for a whole run of
+// another class's turns
+func smoothSchedule(weights [numClasses]int) []Class {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	schedule := make([]Class, 0, total)
+	var current [numClasses]int
+	for len(schedule) < total {
+		// every class earns its weight, the richest class takes the turn and pays for it
+		best := Class(0)
+		for class := range current {
+			current[class] += weights[class]
+			if current[class] > current[best] {
+				best = Class(class)
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// Enqueue adds a Request to the queue of its class
+func (q *PriorityQueue) Enqueue(task *Request) {
+	q.classes[ClassOf(task)].Enqueue(task)
+	// wake up the consumers waiting for a request, if any
+	q.notEmpty.notify()
+}
+
+// DequeueWait removes a Request from the queue, waiting while the queue is empty.
+// Returns nil once the queue is closed and empty, or if `ctx` is done.
+func (q *PriorityQueue) DequeueWait(ctx context.Context) *Request {
+	return q.dequeueWait(ctx, q.Dequeue)
+}
+
+// Dequeue removes a Request from the class whose turn it is or, if that class has no requests, from the
+// next classes. Returns nil if every class is empty.
+func (q *PriorityQueue) Dequeue() *Request {
+	turn := q.turn.Add(1) - 1
+	first := q.schedule[turn%uint64(len(q.schedule))]
+	for i := Class(0); i < numClasses; i++ {
+		if request := q.classes[(first+i)%numClasses].Dequeue(); request != nil {
+			return request
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package queue
+
+// Tests for the scheduling of the multi-class queue
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestPriorityReadsOvertakeWrites(t *testing.T) {
+	q := NewPriorityQueue(Weights{Read: 4, Write: 1, Feed: 1})
+	for i := 0; i < 100; i++ {
+		q.Enqueue(&Request{Command: "ADD", Id: i})
+	}
+	q.Enqueue(&Request{Command: "CONTAINS", Id: 100})
+
+	// the "CONTAINS" enqueued after 100 "ADD"s is dequeued within the first turns
+	for i := 0; i < 6; i++ {
+		if result := q.Dequeue(); result != nil && result.Id == 100 {
+			return
+		}
+	}
+	t.Error("Expected the CONTAINS to overtake the ADDs")
+}
+
+func TestPriorityWeights(t *testing.T) {
+	// with every class busy, each class gets its weight out of every Read+Write+Feed dequeues
+	weights := Weights{Read: 3, Write: 2, Feed: 1}
+	q := NewPriorityQueue(weights)
+	for i := 0; i < 60; i++ {
+		q.Enqueue(&Request{Command: "CONTAINS"})
+		q.Enqueue(&Request{Command: "ADD"})
+		q.Enqueue(&Request{Command: "FEED"})
+	}
+
+	var counts [numClasses]int
+	for i := 0; i < 60; i++ {
+		counts[ClassOf(q.Dequeue())]++
+	}
+	if counts[ReadClass] != 30 || counts[WriteClass] != 20 || counts[FeedClass] != 10 {
+		t.Errorf("Expected 30 reads, 20 writes and 10 feeds. Got:%v", counts)
+	}
+}
+
+func TestPriorityNoStarvation(t *testing.T) {
+	// a class with a small weight is still served while the other classes have plenty of requests
+	q := NewPriorityQueue(Weights{Read: 10, Write: 1, Feed: 1})
+	for i := 0; i < 1000; i++ {
+		q.Enqueue(&Request{Command: "CONTAINS"})
+	}
+	q.Enqueue(&Request{Command: "ADD", Id: -1})
+
+	for i := 0; i < 12; i++ {
+		if result := q.Dequeue(); result.Id == -1 {
+			return
+		}
+	}
+	t.Error("Expected the ADD to be dequeued within one round of the schedule")
+}
+
+func TestPriorityFIFOWithinClass(t *testing.T) {
+	// requests of the same class and producer come out in the order they were enqueued
+	nthreads := 10
+	nvals := 200
+	q := NewPriorityQueue(DefaultWeights)
+
+	var wg sync.WaitGroup
+	wg.Add(nthreads)
+	for tid := 0; tid < nthreads; tid++ {
+		go func(tid int) {
+			for i := 0; i < nvals; i++ {
+				q.Enqueue(&Request{Command: "ADD", Id: i + tid*nvals})
+				q.Enqueue(&Request{Command: "CONTAINS", Id: i + tid*nvals})
+			}
+			wg.Done()
+		}(tid)
+	}
+	wg.Wait()
+
+	var writes, reads []int
+	for r := q.Dequeue(); r != nil; r = q.Dequeue() {
+		if r.Command == "ADD" {
+			writes = append(writes, r.Id)
+		} else {
+			reads = append(reads, r.Id)
+		}
+	}
+	if len(writes) != nthreads*nvals || !assertFIFO(nthreads, nvals, writes) {
+		t.Errorf("Expected FIFO writes, got %v", writes)
+	}
+	if len(reads) != nthreads*nvals || !assertFIFO(nthreads, nvals, reads) {
+		t.Errorf("Expected FIFO reads, got %v", reads)
+	}
+}
@@ -3,6 +3,10 @@
 
 package queue
 
+import (
+	"context"
+)
+
 type qNode struct {
 	request 	*Request
 	next 		*qNode
@@ -38,4 +42,14 @@ func (q *SeqQueue) Dequeue() *Request {
 	request := q.head.next.request
 	q.head = q.head.next
 	return request
-}
\ No newline at end of file
+}
+
+// DequeueWait dequeues a Request from the queue. It never waits: the queue is not thread-safe,
+// so no other goroutine can enqueue while it waits. Returns nil if the queue is empty.
+func (q *SeqQueue) DequeueWait(ctx context.Context) *Request {
+	return q.Dequeue()
+}
+
+// Close does nothing, as DequeueWait never waits
+func (q *SeqQueue) Close() {
+}
@@ -0,0 +1,37 @@
+// Contention counters of the queues.
+// The lock-free queues count the retries of their enqueues and dequeues because another thread changed the queue
+// first (a failed CAS linking a node or moving the head, or an inconsistent snapshot), and the queues waking up
+// consumers with dequeueWaiters count how many times a consumer waited for a request. Next to the statistics of the locks of the feeds (see
+// lock/stats.go), they tell a bottleneck at the head or tail of the queue from one at the feeds.
+// Obs: only the retries and waits are counted, so an uncontended operation does not touch the counters. Helping
+// a lagging tail is not counted: LockFreeQueue.Enqueue leaves the tail behind on every enqueue.
+
+package queue
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the contention counters of a queue
+type Stats struct {
+	EnqueueRetries 	uint64 	`json:"enqueueRetries"` 	// # retries of the enqueues
+	DequeueRetries 	uint64 	`json:"dequeueRetries"` 	// # retries of the dequeues
+	Waits 			uint64 	`json:"waits"` 			// # times a consumer waited for the queue to be non-empty
+}
+
+// Instrumented represents a queue keeping contention counters
+// @Stats: returns the current values of the counters
+type Instrumented interface {
+	Stats() Stats
+}
+
+// contention holds the retry counters of a lock-free queue
+type contention struct {
+	enqueueRetries 	atomic.Uint64
+	dequeueRetries 	atomic.Uint64
+}
+
+// stats returns the current values of the counters of a queue with `c` and waiters `w`
+func (c *contention) stats(w *dequeueWaiters) Stats {
+	return Stats{EnqueueRetries: c.enqueueRetries.Load(), DequeueRetries: c.dequeueRetries.Load(), Waits: w.waits.Load()}
+}
@@ -0,0 +1,169 @@
+// This script implements work-stealing queues: one deque per consumer instead of a single shared queue
+// With a single LockFreeQueue, every consumer CASes the same head, which becomes the contention point with many
+// consumers. StealingQueue spreads the requests over one deque per consumer: Enqueue deals the requests
+// round robin and each consumer takes requests from the front of its own deque, so most of the time consumers
+// touch different memory. A consumer whose deque is empty steals from the back of the other deques, so no
+// consumer idles while another has a backlog.
+// Obs: each deque is guarded by its own mutex; the producer and the owner of a deque are usually the only
+// goroutines using it, and a thief only locks it when its own deque is empty.
+// Obs2: requests are not dequeued in the order they were enqueued, not even with a single producer.
+
+package queue
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// deque represents a double-ended queue of Requests, kept in a ring buffer that grows as needed
+type deque struct {
+	mux 	sync.Mutex
+	buf 	[]*Request 		// the ring buffer; its length is a power of two
+	head 	int 			// position of the front request in `buf`
+	size 	int 			// number of requests in the deque
+}
+
+// pushBack adds a request to the back of the deque
+func (d *deque) pushBack(r *Request) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.size == len(d.buf) {
+		d.grow()
+	}
+	d.buf[(d.head+d.size)&(len(d.buf)-1)] = r
+	d.size++
+}
+
+// grow doubles the capacity of the ring buffer. Must be called with the lock held.
+func (d *deque) grow() {
+	capacity := 2 * len(d.buf)
+	if capacity == 0 {
+		capacity = 16
+	}
+	buf := make([]*Request, capacity)
+	for i := 0; i < d.size; i++ {
+		buf[i] = d.buf[(d.head+i)&(len(d.buf)-1)]
+	}
+	d.buf = buf
+	d.head = 0
+}
+
+// popFront removes the request at the front of the deque (the oldest). Returns nil if the deque is empty.
+func (d *deque) popFront() *Request {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.size == 0 {
+		return nil
+	}
+	r := d.buf[d.head]
+	d.buf[d.head] = nil
+	d.head = (d.head + 1) & (len(d.buf) - 1)
+	d.size--
+	return r
+}
+
+// popBack removes the request at the back of the deque (the newest). Returns nil if the deque is empty.
+func (d *deque) popBack() *Request {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if d.size == 0 {
+		return nil
+	}
+	d.size--
+	i := (d.head + d.size) & (len(d.buf) - 1)
+	r := d.buf[i]
+	d.buf[i] = nil
+	return r
+}
+
+// StealingQueue represents a set of per-consumer deques with operations to enqueue Requests round robin
+// and to dequeue them from any deque
+type StealingQueue struct {
+	deques 		[]*deque 		// one deque per consumer
+	next 		atomic.Uint64 	// the deque of the next enqueue
+	dequeueWaiters 				// consumers waiting for requests; see eventcount.go
+}
+
+// NewStealingQueue creates and initializes a StealingQueue with a deque for each of `consumers` consumers
+func NewStealingQueue(consumers int) *StealingQueue {
+	if consumers < 1 {
+		consumers = 1
+	}
+	q := &StealingQueue{deques: make([]*deque, consumers)}
+	for i := range q.deques {
+		q.deques[i] = &deque{}
+	}
+	q.notEmpty.init()
+	return q
+}
+
+// Enqueue adds a Request to the back of the next deque, round robin
+func (q *StealingQueue) Enqueue(task *Request) {
+	i := (q.next.Add(1) - 1) % uint64(len(q.deques))
+	q.deques[i].pushBack(task)
+	// wake up the consumers waiting for a request, if any
+	q.notEmpty.notify()
+}
+
+// Dequeue removes a Request from any deque, starting with the deque of the next enqueue.
+// Returns nil if every deque is empty.
+func (q *StealingQueue) Dequeue() *Request {
+	return q.dequeueFrom(int(q.next.Load() % uint64(len(q.deques))))
+}
+
+// dequeueFrom removes the oldest Request of deque `id` or, if it is empty, steals the newest Request of
+// the next non-empty deque. Returns nil if every deque is empty.
+func (q *StealingQueue) dequeueFrom(id int) *Request {
+	if r := q.deques[id].popFront(); r != nil {
+		return r
+	}
+	n := len(q.deques)
+	for i := 1; i < n; i++ {
+		if r := q.deques[(id+i)%n].popBack(); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// DequeueWait removes a Request from any deque, waiting while the deques are empty.
+// Returns nil once the queue is closed and empty, or if `ctx` is done.
+func (q *StealingQueue) DequeueWait(ctx context.Context) *Request {
+	return q.dequeueWait(ctx, q.Dequeue)
+}
+
+// Worker returns the view of the queue of consumer `i`, which dequeues from the deque of the consumer
+// and only steals from the other deques when it is empty
+func (q *StealingQueue) Worker(i int) Queue {
+	return &worker{q: q, id: i % len(q.deques)}
+}
+
+// worker represents the view of a StealingQueue of one of its consumers
+type worker struct {
+	q 		*StealingQueue
+	id 		int 		// the index of the consumer's deque
+}
+
+// Enqueue adds a Request to the back of the consumer's own deque
+func (w *worker) Enqueue(task *Request) {
+	w.q.deques[w.id].pushBack(task)
+	w.q.notEmpty.notify()
+}
+
+// Dequeue removes the oldest Request of the consumer's deque or, if it is empty, steals the newest Request of
+// another deque. Returns nil if every deque is empty.
+func (w *worker) Dequeue() *Request {
+	return w.q.dequeueFrom(w.id)
+}
+
+// DequeueWait removes a Request like Dequeue, waiting while every deque is empty.
+// Returns nil once the queue is closed and empty, or if `ctx` is done.
+func (w *worker) DequeueWait(ctx context.Context) *Request {
+	return w.q.dequeueWait(ctx, w.Dequeue)
+}
+
+// Close closes the whole StealingQueue
+func (w *worker) Close() {
+	w.q.Close()
+}
@@ -0,0 +1,101 @@
+package queue
+
+// Tests for the work-stealing deques
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestStealingRoundRobin(t *testing.T) {
+	// requests are dealt round robin and each worker takes the oldest request of its own deque first
+	q := NewStealingQueue(4)
+	for i := 0; i < 8; i++ {
+		q.Enqueue(&Request{Id: i})
+	}
+	for lap := 0; lap < 2; lap++ {
+		for w := 0; w < 4; w++ {
+			if result := q.Worker(w).Dequeue(); result == nil || result.Id != w+4*lap {
+				t.Errorf("Expected worker %d to dequeue %d, got %v", w, w+4*lap, result)
+			}
+		}
+	}
+	if q.Dequeue() != nil {
+		t.Error("Expected the queue to be empty")
+	}
+}
+
+func TestStealingSteals(t *testing.T) {
+	// a worker with an empty deque steals the newest requests of the other deques
+	q := NewStealingQueue(2)
+	owner, thief := q.Worker(0), q.Worker(1)
+	for i := 0; i < 4; i++ {
+		owner.Enqueue(&Request{Id: i})
+	}
+	if result := thief.Dequeue(); result == nil || result.Id != 3 {
+		t.Errorf("Expected the thief to steal 3, got %v", result)
+	}
+	if result := owner.Dequeue(); result == nil || result.Id != 0 {
+		t.Errorf("Expected the owner to dequeue 0, got %v", result)
+	}
+}
+
+func TestStealingGrow(t *testing.T) {
+	// the ring buffer of a deque grows while keeping the order of its requests
+	q := NewStealingQueue(1)
+	for lap := 0; lap < 2; lap++ {
+		for i := 0; i < 100; i++ {
+			q.Enqueue(&Request{Id: i})
+		}
+		for i := 0; i < 100; i++ {
+			if result := q.Dequeue(); result == nil || result.Id != i {
+				t.Fatalf("Expected %d, got %v", i, result)
+			}
+		}
+	}
+}
+
+func TestStealingMultiGoroutine(t *testing.T) {
+	// producers enqueue while workers dequeue and steal; every request is dequeued exactly once
+	workers := 4
+	q := NewStealingQueue(workers)
+	n := 1000
+	producers := 4
+	var mu sync.Mutex
+	seen := make(map[int]bool)
+
+	var consumers sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		consumers.Add(1)
+		go func(tasks Queue) {
+			defer consumers.Done()
+			for req := tasks.DequeueWait(context.Background()); req != nil; req = tasks.DequeueWait(context.Background()) {
+				mu.Lock()
+				if seen[req.Id] {
+					t.Errorf("Dequeued duplicate request with ID: %d", req.Id)
+				}
+				seen[req.Id] = true
+				mu.Unlock()
+			}
+		}(q.Worker(w))
+	}
+
+	var group sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			for j := 0; j < n; j++ {
+				q.Enqueue(&Request{Id: i*n + j})
+			}
+		}(i)
+	}
+	group.Wait()
+	q.Close()
+	consumers.Wait()
+
+	if len(seen) != n*producers {
+		t.Errorf("Expected %d requests, got %d", n*producers, len(seen))
+	}
+}
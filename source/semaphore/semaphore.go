@@ -1,14 +1,92 @@
+// Package semaphore provides a counting semaphore implemented with a mutex and a condition variable,
+// the same primitives used by the r/w lock in `lock/rwlock.go`.
 package semaphore
 
+import (
+	"context"
+	"proj2/lock"
+	"sync"
+	"time"
+)
+
+// Semaphore represents a counting semaphore
 type Semaphore struct {
+	mutex 		sync.Mutex 		// protects `value`
+	cond 		*sync.Cond 		// signals waiting goroutines that a permit was released
+	value 		int 			// number of permits available
 }
 
+// NewSemaphore creates a semaphore with `capacity` permits available
 func NewSemaphore(capacity int) *Semaphore {
-	return nil
+	s := &Semaphore{value: capacity}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
 }
-func (s *Semaphore) Up() {
 
+// Up releases a permit, waking up a goroutine waiting for one, if any
+func (s *Semaphore) Up() {
+	s.mutex.Lock()
+	s.value++
+	s.cond.Signal()
+	s.mutex.Unlock()
 }
+// Obs: signaling a single waiter is enough even with waiters that give up (see DownTimeout): a waiter only
+// gives up if there is no permit available, so a signaled waiter either takes the permit or someone else did.
+
+// Down acquires a permit, waiting until one is available
 func (s *Semaphore) Down() {
+	s.mutex.Lock()
+	for s.value == 0 {
+		s.cond.Wait()
+	}
+	s.value--
+	s.mutex.Unlock()
+}
 
+// TryDown acquires a permit if one is available without waiting. Returns true if the permit was acquired.
+func (s *Semaphore) TryDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.value == 0 {
+		return false
+	}
+	s.value--
+	return true
+}
+
+// DownTimeout acquires a permit, waiting at most `d` for one to be available.
+// Returns true if the permit was acquired.
+func (s *Semaphore) DownTimeout(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	stop := lock.WakeAfter(s.cond, d)
+	defer stop()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.value == 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		s.cond.Wait()
+	}
+	s.value--
+	return true
+}
+
+// DownCtx acquires a permit, waiting until one is available or `ctx` is done.
+// Returns nil if the permit was acquired or else the context's error.
+func (s *Semaphore) DownCtx(ctx context.Context) error {
+	stop := lock.WakeOnDone(ctx, s.cond)
+	defer stop()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.value == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.cond.Wait()
+	}
+	s.value--
+	return nil
 }
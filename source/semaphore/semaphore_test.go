@@ -1,6 +1,8 @@
 package semaphore
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
@@ -70,3 +72,98 @@ func Test2(t *testing.T) {
 	}
 	group.Wait()
 }
+
+func TestTryDown(t *testing.T) {
+	sema := NewSemaphore(2)
+	if !sema.TryDown() || !sema.TryDown() {
+		t.Fatal("Expected to acquire the 2 permits")
+	}
+	if sema.TryDown() {
+		t.Fatal("Expected no permit available")
+	}
+	sema.Up()
+	if !sema.TryDown() {
+		t.Fatal("Expected to acquire the released permit")
+	}
+}
+
+func TestDownTimeout(t *testing.T) {
+	sema := NewSemaphore(1)
+	if !sema.DownTimeout(time.Millisecond) {
+		t.Fatal("Expected to acquire the available permit")
+	}
+
+	// no permit: gives up after the timeout
+	start := time.Now()
+	if sema.DownTimeout(20 * time.Millisecond) {
+		t.Fatal("Expected to time out")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected to wait at least 20ms. Waited:%v", elapsed)
+	}
+
+	// a permit released before the timeout is acquired
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sema.Up()
+	}()
+	if !sema.DownTimeout(10 * time.Second) {
+		t.Fatal("Expected to acquire the released permit")
+	}
+}
+
+func TestDownCtx(t *testing.T) {
+	sema := NewSemaphore(0)
+
+	// cancelled while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := sema.DownCtx(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled. Got:%v", err)
+	}
+
+	// deadline exceeded
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sema.DownCtx(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded. Got:%v", err)
+	}
+
+	// a permit released while waiting is acquired
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sema.Up()
+	}()
+	if err := sema.DownCtx(context.Background()); err != nil {
+		t.Fatalf("Expected to acquire the released permit. Got:%v", err)
+	}
+}
+
+func TestGiveUpKeepsPermits(t *testing.T) {
+	// goroutines giving up and acquiring permits concurrently; in the end, all permits must be available again
+	sema := NewSemaphore(3)
+	var group sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for j := 0; j < 100; j++ {
+				if sema.DownTimeout(time.Microsecond) {
+					sema.Up()
+				}
+			}
+		}()
+	}
+	group.Wait()
+	for i := 0; i < 3; i++ {
+		if !sema.TryDown() {
+			t.Fatalf("Expected 3 permits available. Got:%v", i)
+		}
+	}
+	if sema.TryDown() {
+		t.Fatal("Expected only 3 permits available")
+	}
+}
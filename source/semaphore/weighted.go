@@ -0,0 +1,123 @@
+package semaphore
+
+import (
+	"context"
+	"proj2/lock"
+	"sync"
+)
+
+// Weighted represents a semaphore whose permits are acquired and released `n` at a time.
+// Waiters are served in strict FIFO order: a waiter blocks all the waiters that came after it, even the ones
+// asking for fewer permits than available, so a waiter asking for many permits is not starved by a stream
+// of waiters asking for few.
+type Weighted struct {
+	mutex 		sync.Mutex 		// protects `available` and `waiters`
+	capacity 	int64 			// total number of permits
+	available 	int64 			// number of permits available
+	waiters 	[]*waiter 		// goroutines waiting for permits, in arrival order
+}
+
+// waiter is a goroutine waiting for permits
+// Obs: each waiter has its own condition variable (sharing the semaphore's mutex), so that releasing permits
+// wakes up exactly the waiters that got them
+type waiter struct {
+	n 			int64 			// number of permits asked for
+	cond 		*sync.Cond 		// signals the waiter that it got the permits
+	ready 		bool 			// the permits were given to the waiter
+}
+
+// NewWeighted creates a weighted semaphore with `capacity` permits available
+func NewWeighted(capacity int64) *Weighted {
+	return &Weighted{capacity: capacity, available: capacity}
+}
+
+// Capacity returns the total number of permits of the semaphore
+func (s *Weighted) Capacity() int64 {
+	return s.capacity
+}
+
+// Acquire acquires `n` permits, waiting until they are available and all earlier waiters were served.
+// Panics if `n` is larger than the capacity, as the permits would never be available.
+func (s *Weighted) Acquire(n int64) {
+	s.AcquireCtx(context.Background(), n)
+}
+
+// AcquireCtx acquires `n` permits like Acquire, but gives up when `ctx` is done.
+// Returns nil if the permits were acquired or else the context's error.
+func (s *Weighted) AcquireCtx(ctx context.Context, n int64) error {
+	if n > s.capacity {
+		panic("semaphore: acquiring more permits than the capacity")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// permits available and no one waiting before => acquire them
+	if len(s.waiters) == 0 && s.available >= n {
+		s.available -= n
+		return nil
+	}
+
+	// else, wait in line
+	w := &waiter{n: n, cond: sync.NewCond(&s.mutex)}
+	s.waiters = append(s.waiters, w)
+	stop := lock.WakeOnDone(ctx, w.cond)
+	defer stop()
+	for !w.ready {
+		if err := ctx.Err(); err != nil {
+			s.remove(w)
+			return err
+		}
+		w.cond.Wait()
+	}
+	return nil
+}
+
+// TryAcquire acquires `n` permits if they are available and no one is waiting, without waiting.
+// Returns true if the permits were acquired.
+func (s *Weighted) TryAcquire(n int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.waiters) > 0 || s.available < n {
+		return false
+	}
+	s.available -= n
+	return true
+}
+
+// Release releases `n` permits, giving them to the waiters in line that can be served
+func (s *Weighted) Release(n int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.available += n
+	if s.available > s.capacity {
+		panic("semaphore: releasing more permits than were acquired")
+	}
+	s.serve()
+}
+
+// serve gives permits to the waiters at the front of the line, while there are enough available.
+// Must be called holding the mutex.
+func (s *Weighted) serve() {
+	for len(s.waiters) > 0 && s.waiters[0].n <= s.available {
+		w := s.waiters[0]
+		s.waiters[0] = nil
+		s.waiters = s.waiters[1:]
+		s.available -= w.n
+		w.ready = true
+		w.cond.Signal()
+	}
+}
+
+// remove removes a waiter that gave up from the line. Must be called holding the mutex.
+// Obs: if the waiter was at the front, the waiters behind it may be served now
+func (s *Weighted) remove(w *waiter) {
+	for i, other := range s.waiters {
+		if other == w {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			if i == 0 {
+				s.serve()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package semaphore
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWeightedCapacity(t *testing.T) {
+	// goroutines acquiring different amounts never exceed the capacity together
+	sema := NewWeighted(10)
+	var inUse, maxInUse int64
+	var mutex sync.Mutex
+	var group sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		group.Add(1)
+		go func(n int64) {
+			defer group.Done()
+			for j := 0; j < 100; j++ {
+				sema.Acquire(n)
+				mutex.Lock()
+				inUse += n
+				if inUse > maxInUse {
+					maxInUse = inUse
+				}
+				mutex.Unlock()
+				time.Sleep(time.Microsecond)
+				mutex.Lock()
+				inUse -= n
+				mutex.Unlock()
+				sema.Release(n)
+			}
+		}(int64(i%10 + 1))
+	}
+	group.Wait()
+	if maxInUse > 10 {
+		t.Errorf("Expected at most 10 permits in use. Got:%v", maxInUse)
+	}
+	if !sema.TryAcquire(10) {
+		t.Error("Expected all permits to be available in the end")
+	}
+}
+
+func TestWeightedFIFO(t *testing.T) {
+	// a large waiter blocks the small ones that came after it
+	sema := NewWeighted(10)
+	sema.Acquire(5)
+
+	largeDone := make(chan bool, 1)
+	go func() {
+		sema.Acquire(10)
+		largeDone <- true
+	}()
+	// wait for the large waiter to be in line
+	for sema.TryAcquire(1) {
+		sema.Release(1)
+		time.Sleep(time.Millisecond)
+	}
+
+	// permits are available, but the small waiter must wait for the large one
+	smallDone := make(chan bool, 1)
+	go func() {
+		sema.Acquire(1)
+		smallDone <- true
+	}()
+	select {
+	case <-smallDone:
+		t.Fatal("A small waiter overtook a large waiter")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// releasing serves the large waiter first, then the small one
+	sema.Release(5)
+	<-largeDone
+	select {
+	case <-smallDone:
+		t.Fatal("The small waiter got permits held by the large waiter")
+	case <-time.After(20 * time.Millisecond):
+	}
+	sema.Release(10)
+	<-smallDone
+}
+
+func TestWeightedAcquireCtx(t *testing.T) {
+	sema := NewWeighted(10)
+	sema.Acquire(8)
+
+	// a waiter giving up unblocks the waiters behind it
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	smallDone := make(chan bool, 1)
+	go func() {
+		// wait for the large waiter to be in line
+		for sema.TryAcquire(1) {
+			sema.Release(1)
+			time.Sleep(time.Millisecond)
+		}
+		sema.Acquire(2)
+		smallDone <- true
+	}()
+	if err := sema.AcquireCtx(ctx, 10); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded. Got:%v", err)
+	}
+	select {
+	case <-smallDone:
+	case <-time.After(10 * time.Second):
+		t.Fatal("The small waiter was not served after the large waiter gave up")
+	}
+}
@@ -0,0 +1,43 @@
+// Admission control for the parallel server.
+// The producer reads requests as fast as the client sends them, so a burst of requests can fill the queue
+// with much more work than the consumers can handle. With `Config.MaxInFlightCost`, every request has a cost
+// and the pipeline only admits a request when the cost of the requests in flight (submitted but not executed)
+// plus its own fits in the maximum; otherwise the producer waits, and stops reading from the client.
+// The costs are acquired from a FIFO weighted semaphore (see `semaphore/weighted.go`), so an expensive "FEED"
+// is not starved by a stream of cheap "ADD"s coming after it.
+
+package server
+
+import (
+	"proj2/feed"
+	"proj2/queue"
+)
+
+// requestCost returns the cost of a request: the number of posts a "FEED" or "TIMELINE" request returns
+// (according to the size of the feeds when it is submitted), 1 for the other requests. The cost is at least 1
+// and at most `max`, so that any request can be admitted.
+// Obs: the feeds are only looked up (see Registry.Len), so estimating the cost of a request about an unknown user
+// does not create a feed for it
+func requestCost(users *feed.Registry, request *queue.Request, max int64) int64 {
+	var cost int64
+	switch request.Command {
+	case "FEED":
+		cost = int64(users.Len(request.User))
+		if request.Limit > 0 && int64(request.Limit) < cost {
+			cost = int64(request.Limit)
+		}
+	case "TIMELINE":
+		cost = int64(users.Len(request.User))
+		for _, followee := range users.Following(request.User) {
+			cost += int64(users.Len(followee))
+		}
+	}
+
+	if cost < 1 {
+		cost = 1
+	}
+	if cost > max {
+		cost = max
+	}
+	return cost
+}
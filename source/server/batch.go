@@ -0,0 +1,81 @@
+// Request batching in the consumers.
+// A consumer executing one request at a time takes the write lock of a feed once per "ADD". With
+// `Config.BatchSize` > 1, a consumer takes up to BatchSize tasks at once (waiting only for the first one) and
+// applies each run of consecutive "ADD"s and "REMOVE"s on the same user's feed with a single Feed.ApplyBatch,
+// so the lock-based feeds take their write lock once per run. The other requests are executed one by one.
+// Tasks are executed, and their responses sent, in the order they were dequeued.
+
+package server
+
+import (
+	"context"
+	"proj2/feed"
+	"proj2/queue"
+)
+
+// consumeBatches takes batches of up to `p.batchSize` tasks from `tasks` and executes them. Returns once the
+// pipeline is closed and there are no tasks left.
+func consumeBatches(p *pipeline, tasks queue.Queue) {
+	batch := make([]*queue.Request, 0, p.batchSize)
+	for {
+		// wait for a task, then take the tasks already queued without waiting
+		task := tasks.DequeueWait(context.Background())
+		if task == nil {
+			return
+		}
+		batch = append(batch[:0], task)
+		for len(batch) < p.batchSize {
+			if task = tasks.Dequeue(); task == nil {
+				break
+			}
+			batch = append(batch, task)
+		}
+		executeBatch(p, batch)
+	}
+}
+
+// isMutation returns true if a request can be applied to a feed as part of a Feed.ApplyBatch
+func isMutation(task *queue.Request) bool {
+	return task.Command == "ADD" || task.Command == "REMOVE"
+}
+
+// executeBatch executes the tasks of `batch` in order, applying each run of consecutive "ADD"s and "REMOVE"s
+// of the same user with a single Feed.ApplyBatch
+func executeBatch(p *pipeline, batch []*queue.Request) {
+	for start := 0; start < len(batch); {
+		if !isMutation(batch[start]) {
+			executeTask(p, batch[start])
+			start++
+			continue
+		}
+		// find the end of the run of mutations on the feed of the first one
+		end := start + 1
+		for end < len(batch) && isMutation(batch[end]) && batch[end].User == batch[start].User {
+			end++
+		}
+		applyMutations(p, batch[start:end])
+		start = end
+	}
+}
+
+// applyMutations applies "ADD" and "REMOVE" requests of the same user with a single Feed.ApplyBatch and
+// sends their responses
+func applyMutations(p *pipeline, run []*queue.Request) {
+	ops := make([]feed.Op, len(run))
+	for i, task := range run {
+		if task.Command == "REMOVE" {
+			ops[i] = feed.Op{Kind: feed.RemoveOp, Timestamp: task.TimeStamp}
+		} else {
+			ops[i] = feed.Op{Kind: feed.AddOp, Body: task.Body, Timestamp: task.TimeStamp}
+		}
+	}
+	results := p.users.Feed(run[0].User).ApplyBatch(ops)
+
+	for i, task := range run {
+		info := task.Meta.(*taskInfo)
+		info.client.respond(info.seq, Response{Success: results[i], Id: task.Id})
+		if p.admission != nil {
+			p.admission.Release(info.cost)
+		}
+	}
+}
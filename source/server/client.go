@@ -0,0 +1,78 @@
+// A client of the parallel server: where its requests come from and where their responses go.
+// The server reading from `Config.Decoder` has a single client; in listener mode (see listener.go) every
+// connection is a client and in HTTP mode (see http.go) every HTTP request is a client. All clients feed the same pipeline.
+
+package server
+
+import (
+	"encoding/json"
+	"proj2/feed"
+	"proj2/queue"
+	"sync"
+)
+
+// taskInfo is the bookkeeping attached by the server to each request (in `Request.Meta`)
+type taskInfo struct {
+	client 		*client 		// the client who sent the request
+	seq 		uint64 			// position of the request among the requests of its client
+	order 		*orderInfo 		// ordered execution only: the requests this one depends on
+	cost 		int64 			// admission control only: the cost of the request (see admission.go)
+}
+
+// client holds the decoder of a client's requests and where their responses go
+type client struct {
+	dec 		*json.Decoder 		// the buffer to decode requests
+	out 		responder 			// receives the responses of the client's requests
+	w 			*responseWriter 	// `out`, if it is a response writer; needed for ordered responses
+	ordered 	bool 				// responses are written in the order the requests were sent
+	seq 		uint64 				// sequence number of the next request; only accessed by the client's producer
+	tasks 		sync.WaitGroup 		// tracks the requests of the client not executed yet
+}
+
+// newClient creates a client and starts its response writer
+func newClient(enc *json.Encoder, dec *json.Decoder, orderedResponses bool) *client {
+	w := newResponseWriter(enc)
+	return &client{dec: dec, out: w, w: w, ordered: orderedResponses}
+}
+
+// track returns the bookkeeping of the next request of the client
+func (c *client) track() *taskInfo {
+	info := &taskInfo{client: c, seq: c.seq}
+	c.seq++
+	c.tasks.Add(1)
+	return info
+}
+
+// execute executes the request with sequence number `seq` and sends its response to the client
+func (c *client) execute(users *feed.Registry, task *queue.Request, seq uint64) {
+	defer c.tasks.Done()
+	if !c.ordered {
+		execute(users, c.out, task)
+		return
+	}
+	out := &sequencedResponder{w: c.w, seq: seq}
+	execute(users, out, task)
+	// unknown commands get no response, but the responses after them must not wait for one
+	if !out.sent {
+		c.w.respondAt(seq, nil)
+	}
+}
+
+// respond sends `response` as the response of the request with sequence number `seq`, executed without
+// going through `execute` (see batch.go)
+func (c *client) respond(seq uint64, response interface{}) {
+	defer c.tasks.Done()
+	if !c.ordered {
+		c.out.respond(response)
+		return
+	}
+	c.w.respondAt(seq, response)
+}
+
+// Close waits until all requests of the client were executed and their responses written
+func (c *client) Close() {
+	c.tasks.Wait()
+	if c.w != nil {
+		c.w.Close()
+	}
+}
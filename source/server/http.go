@@ -0,0 +1,212 @@
+// HTTP mode: a REST front-end translating HTTP requests into the commands of the server
+// - POST /posts with a json body {"body": <text>, "timestamp": <number>}: "ADD"
+// - DELETE /posts/{timestamp}: "REMOVE"
+// - GET /posts/{timestamp}: "CONTAINS"
+// - GET /feed, optionally with the query parameters `since`, `until`, `limit` and `cursor`: "FEED" (see page.go)
+// Every route takes the user as the optional query parameter `user`.
+// Each HTTP request is a client of the pipeline with a single request: the handler submits it to the pipeline,
+// waits until a consumer executes it and maps the response onto the status code of the HTTP response.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"proj2/queue"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ServeHTTP serves the REST API on `l` until `ctx` is cancelled or `l` fails. As in listener mode,
+// `config.Encoder` and `config.Decoder` are not used and sequential mode means a single consumer.
+// On shutdown, the server stops accepting requests and only returns after the requests in progress
+// were answered. Returns the context's error if it was cancelled or else the error serving HTTP.
+func ServeHTTP(ctx context.Context, l net.Listener, config Config) error {
+	p, err := newSharedPipeline(config)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: &httpHandler{p: p}}
+
+	// on shutdown, stop accepting requests and wait for the ones in progress
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var shutdown sync.WaitGroup
+	shutdown.Add(1)
+	go func() {
+		defer shutdown.Done()
+		<-serveCtx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	err = srv.Serve(l)
+	cancel()
+	shutdown.Wait()
+	p.Close()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("serving http: %w", err)
+}
+
+// httpHandler translates HTTP requests into requests to the pipeline
+type httpHandler struct {
+	p 		*pipeline
+	ids 	atomic.Int64 		// the id of the last request
+}
+
+// reply receives the response of a single request
+type reply struct {
+	response 	interface{}
+}
+
+func (r *reply) respond(response interface{}) {
+	r.response = response
+}
+
+// httpError is an invalid HTTP request, answered with `status` and `msg`
+type httpError struct {
+	status 	int
+	msg 	string
+	allow 	string 		// 405 Method Not Allowed only: the methods allowed
+}
+
+func (h *httpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request, err := parseHTTPRequest(r)
+	if err != nil {
+		if err.allow != "" {
+			w.Header().Set("Allow", err.allow)
+		}
+		http.Error(w, err.msg, err.status)
+		return
+	}
+	request.Id = int(h.ids.Add(1))
+
+	// submit the request as a client of its own and wait for the response
+	// Obs: the client's wait group orders the consumer's write of the response before the read below
+	out := &reply{}
+	c := &client{out: out}
+	h.p.submit(c, request)
+	c.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(request.Command, out.response))
+	json.NewEncoder(w).Encode(out.response)
+}
+
+// parseHTTPRequest translates an HTTP request into a request to the server
+func parseHTTPRequest(r *http.Request) (*queue.Request, *httpError) {
+	query := r.URL.Query()
+	request := &queue.Request{User: query.Get("user")}
+
+	switch {
+	case r.URL.Path == "/posts":
+		if r.Method != http.MethodPost {
+			return nil, methodNotAllowed(r, http.MethodPost)
+		}
+		var post struct {
+			Body 		string 		`json:"body"`
+			Timestamp 	*float64 	`json:"timestamp"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+			return nil, &httpError{status: http.StatusBadRequest, msg: fmt.Sprintf("invalid post: %v", err)}
+		}
+		if post.Timestamp == nil {
+			return nil, &httpError{status: http.StatusBadRequest, msg: "invalid post: missing timestamp"}
+		}
+		request.Command, request.Body, request.TimeStamp = "ADD", post.Body, *post.Timestamp
+
+	case strings.HasPrefix(r.URL.Path, "/posts/"):
+		timestamp, err := parseTimestamp(strings.TrimPrefix(r.URL.Path, "/posts/"))
+		if err != nil {
+			return nil, &httpError{status: http.StatusBadRequest, msg: fmt.Sprintf("invalid timestamp: %v", err)}
+		}
+		switch r.Method {
+		case http.MethodGet:
+			request.Command = "CONTAINS"
+		case http.MethodDelete:
+			request.Command = "REMOVE"
+		default:
+			return nil, methodNotAllowed(r, http.MethodGet, http.MethodDelete)
+		}
+		request.TimeStamp = timestamp
+
+	case r.URL.Path == "/feed":
+		if r.Method != http.MethodGet {
+			return nil, methodNotAllowed(r, http.MethodGet)
+		}
+		request.Command = "FEED"
+		for _, bound := range []struct {
+			name 	string
+			value 	**float64
+		}{{"since", &request.Since}, {"until", &request.Until}} {
+			if query.Has(bound.name) {
+				timestamp, err := parseTimestamp(query.Get(bound.name))
+				if err != nil {
+					return nil, &httpError{status: http.StatusBadRequest, msg: fmt.Sprintf("invalid %s: %v", bound.name, err)}
+				}
+				*bound.value = &timestamp
+			}
+		}
+		if query.Has("limit") {
+			limit, err := strconv.Atoi(query.Get("limit"))
+			if err != nil || limit < 0 {
+				return nil, &httpError{status: http.StatusBadRequest, msg: "invalid limit: expected a non-negative integer"}
+			}
+			request.Limit = limit
+		}
+		request.Cursor = query.Get("cursor")
+
+	default:
+		return nil, &httpError{status: http.StatusNotFound, msg: "not found"}
+	}
+	return request, nil
+}
+
+// parseTimestamp parses a timestamp given in a path or query parameter
+func parseTimestamp(s string) (float64, error) {
+	timestamp, err := strconv.ParseFloat(s, 64)
+	if err == nil && math.IsNaN(timestamp) {
+		err = errors.New("NaN is not a timestamp")
+	}
+	return timestamp, err
+}
+
+// methodNotAllowed returns the error for a request whose method is not one of `allowed`
+func methodNotAllowed(r *http.Request, allowed ...string) *httpError {
+	msg := fmt.Sprintf("method %s not allowed", r.Method)
+	return &httpError{status: http.StatusMethodNotAllowed, msg: msg, allow: strings.Join(allowed, ", ")}
+}
+
+// httpStatus returns the status code of the HTTP response for the response of a request with `command`
+// - "ADD": 201 Created
+// - "REMOVE" and "CONTAINS": 200 OK if the post was found, else 404 Not Found
+// - "FEED": 200 OK, 400 Bad Request if the cursor is not valid, or 503 Service Unavailable if the request timed out
+//   waiting for the lock of the feed (see Config.FeedTimeout)
+func httpStatus(command string, response interface{}) int {
+	switch response := response.(type) {
+	case FeedResponse:
+		return http.StatusOK
+	case Response:
+		switch {
+		case command == "ADD":
+			return http.StatusCreated
+		case response.Success:
+			return http.StatusOK
+		case response.Error == "timeout":
+			return http.StatusServiceUnavailable
+		case command == "FEED":
+			return http.StatusBadRequest
+		default:
+			return http.StatusNotFound
+		}
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,143 @@
+// Listener mode: instead of a single client talking through `Config.Decoder` and `Config.Encoder`,
+// the server accepts clients over a TCP or unix socket. Every connection gets its own decoder, encoder
+// and response writer, and its producer submits the requests to the pipeline shared by all connections,
+// so the responses of a request are always sent back through the connection it came from.
+// A "DONE" request closes the connection of the client who sent it; the server keeps running until it is cancelled.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Listen creates a listener for an address of the form "tcp://host:port" or "unix:///path/to/socket"
+func Listen(address string) (net.Listener, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok || (network != "tcp" && network != "unix") {
+		return nil, fmt.Errorf("invalid address %q: expected tcp://host:port or unix:///path", address)
+	}
+	return net.Listen(network, addr)
+}
+
+// Serve accepts clients on `l` and executes their requests until `ctx` is cancelled or `l` fails.
+// `config.Encoder` and `config.Decoder` are not used; in sequential mode, the requests of all clients are
+// executed by a single consumer. On shutdown, the server stops reading requests, and only returns after
+// every request already read was executed and its response sent. Returns the context's error if it was
+// cancelled or else the error accepting connections.
+func Serve(ctx context.Context, l net.Listener, config Config) error {
+	// create the pipeline shared by all clients
+	p, err := newSharedPipeline(config)
+	if err != nil {
+		return err
+	}
+
+	// on shutdown, stop accepting connections and reading requests
+	// Obs: closing the listener is the only way to interrupt a blocked Accept
+	conns := &connSet{conns: make(map[net.Conn]bool)}
+	serveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-serveCtx.Done()
+		l.Close()
+		conns.closeRead()
+	}()
+
+	// serve each connection in its own goroutine
+	var conn net.Conn
+	for {
+		conn, err = l.Accept()
+		if err != nil {
+			break
+		}
+		if !conns.add(conn) {
+			conn.Close()
+			break
+		}
+		go serveConn(serveCtx, conn, p, config.OrderedResponses, conns)
+	}
+
+	// shutdown: wait for the connections to be answered, then for the consumers to exit
+	cancel()
+	conns.wg.Wait()
+	p.Close()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("accepting connection: %w", err)
+}
+
+// newSharedPipeline creates the registry holding one feed per user and a pipeline to be shared by several
+// clients, configured by `config`. In sequential mode, the pipeline has a single consumer.
+func newSharedPipeline(config Config) (*pipeline, error) {
+	users, err := newRegistry(config)
+	if err != nil {
+		return nil, fmt.Errorf("configuring server: %w", err)
+	}
+	if config.Mode == "s" || config.ConsumersCount < 1 {
+		config.ConsumersCount = 1
+	}
+	p, err := newPipeline(users, config)
+	if err != nil {
+		return nil, fmt.Errorf("configuring server: %w", err)
+	}
+	return p, nil
+}
+
+// serveConn submits the requests of a connection to the pipeline until the client sends "DONE", closes the
+// connection or the server shuts down. Closes the connection once all its requests were answered.
+func serveConn(ctx context.Context, conn net.Conn, p *pipeline, orderedResponses bool, conns *connSet) {
+	defer conns.remove(conn)
+	c := newClient(json.NewEncoder(conn), json.NewDecoder(conn), orderedResponses)
+	producer(ctx, c, p)
+	c.Close()
+	conn.Close()
+}
+
+// connSet keeps track of the open connections of the server
+type connSet struct {
+	mux 		sync.Mutex 				// protects `conns` and `closed`
+	conns 		map[net.Conn]bool 		// the open connections
+	closed 		bool 					// the server is shutting down; no connections may be added
+	wg 			sync.WaitGroup 			// tracks the goroutines serving the connections
+}
+
+// add adds a connection to the set. Returns false if the server is shutting down.
+func (s *connSet) add(conn net.Conn) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	s.wg.Add(1)
+	return true
+}
+
+// remove removes a connection whose goroutine is done
+func (s *connSet) remove(conn net.Conn) {
+	s.mux.Lock()
+	delete(s.conns, conn)
+	s.mux.Unlock()
+	s.wg.Done()
+}
+
+// closeRead stops reading requests from all connections, so that their producers return
+// Obs: only the reading side of TCP and unix connections is closed, so the responses of the requests
+// already read can still be sent
+func (s *connSet) closeRead() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		if c, ok := conn.(interface{ CloseRead() error }); ok {
+			c.CloseRead()
+		} else {
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Order-preserving execution for the parallel server.
+// With several consumers, requests are executed and answered in whatever order the consumers finish them,
+// so an "ADD" followed by a "CONTAINS" of the same post may be executed in reverse order.
+// When ordering is enabled, the producer tracks every request before enqueueing it:
+// - each request gets a sequence number among the requests of its client, used by the client's response writer
+// to write responses in submission order (see client.go)
+// - each request gets the list of earlier requests it conflicts with, which must be executed before it
+// Two requests conflict if they refer to the same post (same `user` and `timestamp`) or if one of them refers
+// to the user as a whole ("FEED", "TIMELINE", "FOLLOW", "UNFOLLOW") and the other to the same user.
+// Requests that do not conflict still run in parallel.
+// Obs: dependencies always point to earlier requests and the queue is FIFO, so the oldest unfinished request
+// never waits and a consumer waiting for its dependencies cannot block the server forever.
+// Obs2: "TIMELINE" is ordered only with respect to the requests of its own user, not of the users it follows.
+
+package server
+
+import (
+	"proj2/queue"
+	"sync"
+	"sync/atomic"
+)
+
+// postKey identifies a post of a user
+type postKey struct {
+	user 		string
+	timestamp 	float64
+}
+
+// ticket tracks whether a request was executed
+type ticket struct {
+	done 	atomic.Bool 	// true once the request was executed
+	key 	postKey 		// the post the request refers to, if any
+}
+
+// orderInfo holds the dependencies of a request when conflicting requests are executed in order
+type orderInfo struct {
+	ticket 		*ticket 		// signals the requests depending on this one
+	deps 		[]*ticket 		// earlier requests that must be executed before this one
+}
+
+// orderTracker computes the dependencies between requests and lets consumers wait for them.
+// Obs: `lastPost`, `lastUser` and `sinceUser` are only accessed while enqueueing (see pipeline.submit), so they
+// are not protected.
+type orderTracker struct {
+	lastPost 	map[postKey]*ticket 		// last request referring to each post
+	lastUser 	map[string]*ticket 			// last request referring to each user as a whole
+	sinceUser 	map[string][]*ticket 		// requests referring to posts of each user since its last user request
+	mux 		sync.Mutex 					// used with `cond` by consumers waiting for their dependencies
+	cond 		*sync.Cond 					// signals waiting consumers that a request was executed
+	waiting 	atomic.Int32 				// number of consumers waiting on `cond`
+}
+
+// newOrderTracker creates an empty orderTracker
+func newOrderTracker() *orderTracker {
+	o := &orderTracker{
+		lastPost: make(map[postKey]*ticket),
+		lastUser: make(map[string]*ticket),
+		sinceUser: make(map[string][]*ticket),
+	}
+	o.cond = sync.NewCond(&o.mux)
+	return o
+}
+
+// track returns the dependencies of `task`. Must be called in submission order, right before enqueueing the task.
+func (o *orderTracker) track(task *queue.Request) *orderInfo {
+	info := &orderInfo{ticket: &ticket{}}
+
+	switch task.Command {
+	// requests on a single post depend on the last request on the same post and on the last request on the user
+	case "ADD", "REMOVE", "CONTAINS":
+		key := postKey{user: task.User, timestamp: task.TimeStamp}
+		info.ticket.key = key
+		info.deps = appendPending(info.deps, o.lastPost[key], o.lastUser[task.User])
+		o.lastPost[key] = info.ticket
+		o.sinceUser[task.User] = o.compact(append(o.sinceUser[task.User], info.ticket))
+
+	// requests on the user as a whole depend on every request on the user since its last request of this kind
+	// Obs: later requests on a post then only need to depend on this one, so the posts of the user are forgotten
+	case "FEED", "TIMELINE", "FOLLOW", "UNFOLLOW":
+		info.deps = appendPending(info.deps, o.lastUser[task.User])
+		for _, t := range o.sinceUser[task.User] {
+			info.deps = appendPending(info.deps, t)
+			if o.lastPost[t.key] == t {
+				delete(o.lastPost, t.key)
+			}
+		}
+		delete(o.sinceUser, task.User)
+		o.lastUser[task.User] = info.ticket
+	}
+	return info
+}
+
+// compact drops the tickets of executed requests from a full list of tickets, so that the lists of users
+// who never send a request on the user as a whole do not grow indefinitely
+func (o *orderTracker) compact(tickets []*ticket) []*ticket {
+	if len(tickets) < cap(tickets) || len(tickets) < 64 {
+		return tickets
+	}
+	pending := tickets[:0]
+	for _, t := range tickets {
+		if !t.done.Load() {
+			pending = append(pending, t)
+		} else if o.lastPost[t.key] == t {
+			delete(o.lastPost, t.key)
+		}
+	}
+	for i := len(pending); i < len(tickets); i++ {
+		tickets[i] = nil
+	}
+	return pending
+}
+
+// appendPending appends to `deps` the tickets of requests that were not executed yet
+func appendPending(deps []*ticket, tickets ...*ticket) []*ticket {
+	for _, t := range tickets {
+		if t != nil && !t.done.Load() {
+			deps = append(deps, t)
+		}
+	}
+	return deps
+}
+
+// wait blocks until all requests `info` depends on were executed
+func (o *orderTracker) wait(info *orderInfo) {
+	for _, dep := range info.deps {
+		if dep.done.Load() {
+			continue
+		}
+		o.mux.Lock()
+		o.waiting.Add(1)
+		for !dep.done.Load() {
+			o.cond.Wait()
+		}
+		o.waiting.Add(-1)
+		o.mux.Unlock()
+	}
+}
+
+// done marks the request of `info` as executed and wakes up the consumers waiting for it
+// Obs: a consumer increments `waiting` before checking its dependency and this function sets `done` before
+// reading `waiting`, so either the consumer sees the request executed or it gets the broadcast.
+func (o *orderTracker) done(info *orderInfo) {
+	info.ticket.done.Store(true)
+	if o.waiting.Load() > 0 {
+		o.mux.Lock()
+		o.cond.Broadcast()
+		o.mux.Unlock()
+	}
+}
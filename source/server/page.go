@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"math"
+	"proj2/feed"
+	"proj2/queue"
+	"strconv"
+	"strings"
+)
+
+// errInvalidCursor is returned by readPage for a cursor that was not returned by the server
+var errInvalidCursor = errors.New("invalid cursor")
+
+// readPage executes a paged "FEED" request: it returns the posts of `f` newer than `task.Since`,
+// older than `task.Until` and after the post the cursor points to, at most `task.Limit` of them.
+// If more posts remain in the range, the response carries the cursor to request the next page.
+// Returns errInvalidCursor if the cursor is not valid, or the context's error if `ctx` is done before
+// the lock of the feed is acquired (see feed.ReturnRangeCtx).
+// Obs: posts may share a timestamp, so the cursor also counts the posts with the last timestamp already
+// returned; the next page starts with the posts with that timestamp and skips that many of them.
+func readPage(ctx context.Context, f feed.Feed, task *queue.Request) (FeedResponse, error) {
+	// missing bounds leave the range open
+	newerThan, olderThan := math.Inf(-1), math.Inf(1)
+	if task.Since != nil {
+		newerThan = *task.Since
+	}
+	if task.Until != nil {
+		olderThan = *task.Until
+	}
+	var last float64
+	var skip int
+	if task.Cursor != "" {
+		var ok bool
+		if last, skip, ok = decodeCursor(task.Cursor); !ok {
+			return FeedResponse{Id: task.Id}, errInvalidCursor
+		}
+		if last < olderThan {
+			// include the posts with the last timestamp, to skip the ones already returned
+			olderThan = math.Nextafter(last, math.Inf(1))
+		} else {
+			skip = 0
+		}
+	}
+
+	// no limit => a single page with the whole range
+	// otherwise, ask for one extra post to know whether there is a next page
+	limit := 0
+	if task.Limit > 0 {
+		limit = task.Limit + 1 + skip
+	}
+	posts, err := feed.ReturnRangeCtx(ctx, f, newerThan, olderThan, limit)
+	if err != nil {
+		return FeedResponse{Id: task.Id}, err
+	}
+	skipped := 0
+	for skipped < skip && skipped < len(posts) && *posts[skipped].Timestamp == last {
+		skipped++
+	}
+	posts = posts[skipped:]
+	if task.Limit <= 0 || len(posts) <= task.Limit {
+		return FeedResponse{Id: task.Id, Feed: posts}, nil
+	}
+	posts = posts[:task.Limit]
+
+	// count the posts of the page with its last timestamp, plus the ones of the previous pages if the whole
+	// page has that timestamp
+	next := *posts[len(posts)-1].Timestamp
+	count := 0
+	for count < len(posts) && *posts[len(posts)-1-count].Timestamp == next {
+		count++
+	}
+	if count == len(posts) && task.Cursor != "" && next == last {
+		count += skipped
+	}
+	return FeedResponse{Id: task.Id, Feed: posts, Cursor: encodeCursor(next, count)}, nil
+}
+
+// encodeCursor returns an opaque cursor pointing right after the `count`-th post with `timestamp`
+func encodeCursor(timestamp float64, count int) string {
+	raw := strconv.FormatFloat(timestamp, 'g', -1, 64) + "/" + strconv.Itoa(count)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeCursor returns the timestamp a cursor points to and how many posts with it were already returned.
+// Returns false if the cursor is malformed.
+func decodeCursor(cursor string) (float64, int, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, 0, false
+	}
+	rawTimestamp, rawCount, found := strings.Cut(string(raw), "/")
+	if !found {
+		return 0, 0, false
+	}
+	timestamp, err := strconv.ParseFloat(rawTimestamp, 64)
+	if err != nil || math.IsNaN(timestamp) {
+		return 0, 0, false
+	}
+	count, err := strconv.Atoi(rawCount)
+	if err != nil || count < 0 {
+		return 0, 0, false
+	}
+	return timestamp, count, true
+}
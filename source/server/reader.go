@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"proj2/queue"
+)
+
+// requestReader is the first stage of the server: a reader goroutine decodes the requests of a client, so that
+// waiting for the next request can be cancelled.
+// Obs: json.Decoder.Decode cannot be interrupted; after a cancellation, the reader goroutine stays blocked in it
+// until the client sends something or the underlying reader is closed (see closeRead in listener.go), then exits.
+type requestReader struct {
+	requests 	chan decoded 		// the requests decoded by the reader goroutine, handed over one at a time
+	stop 		chan struct{} 		// closed when no more requests will be taken
+}
+
+// decoded is a request read by the reader goroutine, or the error decoding it
+type decoded struct {
+	request 	*queue.Request
+	err 		error
+}
+
+// newRequestReader creates a requestReader over `dec` and starts its reader goroutine
+func newRequestReader(dec *json.Decoder) *requestReader {
+	r := &requestReader{requests: make(chan decoded), stop: make(chan struct{})}
+	go r.run(dec)
+	return r
+}
+
+// run decodes requests until the client sends "DONE", the requests cannot be decoded or the reader is closed
+func (r *requestReader) run(dec *json.Decoder) {
+	for {
+		// Obs: a new request each time, otherwise fields missing from the json (e.g. `user`)
+		// would keep the values of the previous request
+		request := &queue.Request{}
+		err := dec.Decode(request)
+		select {
+		case r.requests <- decoded{request, err}:
+		case <-r.stop:
+			return
+		}
+		// nothing is read past "DONE" or an error
+		if err != nil || request.Command == "DONE" {
+			return
+		}
+	}
+}
+
+// next waits for the next request of the client. Returns the decoding error if the requests cannot be decoded,
+// or the context's error if `ctx` is cancelled first; a request decoded after the cancellation is dropped.
+// Obs: must not be called after it returned an error or a "DONE" request
+func (r *requestReader) next(ctx context.Context) (*queue.Request, error) {
+	select {
+	case d := <-r.requests:
+		if d.err != nil {
+			return nil, fmt.Errorf("decoding request: %w", d.err)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return d.request, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the reader goroutine once its current read returns. No request may be taken after Close.
+func (r *requestReader) Close() {
+	close(r.stop)
+}
@@ -1,25 +1,38 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
+	"time"
 	"proj2/feed"
-	"proj2/queue"
 	"proj2/lock"
+	"proj2/queue"
+	"proj2/semaphore"
 )
 
-// Represents a response to a client request for "ADD", "REMOVE", "CONTAINS", "FEED"
+// Represents a response to a client request for "ADD", "REMOVE", "CONTAINS", "FOLLOW", "UNFOLLOW"
 type Response struct {
-	Success bool `json:"success"`
-	Id      int  `json:"id"`
+	Success bool 	`json:"success"`
+	Id      int  	`json:"id"`
+	Error 	string 	`json:"error,omitempty"` 	// why the request failed, if it was not refused: "timeout" ("FEED" only)
+}
+
+// Represents a response to a client request for "STATS"
+type StatsResponse struct {
+	Id 		int 				`json:"id"`
+	Locks 	lock.StatsSnapshot 	`json:"locks"` 	// statistics of the locks of all feeds; see lock/stats.go
+	Queue 	*queue.Stats 		`json:"queue,omitempty"` 	// parallel mode: counters of the queue of tasks; see queue/stats.go
 }
 
-// Represents a response to a client request for "FEED"
+// Represents a response to a client request for "FEED" and "TIMELINE"
 type FeedResponse struct {
 	Id      int 		`json:"id"`
 	Feed 	[]feed.Post `json:"feed"` 
 			// feed.Post contains the `body` and `timestamp` of a post; see feed/feed.go	
+	Cursor 	string 		`json:"cursor,omitempty"`	// paged "FEED" only: cursor of the next page, if any
 }
 
 type Config struct {
@@ -31,139 +44,374 @@ type Config struct {
 	// If Mode == "p"  then run the parallel version
 	// These are the only values for Version
 	ConsumersCount int // Represents the number of consumers to spawn
+	FeedStrategy string // Represents the implementation used for the feed of each user
+	// If FeedStrategy == "coarse" (or "") then use the coarse-grained linked list (feed.NewFeed)
+	// If FeedStrategy == "optimistic" then use the optimistic linked list (feed.NewOptFeed)
+	// If FeedStrategy == "upgradable" then use the linked list with an upgradable read lock (feed.NewUpgradableFeed)
+	// Obs: "upgradable" needs a LockStrategy built by lock.NewRWLock ("cond", "reader" or "fair")
+	// If FeedStrategy == "skiplist" then use the lazy skip list (feed.NewSkipListFeed)
+	// If FeedStrategy == "fine" then use the hand-over-hand linked list (feed.NewFineFeed)
+	// If FeedStrategy == "lazy" then use the lazy linked list (feed.NewLazyFeed)
+	// If FeedStrategy == "lockfree" then use the lock-free linked list (feed.NewLockFreeFeed)
+	LockStrategy string // Represents the r/w lock used by the "coarse", "optimistic" and "upgradable" feeds
+	// If LockStrategy == "cond" (or "") then use lock.NewRWLock (writer-preferred)
+	// If LockStrategy == "reader" then use lock.NewRWLock with the lock.ReaderPreferred policy
+	// If LockStrategy == "fair" then use lock.NewRWLock with the lock.FairPolicy policy (first come, first served)
+	// If LockStrategy == "faster" then use lock.NewRWLockFaster
+	// If LockStrategy == "atomic" then use lock.NewRWLockAtomic (writer-preferred, state in a single atomic word)
+	// If LockStrategy == "sync" then use Go's sync.RWMutex
+	MaxReaders int // Represents the maximum number of readers holding the lock of a feed at once
+	// Only used with the LockStrategy "cond", "reader", "fair" and "atomic"
+	// If == 0, use lock.DefaultMaxReaders; if < 0, there is no limit
+	LockStats bool // Represents whether the r/w locks of the feeds record contention statistics
+	// If true, the locks of the "coarse" and "optimistic" feeds are wrapped with lock.NewInstrumentedRWLock and
+	// the "STATS" command returns their statistics; cannot be combined with the "upgradable" feed
+	// If false, "STATS" fails
+	DebugLocks bool // Represents whether the r/w locks of the feeds check how they are used; for debugging only
+	// If true, the locks of the "coarse" and "optimistic" feeds are wrapped with lock.NewDebugRWLock: releasing
+	// a lock not held by the releasing goroutine panics, and the wait-for graph of the locks (who holds and who
+	// waits for each lock, and the deadlocks) is written to os.Stderr when a lock is held longer than
+	// LockHoldThreshold. Cannot be combined with the "upgradable" feed
+	LockHoldThreshold time.Duration // Only used with DebugLocks; if == 0, use lock.DefaultHoldThreshold
+	FeedTimeout time.Duration // Represents how long a "FEED" request waits for the lock of the feed
+	// If > 0, a "FEED" request without a `timeout` of its own fails with {"success": false, "error": "timeout"}
+	// if it cannot get the lock within FeedTimeout (e.g., while a long writer holds it), instead of blocking
+	// its consumer. Rounded up to the millisecond
+	// Obs: only the locks of the LockStrategy "cond", "reader", "fair" and "faster" give up waiting (also with
+	// LockStats or DebugLocks): with the "coarse", "optimistic" and "upgradable" feeds, the other locks are
+	// rejected. The other feeds have no feed-wide lock to wait for
+	// Only used in parallel mode
+	OrderedExecution bool // Represents whether conflicting requests are executed in the order they were sent
+	// If true, requests on the same post (same `user` and `timestamp`), or on the same user as a whole
+	// ("FEED", "TIMELINE", "FOLLOW", "UNFOLLOW"), are executed in submission order; see order.go
+	// Only used in parallel mode: the sequential version always executes requests in submission order
+	OrderedResponses bool // Represents whether responses are written in the order the requests were sent
+	// Only used in parallel mode
+	MaxInFlightCost int // Represents the admission control of the server
+	// If > 0, the total cost of the requests read but not executed yet is at most MaxInFlightCost: the producer
+	// waits before enqueueing a request that would exceed it. "FEED" and "TIMELINE" requests cost the number
+	// of posts they return, the others cost 1; see admission.go
+	// Only used in parallel mode
+	QueueCapacity int // Represents the maximum number of requests waiting in the queue
+	// If > 0, use the bounded queue (queue.NewBoundedQueue): the producer waits while the queue is full,
+	// so it reads requests at the speed of the consumers
+	// If == 0, use the unbounded queue selected by QueueStrategy
+	// Only used in parallel mode
+	QueueStrategy string // Represents the implementation of the unbounded queue of tasks
+	// If QueueStrategy == "lockfree" (or "") then use the lock-free queue (queue.NewLockFreeQueue)
+	// If QueueStrategy == "pooled" then use the lock-free queue recycling its nodes (queue.NewPooledQueue)
+	// If QueueStrategy == "priority" then use the multi-class queue (queue.NewPriorityQueue): "CONTAINS"
+	// requests are not stuck behind a burst of "ADD"s. Cannot be combined with OrderedExecution
+	// Only used in parallel mode
+	QueueWeights queue.Weights // Represents the share of the dequeues of each class of request
+	// Only used with QueueStrategy == "priority"; weights < 1 take the value of queue.DefaultWeights
+	WorkStealing bool // Represents how the tasks are distributed among the consumers
+	// If true, each consumer has its own deque (queue.NewStealingQueue): the producer deals the requests
+	// round robin and a consumer with an empty deque steals from the others. QueueCapacity and QueueStrategy
+	// are ignored. Cannot be combined with OrderedExecution
+	// If false, all consumers take tasks from a single queue
+	// Only used in parallel mode
+	BatchSize int // Represents the maximum number of tasks a consumer takes at once
+	// If > 1, consecutive "ADD"s and "REMOVE"s of the same user among the tasks taken at once are applied
+	// with a single Feed.ApplyBatch; see batch.go. Cannot be combined with OrderedExecution
+	// If <= 1, consumers take and execute one task at a time
+	// Only used in parallel mode
 }
 
-
 // SyncContext is a struct that contains synchronization constructs for the consumer-producer model
+// Obs: consumers wait for tasks on the queue itself (queue.DequeueWait), which is closed on shutdown
 type SyncContext struct {
-	// mux 			sync.Mutex			// A mutual exclusion lock
-	mux 			lock.DummyLocker	// A Locker whose Lock() and Unlock() methods do nothing
-	cond 			*sync.Cond			// cond is used for producer to signal consumer of tasks and consumer to wait for tasks
-	wg 				sync.WaitGroup		// wg keeps track of the number of tasks remaining to be executed
+	consumers 		sync.WaitGroup		// consumers keeps track of the consumers still running
 }
-// Obs: dummylock is used because we only need the signaling and enqueing aspects of the condition variable.
-// One can also use the traditional mutex, but would have the overhead of Lock() and Unlock() unnecessarily.
 
 
 // NewContext creates and initializes a SyncContext
 func NewContext() *SyncContext {
-	ctx := &SyncContext{}
-	ctx.cond = sync.NewCond(&ctx.mux)
-	return ctx
+	return &SyncContext{}
 }
 
 //Run starts up the twitter server based on the configuration information
 // provided and only returns when the server is fully shutdown.
 func Run(config Config) {
-	// create a new feed
-	f := feed.NewFeed() 		// naive coarse-grained locking
-	// f := feed.NewOptFeed()	// optimistic locking
+	if err := RunContext(context.Background(), config); err != nil {
+		fmt.Printf("\nError %s\n", err.Error())
+	}
+}
+
+// RunContext starts up the twitter server like Run, but stops reading requests once `ctx` is cancelled.
+// In any case, the server only returns after every request already read was executed, its response
+// written and all consumers exited. Returns nil if the client sent "DONE", the decoding error
+// if the requests could not be read, or the context's error if it was cancelled.
+// Obs: a cancellation is also noticed while waiting for a request; the read itself is left to a reader
+// goroutine, which exits once the decoder's underlying reader is closed (see reader.go).
+func RunContext(ctx context.Context, config Config) error {
+	// create the registry holding one feed per user
+	f, err := newRegistry(config)
+	if err != nil {
+		return fmt.Errorf("configuring server: %w", err)
+	}
 	
 	// run the server in sequential mode
 	if config.Mode == "s" {
-		RunSequential(f, config.Encoder, config.Decoder)
-	
+		return RunSequential(ctx, f, config.Encoder, config.Decoder)
+	}
+
 	// run the server in parallel mode
-	} else {
-		// create a new lock-free queue and sync context
-		q := queue.NewLockFreeQueue()
-		ctx := NewContext()	
-		// spawn the consumers as separate goroutines
-		for i:=0; i < config.ConsumersCount; i++{
-			go consumer(f, config.Encoder, q, ctx)
+	// create the pipeline (queue, sync context and consumers) and the only client, reading from the config's decoder
+	p, err := newPipeline(f, config)
+	if err != nil {
+		return fmt.Errorf("configuring server: %w", err)
+	}
+	c := newClient(config.Encoder, config.Decoder, config.OrderedResponses)
+	// start the producer
+	err = producer(ctx, c, p)
+
+	// shutdown: no more tasks; wait for consumers to finish the remaining tasks and exit, then flush the responses
+	p.Close()
+	c.Close()
+	return err
+}
+
+// pipeline holds the parts of the parallel server shared by all clients: the feeds, the queue of tasks
+// and the consumers executing them
+type pipeline struct {
+	users 		*feed.Registry 		// the feeds of the users
+	q 			queue.Queue 		// the tasks to be executed
+	syncCtx 	*SyncContext 		// synchronization between producers and consumers
+	order 		*orderTracker 		// dependencies between tasks; nil if tasks can be executed in any order
+	mux 		sync.Mutex 			// ordered execution only: makes tracking and enqueueing a task atomic
+	admission 	*semaphore.Weighted // caps the cost of the tasks in flight; nil if there is no admission control
+	batchSize 	int 				// maximum number of tasks a consumer takes at once; see batch.go
+	feedTimeout int 				// default `timeout` of the "FEED" requests, in ms; 0 = no limit
+}
+// Obs: with several producers (see listener.go), two tasks could be tracked in one order and enqueued in the
+// other, breaking the assumption of order.go that dependencies are always dequeued first.
+
+// newPipeline creates a pipeline over the feeds in `users` configured by `config` and spawns its consumers
+// as separate goroutines
+func newPipeline(users *feed.Registry, config Config) (*pipeline, error) {
+	q, err := newQueue(config)
+	if err != nil {
+		return nil, err
+	}
+	// a batch is executed without waiting for the dependencies of its tasks, which may be in the same batch
+	if config.BatchSize > 1 && config.OrderedExecution {
+		return nil, fmt.Errorf("batching cannot be used with ordered execution")
+	}
+	p := &pipeline{users: users, q: q, syncCtx: NewContext(), batchSize: config.BatchSize}
+	if config.FeedTimeout > 0 {
+		// like the other invalid combinations, a timeout the locks cannot honor is rejected
+		if !canTimeOut(config) {
+			return nil, fmt.Errorf("lock strategy %q cannot time out: FeedTimeout is not available", config.LockStrategy)
 		}
-		// start the producer
-		producer(f, config.Decoder, config.Encoder, q, ctx)
+		p.feedTimeout = int((config.FeedTimeout + time.Millisecond - 1) / time.Millisecond)
+	}
+	if config.OrderedExecution {
+		p.order = newOrderTracker()
+	}
+	if config.MaxInFlightCost > 0 {
+		p.admission = semaphore.NewWeighted(int64(config.MaxInFlightCost))
+	}
+	for i:=0; i < config.ConsumersCount; i++{
+		p.syncCtx.consumers.Add(1)
+		// with work stealing, each consumer takes tasks from its own deque first
+		tasks := p.q
+		if deques, ok := p.q.(*queue.StealingQueue); ok {
+			tasks = deques.Worker(i)
+		}
+		go consumer(p, tasks)
+	}
+	return p, nil
+}
+
+// submit enqueues a request of client `c`, waking up a waiting consumer. With admission control, waits until
+// the cost of the request fits in the cost of the tasks in flight.
+// Obs: must not be called concurrently for the same client
+func (p *pipeline) submit(c *client, request *queue.Request) {
+	info := c.track()
+	request.Meta = info
+	if request.Command == "FEED" && request.Timeout == 0 {
+		request.Timeout = p.feedTimeout
+	}
+	if p.admission != nil {
+		info.cost = requestCost(p.users, request, p.admission.Capacity())
+		p.admission.Acquire(info.cost)
+	}
+	if p.order != nil {
+		p.mux.Lock()
+		info.order = p.order.track(request)
+		p.q.Enqueue(request)
+		p.mux.Unlock()
+	} else {
+		p.q.Enqueue(request)
 	}
 }
 
+// Close waits for the consumers to execute the remaining tasks and exit. No request may be submitted after Close.
+func (p *pipeline) Close() {
+	p.q.Close()
+	p.syncCtx.consumers.Wait()
+}
 
-func producer(f feed.Feed, dec *json.Decoder, enc *json.Encoder, q queue.Queue, ctx *SyncContext) {
+// producer reads requests of client `c` and submits them to the pipeline until the client sends a "DONE" request,
+// the requests cannot be decoded or `ctx` is cancelled. Tasks already submitted may still be running when it returns.
+func producer(ctx context.Context, c *client, p *pipeline) error {
+	r := newRequestReader(c.dec)
+	defer r.Close()
 	
-	// loops reading requests from os.Stdin until the client sends a "DONE" request 
+	// loops reading requests from the client until it sends a "DONE" request 
 	for {
-		// decode the request
-		request := &queue.Request{}
- 		err := dec.Decode(&request)
-		
+		// wait for the next request; if the server was cancelled, stop waiting
+		request, err := r.next(ctx)
 		if err != nil {
-			fmt.Printf("\nError decoding request: %s\n", err.Error())
-			return
+			return err
 		}
-		// if "DONE" command, wait for consumers to finish remaining tasks and shutdown the server
+		// if "DONE" command, stop reading requests
 		if request.Command == "DONE" {
-			ctx.wg.Wait()
-			return
+			return nil
 		}
-		// add a task to the wg and enqueue it
-		ctx.wg.Add(1)
-		q.Enqueue(request)
-
-		// signal the consumers that there is a new task
-		ctx.cond.Broadcast()
+		// enqueue the task
+		p.submit(c, request)
 	}
 }
 
-// consumer waits for tasks to be enqueued and executes them.
-func consumer(f feed.Feed, enc *json.Encoder, q queue.Queue, ctx *SyncContext) {	
+// consumer waits for tasks to be enqueued in `tasks` (the queue of the pipeline or the consumer's view of it)
+// and executes them. Returns once the pipeline is closed and there are no tasks left.
+func consumer(p *pipeline, tasks queue.Queue) {	
+	defer p.syncCtx.consumers.Done()
+	if p.batchSize > 1 {
+		consumeBatches(p, tasks)
+		return
+	}
 	for {
-		// try to dequeue a task
-		task := q.Dequeue()		
+		// take a task, waiting for the producer to enqueue one if the queue is empty
+		// Obs: consumers are not cancelled: on shutdown, they execute the remaining tasks and exit
+		task := tasks.DequeueWait(context.Background())
 		
-		// if the queue is empty, wait for the producer to enqueue a task
+		// the queue is closed and empty => the server is shutting down
 		if task == nil {
-			ctx.mux.Lock()
-			ctx.cond.Wait()
-			ctx.mux.Unlock()		
-		// if task retrieved, execute it, subtract from the wg and try to dequeue another task
-		} else {
-			execute(f, enc, task)
-			ctx.wg.Done()
+			return
 		}
+		executeTask(p, task)
+	}
+}
+
+// executeTask executes a task taken from the pipeline's queue: waits until the requests it depends on are executed,
+// if any, executes it and sends the response to the client who sent it
+func executeTask(p *pipeline, task *queue.Request) {
+	info := task.Meta.(*taskInfo)
+	if info.order != nil {
+		p.order.wait(info.order)
+	}
+	if task.Command == "STATS" {
+		// only the pipeline knows its queue
+		info.client.respond(info.seq, statsResponse(p.users, p.q, task))
+	} else {
+		info.client.execute(p.users, task, info.seq)
+	}
+	if info.order != nil {
+		p.order.done(info.order)
+	}
+	if p.admission != nil {
+		p.admission.Release(info.cost)
 	}
 }
 
 // execute executes a task = client request and sends the response to the client
-func execute(f feed.Feed, enc *json.Encoder, task *queue.Request) {
+// Obs: requests without a `user` refer to the feed of the default user "".
+func execute(users *feed.Registry, out responder, task *queue.Request) {
 	switch task.Command{
 	case "ADD":	
-		f.Add(task.Body, task.TimeStamp)
-		enc.Encode(Response{Success: true, Id: task.Id})
+		users.Feed(task.User).Add(task.Body, task.TimeStamp)
+		out.respond(Response{Success: true, Id: task.Id})
 
 	case "REMOVE":
-		success := f.Remove(task.TimeStamp)
-		enc.Encode(Response{Success: success, Id: task.Id})
+		success := users.Feed(task.User).Remove(task.TimeStamp)
+		out.respond(Response{Success: success, Id: task.Id})
 
 	case "CONTAINS":
-		success := f.Contains(task.TimeStamp)
-		enc.Encode(Response{Success: success, Id: task.Id})
+		success := users.Feed(task.User).Contains(task.TimeStamp)
+		out.respond(Response{Success: success, Id: task.Id})
 
 	case "FEED":
-		feedPosts := f.ReturnFeed()
-		enc.Encode(FeedResponse{Id: task.Id, Feed: feedPosts})
-		return
+		// a paged request returns only a range of the feed, and a request with a timeout may give up
+		// waiting for the lock of the feed; see page.go
+		if task.IsPaged() || task.Timeout > 0 {
+			ctx := context.Background()
+			if task.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(task.Timeout)*time.Millisecond)
+				defer cancel()
+			}
+			page, err := readPage(ctx, users.Feed(task.User), task)
+			switch {
+			case err == nil:
+				out.respond(page)
+			case errors.Is(err, context.DeadlineExceeded):
+				out.respond(Response{Success: false, Id: task.Id, Error: "timeout"})
+			default:
+				out.respond(Response{Success: false, Id: task.Id})
+			}
+			return
+		}
+		feedPosts := users.Feed(task.User).ReturnFeed()
+		out.respond(FeedResponse{Id: task.Id, Feed: feedPosts})
+
+	case "FOLLOW":
+		success := users.Follow(task.User, task.Followee)
+		out.respond(Response{Success: success, Id: task.Id})
+
+	case "UNFOLLOW":
+		success := users.Unfollow(task.User, task.Followee)
+		out.respond(Response{Success: success, Id: task.Id})
+
+	// TIMELINE merges the feeds of the user and of everyone the user follows
+	case "TIMELINE":
+		timeline := users.Timeline(task.User)
+		out.respond(FeedResponse{Id: task.Id, Feed: timeline})
+
+	// STATS returns the contention statistics of the locks of the feeds, if collected
+	// Obs: the pipeline answers it itself, with the counters of its queue (see executeTask)
+	case "STATS":
+		out.respond(statsResponse(users, nil, task))
 	}
 }
 
-// RunSequential runs the server in sequential mode
-func RunSequential(f feed.Feed, enc *json.Encoder, dec *json.Decoder) {
-	var request queue.Request
-	for {
-		// decode the request
- 		err := dec.Decode(&request)
+// statsResponse returns the response to a "STATS" request: the contention statistics of the locks of the feeds in
+// `users`, with the counters of the queue `q` if it keeps them (see queue.Instrumented). `q` may be nil.
+// Fails if the locks do not collect statistics.
+func statsResponse(users *feed.Registry, q queue.Queue, task *queue.Request) interface{} {
+	stats := users.LockStats()
+	if stats == nil {
+		return Response{Success: false, Id: task.Id}
+	}
+	response := StatsResponse{Id: task.Id, Locks: stats.Snapshot()}
+	if instrumented, ok := q.(queue.Instrumented); ok {
+		queueStats := instrumented.Stats()
+		response.Queue = &queueStats
+	}
+	return response
+}
 
+// RunSequential runs the server in sequential mode until the client sends a "DONE" request, the requests
+// cannot be decoded or `ctx` is cancelled
+func RunSequential(ctx context.Context, f *feed.Registry, enc *json.Encoder, dec *json.Decoder) error {
+	r := newRequestReader(dec)
+	defer r.Close()
+	for {
+		// wait for the next request; if the server was cancelled, stop waiting
+		request, err := r.next(ctx)
 		if err != nil {
-			fmt.Printf("\nError decoding request: %s\n", err.Error())
-			return
+			return err
 		}
 
 		// if "DONE" command, shutdown the server
 		if request.Command == "DONE" {
-			return
+			return nil
 		}
 
 		// execute the request
-		execute(f, enc, &request)
+		execute(f, encoderResponder{enc}, request)
 	}
 }
 
@@ -0,0 +1,738 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"proj2/feed"
+	"proj2/lock"
+	"proj2/queue"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runServer runs the server with `threads` consumers over the given requests (one json per line)
+// and returns the decoded responses and the error returned by RunContext
+func runServer(ctx context.Context, threads int, input io.Reader) ([]Response, error) {
+	return runConfig(ctx, Config{ConsumersCount: threads}, input)
+}
+
+// runConfig is like runServer, with the other fields of `config` (besides the encoder, decoder and mode) set by the caller
+func runConfig(ctx context.Context, config Config, input io.Reader) ([]Response, error) {
+	var output bytes.Buffer
+	config.Encoder = json.NewEncoder(&output)
+	config.Decoder = json.NewDecoder(input)
+	config.Mode = "p"
+	if config.ConsumersCount <= 1 {
+		config.Mode = "s"
+	}
+	err := RunContext(ctx, config)
+
+	var responses []Response
+	dec := json.NewDecoder(&output)
+	for {
+		var response Response
+		if dec.Decode(&response) != nil {
+			break
+		}
+		responses = append(responses, response)
+	}
+	return responses, err
+}
+
+// addRequests returns `n` "ADD" requests with ids [0, n), one per line
+func addRequests(n int) string {
+	var requests strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&requests, "{\"command\": \"ADD\", \"id\": %d, \"body\": \"post\", \"timestamp\": %d}\n", i, i)
+	}
+	return requests.String()
+}
+
+func TestRunDone(t *testing.T) {
+	for _, threads := range []int{1, 8} {
+		responses, err := runServer(context.Background(), threads, strings.NewReader(addRequests(100)+"{\"command\": \"DONE\"}\n"))
+		if err != nil {
+			t.Errorf("Expected no error after DONE. Got:%v", err)
+		}
+		if len(responses) != 100 {
+			t.Errorf("Expected 100 responses before shutting down. Got:%v", len(responses))
+		}
+	}
+}
+
+func TestRunDecodeErrorWaitsForTasks(t *testing.T) {
+	// the input ends without "DONE": the requests read so far must still be executed and answered
+	responses, err := runServer(context.Background(), 8, strings.NewReader(addRequests(1000)))
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF decoding error. Got:%v", err)
+	}
+	if len(responses) != 1000 {
+		t.Errorf("Expected 1000 responses before shutting down. Got:%v", len(responses))
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := runServer(ctx, 8, reader)
+		result <- err
+	}()
+
+	// the server keeps running while requests arrive; after cancelling, the next request is dropped
+	// Obs: the server may stop reading in the middle of the last write, so it is not waited for
+	io.WriteString(writer, addRequests(10))
+	cancel()
+	go io.WriteString(writer, addRequests(1))
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled. Got:%v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The server did not shut down after being cancelled")
+	}
+	writer.Close()
+}
+
+func TestRunContextCancelIdle(t *testing.T) {
+	// a server waiting for a request that never comes shuts down once cancelled, in both modes
+	for _, threads := range []int{1, 8} {
+		ctx, cancel := context.WithCancel(context.Background())
+		reader, writer := io.Pipe()
+
+		result := make(chan error, 1)
+		go func() {
+			_, err := runServer(ctx, threads, reader)
+			result <- err
+		}()
+		io.WriteString(writer, addRequests(10))
+		cancel()
+
+		select {
+		case err := <-result:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected context.Canceled. Got:%v", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d threads: the server waiting for a request did not shut down after being cancelled", threads)
+		}
+		// the reader goroutine, still blocked on the input, exits once it is closed
+		writer.Close()
+	}
+}
+
+func TestOrderedExecution(t *testing.T) {
+	// each post is added, checked, removed and checked again; with ordered execution the checks always
+	// see the effect of the requests sent before them
+	var requests strings.Builder
+	for i := 0; i < 500; i++ {
+		user := fmt.Sprintf("user%d", i%5)
+		fmt.Fprintf(&requests, "{\"command\": \"ADD\", \"id\": %d, \"user\": \"%s\", \"body\": \"post\", \"timestamp\": %d}\n", 4*i, user, i)
+		fmt.Fprintf(&requests, "{\"command\": \"CONTAINS\", \"id\": %d, \"user\": \"%s\", \"timestamp\": %d}\n", 4*i+1, user, i)
+		fmt.Fprintf(&requests, "{\"command\": \"REMOVE\", \"id\": %d, \"user\": \"%s\", \"timestamp\": %d}\n", 4*i+2, user, i)
+		fmt.Fprintf(&requests, "{\"command\": \"CONTAINS\", \"id\": %d, \"user\": \"%s\", \"timestamp\": %d}\n", 4*i+3, user, i)
+	}
+	requests.WriteString("{\"command\": \"DONE\"}\n")
+
+	responses, err := runConfig(context.Background(), Config{ConsumersCount: 8, OrderedExecution: true}, strings.NewReader(requests.String()))
+	if err != nil {
+		t.Fatalf("Expected no error after DONE. Got:%v", err)
+	}
+	if len(responses) != 2000 {
+		t.Fatalf("Expected 2000 responses. Got:%v", len(responses))
+	}
+	for _, response := range responses {
+		// ADD, CONTAINS and REMOVE succeed; the last CONTAINS fails
+		expected := response.Id%4 != 3
+		if response.Success != expected {
+			t.Errorf("Request %v: expected success=%v. Got:%v", response.Id, expected, response.Success)
+		}
+	}
+}
+
+func TestOrderedResponses(t *testing.T) {
+	// unknown commands have no response and must not hold back the responses after them
+	adds := addRequests(1000)
+	half := len(addRequests(500))
+	requests := adds[:half] + "{\"command\": \"UNKNOWN\", \"id\": -1}\n" + adds[half:] + "{\"command\": \"DONE\"}\n"
+
+	responses, err := runConfig(context.Background(), Config{ConsumersCount: 8, OrderedResponses: true}, strings.NewReader(requests))
+	if err != nil {
+		t.Fatalf("Expected no error after DONE. Got:%v", err)
+	}
+	if len(responses) != 1000 {
+		t.Fatalf("Expected 1000 responses. Got:%v", len(responses))
+	}
+	for i, response := range responses {
+		if response.Id != i {
+			t.Fatalf("Expected response %v to have id %v. Got:%v", i, i, response.Id)
+		}
+	}
+}
+
+func TestListen(t *testing.T) {
+	for _, address := range []string{"localhost:0", "http://localhost:0", "udp://localhost:0"} {
+		if _, err := Listen(address); err == nil {
+			t.Errorf("Expected an error for address %v", address)
+		}
+	}
+	for _, address := range []string{"tcp://127.0.0.1:0", "unix://" + filepath.Join(t.TempDir(), "twitter.sock")} {
+		l, err := Listen(address)
+		if err != nil {
+			t.Errorf("Expected no error for address %v. Got:%v", address, err)
+			continue
+		}
+		l.Close()
+	}
+}
+
+func TestServeClients(t *testing.T) {
+	l, err := Listen("tcp://127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- Serve(ctx, l, Config{Mode: "p", ConsumersCount: 4, OrderedResponses: true})
+	}()
+
+	// each client adds posts to its own user and checks them; the responses come back through its connection
+	const clients = 8
+	errs := make(chan error, clients)
+	for c := 0; c < clients; c++ {
+		go func(c int) {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer conn.Close()
+			enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+			for i := 0; i < 100; i++ {
+				enc.Encode(map[string]interface{}{"command": "ADD", "id": c*1000 + i, "user": fmt.Sprint(c), "body": "post", "timestamp": i})
+			}
+			enc.Encode(map[string]interface{}{"command": "FEED", "id": c*1000 + 100, "user": fmt.Sprint(c)})
+			enc.Encode(map[string]interface{}{"command": "DONE"})
+
+			for i := 0; i < 100; i++ {
+				var response Response
+				if err := dec.Decode(&response); err != nil || response.Id != c*1000+i || !response.Success {
+					errs <- fmt.Errorf("client %v: unexpected response %v (%v)", c, response, err)
+					return
+				}
+			}
+			var feedResponse FeedResponse
+			if err := dec.Decode(&feedResponse); err != nil || feedResponse.Id != c*1000+100 {
+				errs <- fmt.Errorf("client %v: unexpected feed response %v (%v)", c, feedResponse, err)
+				return
+			}
+			// the connection is closed after "DONE"
+			if err := dec.Decode(&feedResponse); err != io.EOF {
+				errs <- fmt.Errorf("client %v: expected the connection to be closed. Got:%v", c, err)
+				return
+			}
+			errs <- nil
+		}(c)
+	}
+	for c := 0; c < clients; c++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// a client still connected does not keep the server from shutting down
+	idle, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	// wait for the server to accept the idle connection
+	enc, dec := json.NewEncoder(idle), json.NewDecoder(idle)
+	enc.Encode(map[string]interface{}{"command": "CONTAINS", "id": 0, "timestamp": 0})
+	var response Response
+	dec.Decode(&response)
+
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled. Got:%v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The server did not shut down after being cancelled")
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	p, err := newSharedPipeline(Config{Mode: "p", ConsumersCount: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	handler := &httpHandler{p: p}
+
+	for _, test := range []struct {
+		method, target, body 	string
+		status 					int
+	}{
+		{"POST", "/posts", `{"body": "first", "timestamp": 1}`, http.StatusCreated},
+		{"POST", "/posts?user=ann", `{"body": "second", "timestamp": 2}`, http.StatusCreated},
+		{"POST", "/posts", `{"body": "no timestamp"}`, http.StatusBadRequest},
+		{"POST", "/posts", `not json`, http.StatusBadRequest},
+		{"GET", "/posts/1", "", http.StatusOK},
+		{"GET", "/posts/2", "", http.StatusNotFound},
+		{"GET", "/posts/2?user=ann", "", http.StatusOK},
+		{"GET", "/posts/abc", "", http.StatusBadRequest},
+		{"PUT", "/posts/1", "", http.StatusMethodNotAllowed},
+		{"GET", "/posts", "", http.StatusMethodNotAllowed},
+		{"DELETE", "/posts/1", "", http.StatusOK},
+		{"DELETE", "/posts/1", "", http.StatusNotFound},
+		{"GET", "/feed?user=ann", "", http.StatusOK},
+		{"GET", "/feed?limit=-1", "", http.StatusBadRequest},
+		{"GET", "/feed?cursor=%21", "", http.StatusBadRequest},
+		{"GET", "/unknown", "", http.StatusNotFound},
+	} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+		if recorder.Code != test.status {
+			t.Errorf("%v %v: expected status %v. Got:%v", test.method, test.target, test.status, recorder.Code)
+		}
+	}
+
+	// the feed is returned as in a "FEED" response
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/feed?user=ann", nil))
+	var response FeedResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Feed) != 1 || *response.Feed[0].Body != "second" {
+		t.Errorf("Expected the feed of ann to have 1 post. Got:%v", response.Feed)
+	}
+}
+
+func TestServeHTTPShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- ServeHTTP(ctx, l, Config{Mode: "p", ConsumersCount: 4})
+	}()
+
+	response, err := http.Post("http://"+l.Addr().String()+"/posts", "application/json", strings.NewReader(`{"body": "post", "timestamp": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status %v. Got:%v", http.StatusCreated, response.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled. Got:%v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("The server did not shut down after being cancelled")
+	}
+}
+
+func TestRequestCost(t *testing.T) {
+	created := 0
+	users := feed.NewRegistry(func() feed.Feed { created++; return feed.NewFeed() })
+	for i := 0; i < 10; i++ {
+		users.Feed("ann").Add("post", float64(i))
+		users.Feed("bob").Add("post", float64(i))
+	}
+	users.Follow("ann", "bob")
+	users.Follow("ann", "carol")
+	users.Follow("nobody", "dave")
+
+	for _, test := range []struct {
+		request 	queue.Request
+		cost 		int64
+	}{
+		{queue.Request{Command: "ADD", User: "ann"}, 1},
+		{queue.Request{Command: "FEED", User: "ann"}, 10},
+		{queue.Request{Command: "FEED", User: "ann", Limit: 3}, 3},
+		{queue.Request{Command: "FEED", User: "nobody"}, 1},
+		{queue.Request{Command: "TIMELINE", User: "ann"}, 15},
+		{queue.Request{Command: "TIMELINE", User: "nobody"}, 1},
+	} {
+		if cost := requestCost(users, &test.request, 15); cost != test.cost {
+			t.Errorf("%v of %v: expected cost %v. Got:%v", test.request.Command, test.request.User, test.cost, cost)
+		}
+	}
+	// the users without posts (nobody, carol and dave) still have no feed
+	if created != 2 {
+		t.Errorf("Expected only the feeds of ann and bob. Got:%v feeds", created)
+	}
+}
+
+func TestAdmissionControl(t *testing.T) {
+	// every request is eventually admitted, including the ones costing more than the maximum
+	var requests strings.Builder
+	requests.WriteString(addRequests(1000))
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&requests, "{\"command\": \"FEED\", \"id\": %d}\n", 1000+i)
+	}
+	requests.WriteString("{\"command\": \"DONE\"}\n")
+
+	responses, err := runConfig(context.Background(), Config{ConsumersCount: 8, MaxInFlightCost: 50}, strings.NewReader(requests.String()))
+	if err != nil {
+		t.Fatalf("Expected no error after DONE. Got:%v", err)
+	}
+	if len(responses) != 1100 {
+		t.Errorf("Expected 1100 responses. Got:%v", len(responses))
+	}
+}
+
+func TestBoundedQueue(t *testing.T) {
+	// the producer waits for room in a small queue; every request is still executed
+	for _, threads := range []int{2, 8} {
+		responses, err := runConfig(context.Background(), Config{ConsumersCount: threads, QueueCapacity: 4},
+			strings.NewReader(addRequests(2000)+"{\"command\": \"DONE\"}\n"))
+		if err != nil {
+			t.Errorf("Expected no error after DONE. Got:%v", err)
+		}
+		if len(responses) != 2000 {
+			t.Errorf("Expected 2000 responses. Got:%v", len(responses))
+		}
+	}
+}
+
+func TestPooledQueue(t *testing.T) {
+	for _, threads := range []int{2, 8} {
+		responses, err := runConfig(context.Background(), Config{ConsumersCount: threads, QueueStrategy: "pooled"},
+			strings.NewReader(addRequests(2000)+"{\"command\": \"DONE\"}\n"))
+		if err != nil {
+			t.Errorf("Expected no error after DONE. Got:%v", err)
+		}
+		if len(responses) != 2000 {
+			t.Errorf("Expected 2000 responses. Got:%v", len(responses))
+		}
+	}
+
+	if _, err := runConfig(context.Background(), Config{ConsumersCount: 2, QueueStrategy: "unknown"},
+		strings.NewReader("{\"command\": \"DONE\"}\n")); err == nil {
+		t.Error("Expected an error for an unknown queue strategy")
+	}
+}
+
+func TestUpgradableFeed(t *testing.T) {
+	for _, lockStrategy := range []string{"cond", "fair"} {
+		responses, err := runConfig(context.Background(), Config{ConsumersCount: 4, FeedStrategy: "upgradable",
+			LockStrategy: lockStrategy}, strings.NewReader(addRequests(2000)+"{\"command\": \"DONE\"}\n"))
+		if err != nil {
+			t.Errorf("Expected no error after DONE. Got:%v", err)
+		}
+		if len(responses) != 2000 {
+			t.Errorf("Expected 2000 responses. Got:%v", len(responses))
+		}
+	}
+
+	// the other locks have no upgradable read mode
+	_, err := runConfig(context.Background(), Config{ConsumersCount: 2, FeedStrategy: "upgradable",
+		LockStrategy: "sync"}, strings.NewReader("{\"command\": \"DONE\"}\n"))
+	if err == nil {
+		t.Error("Expected an error for the upgradable feed with the sync lock")
+	}
+}
+
+func TestLockStats(t *testing.T) {
+	input := addRequests(100) + "{\"command\": \"CONTAINS\", \"id\": 100, \"timestamp\": 5}\n" +
+		"{\"command\": \"STATS\", \"id\": 101}\n{\"command\": \"DONE\"}\n"
+	var output bytes.Buffer
+	err := RunContext(context.Background(), Config{Encoder: json.NewEncoder(&output),
+		Decoder: json.NewDecoder(strings.NewReader(input)), Mode: "s", LockStats: true})
+	if err != nil {
+		t.Fatalf("Expected no error after DONE. Got:%v", err)
+	}
+	// the sequential server answers in order: the statistics come last
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	var stats StatsResponse
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &stats); err != nil || stats.Id != 101 {
+		t.Fatalf("Expected the response to STATS. Got:%v (%v)", lines[len(lines)-1], err)
+	}
+	if stats.Locks.WriteAcquisitions != 100 || stats.Locks.ReadAcquisitions != 1 {
+		t.Errorf("Expected 100 writes and 1 read. Got:%+v", stats.Locks)
+	}
+	if stats.Queue != nil {
+		t.Errorf("Expected no queue counters in sequential mode. Got:%+v", stats.Queue)
+	}
+
+	// in parallel mode, the counters of the queue come with the statistics of the locks
+	output.Reset()
+	err = RunContext(context.Background(), Config{Encoder: json.NewEncoder(&output),
+		Decoder: json.NewDecoder(strings.NewReader(input)), Mode: "p", ConsumersCount: 2, LockStats: true})
+	if err != nil {
+		t.Fatalf("Expected no error after DONE. Got:%v", err)
+	}
+	stats = StatsResponse{}
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if strings.Contains(line, `"locks"`) {
+			json.Unmarshal([]byte(line), &stats)
+		}
+	}
+	if stats.Id != 101 || stats.Queue == nil {
+		t.Errorf("Expected the response to STATS with the counters of the queue. Got:%+v", stats)
+	}
+
+	// without statistics, STATS fails
+	responses, _ := runServer(context.Background(), 1, strings.NewReader("{\"command\": \"STATS\", \"id\": 1}\n"))
+	if len(responses) != 1 || responses[0].Success {
+		t.Errorf("Expected STATS to fail. Got:%v", responses)
+	}
+
+	// the instrumented lock has no upgradable read mode
+	_, err = runConfig(context.Background(), Config{FeedStrategy: "upgradable", LockStats: true},
+		strings.NewReader("{\"command\": \"DONE\"}\n"))
+	if err == nil {
+		t.Error("Expected an error for lock statistics with the upgradable feed")
+	}
+}
+
+func TestDebugLocks(t *testing.T) {
+	// the debug locks do not change the responses
+	for _, feedStrategy := range []string{"coarse", "optimistic"} {
+		responses, err := runConfig(context.Background(), Config{ConsumersCount: 4, FeedStrategy: feedStrategy,
+			DebugLocks: true, LockStats: true}, strings.NewReader(addRequests(500)+"{\"command\": \"DONE\"}\n"))
+		if err != nil {
+			t.Errorf("Expected no error after DONE. Got:%v", err)
+		}
+		if len(responses) != 500 {
+			t.Errorf("Expected 500 responses. Got:%v", len(responses))
+		}
+	}
+
+	// the debug lock has no upgradable read mode
+	_, err := runConfig(context.Background(), Config{FeedStrategy: "upgradable", DebugLocks: true},
+		strings.NewReader("{\"command\": \"DONE\"}\n"))
+	if err == nil {
+		t.Error("Expected an error for debug locks with the upgradable feed")
+	}
+}
+
+func TestFeedTimeout(t *testing.T) {
+	// every feed shares a lock, held by a long "writer"
+	rw := lock.NewRWLock()
+	users := feed.NewRegistry(func() feed.Feed { return feed.NewFeedWithLock(rw) })
+	users.Feed("").Add("post", 1)
+	var output bytes.Buffer
+	out := encoderResponder{json.NewEncoder(&output)}
+
+	rw.Lock()
+	start := time.Now()
+	execute(users, out, &queue.Request{Command: "FEED", Id: 1, Timeout: 20})
+	var response Response
+	if err := json.NewDecoder(&output).Decode(&response); err != nil || response.Success || response.Error != "timeout" {
+		t.Fatalf("Expected the FEED to time out. Got:%+v (%v)", response, err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected the FEED to wait for 20ms. Got:%v", elapsed)
+	}
+	if status := httpStatus("FEED", response); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 for a timeout. Got:%v", status)
+	}
+
+	// once the lock is released, the same request gets the whole feed
+	rw.Unlock()
+	output.Reset()
+	execute(users, out, &queue.Request{Command: "FEED", Id: 2, Timeout: 20})
+	var page FeedResponse
+	if err := json.NewDecoder(&output).Decode(&page); err != nil || page.Id != 2 || len(page.Feed) != 1 {
+		t.Errorf("Expected the feed with 1 post. Got:%+v (%v)", page, err)
+	}
+
+	// the pipeline gives its timeout (rounded up to the ms) to the FEED requests without one
+	p, err := newPipeline(users, Config{ConsumersCount: 1, FeedTimeout: 500 * time.Microsecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(json.NewEncoder(io.Discard), nil, false)
+	requests := []*queue.Request{{Command: "FEED"}, {Command: "FEED", Timeout: 30}, {Command: "CONTAINS"}}
+	for _, request := range requests {
+		p.submit(c, request)
+	}
+	if requests[0].Timeout != 1 || requests[1].Timeout != 30 || requests[2].Timeout != 0 {
+		t.Errorf("Expected the timeouts 1, 30 and 0. Got:%v, %v and %v", requests[0].Timeout, requests[1].Timeout,
+			requests[2].Timeout)
+	}
+	p.Close()
+	c.Close()
+
+	// the locks that cannot time out are rejected, also when wrapped; the feeds without a feed-wide lock are not
+	for _, config := range []Config{{LockStrategy: "atomic"}, {LockStrategy: "sync"},
+		{FeedStrategy: "optimistic", LockStrategy: "sync", LockStats: true}} {
+		config.FeedTimeout = time.Second
+		if _, err := newPipeline(users, config); err == nil {
+			t.Errorf("Expected an error for a FeedTimeout with the %q lock", config.LockStrategy)
+		}
+	}
+	for _, config := range []Config{{LockStrategy: "faster", LockStats: true}, {LockStrategy: "fair", DebugLocks: true},
+		{FeedStrategy: "skiplist", LockStrategy: "sync"}} {
+		config.FeedTimeout = time.Second
+		p, err := newPipeline(users, config)
+		if err != nil {
+			t.Errorf("Expected no error for a FeedTimeout with %+v. Got:%v", config, err)
+			continue
+		}
+		p.Close()
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	input := addRequests(2000) + "{\"command\": \"CONTAINS\", \"id\": 2000, \"timestamp\": 0}\n" +
+		"{\"command\": \"DONE\"}\n"
+	responses, err := runConfig(context.Background(), Config{ConsumersCount: 4, QueueStrategy: "priority"},
+		strings.NewReader(input))
+	if err != nil {
+		t.Errorf("Expected no error after DONE. Got:%v", err)
+	}
+	if len(responses) != 2001 {
+		t.Errorf("Expected 2001 responses. Got:%v", len(responses))
+	}
+
+	// the priority queue does not dequeue in submission order, which ordered execution relies on
+	_, err = runConfig(context.Background(), Config{ConsumersCount: 2, QueueStrategy: "priority",
+		OrderedExecution: true}, strings.NewReader("{\"command\": \"DONE\"}\n"))
+	if err == nil {
+		t.Error("Expected an error for the priority queue with ordered execution")
+	}
+}
+
+func TestWorkStealing(t *testing.T) {
+	for _, threads := range []int{2, 8} {
+		responses, err := runConfig(context.Background(), Config{ConsumersCount: threads, WorkStealing: true},
+			strings.NewReader(addRequests(2000)+"{\"command\": \"DONE\"}\n"))
+		if err != nil {
+			t.Errorf("Expected no error after DONE. Got:%v", err)
+		}
+		if len(responses) != 2000 {
+			t.Errorf("Expected 2000 responses. Got:%v", len(responses))
+		}
+	}
+
+	_, err := runConfig(context.Background(), Config{ConsumersCount: 2, WorkStealing: true, OrderedExecution: true},
+		strings.NewReader("{\"command\": \"DONE\"}\n"))
+	if err == nil {
+		t.Error("Expected an error for work stealing with ordered execution")
+	}
+}
+
+func TestBatching(t *testing.T) {
+	for _, threads := range []int{2, 8} {
+		responses, err := runConfig(context.Background(), Config{ConsumersCount: threads, BatchSize: 16},
+			strings.NewReader(addRequests(2000)+"{\"command\": \"DONE\"}\n"))
+		if err != nil {
+			t.Errorf("Expected no error after DONE. Got:%v", err)
+		}
+		if len(responses) != 2000 {
+			t.Errorf("Expected 2000 responses. Got:%v", len(responses))
+		}
+		for _, response := range responses {
+			if !response.Success {
+				t.Errorf("Expected every ADD to succeed. Got:%v", response)
+			}
+		}
+	}
+
+	_, err := runConfig(context.Background(), Config{ConsumersCount: 2, BatchSize: 16, OrderedExecution: true},
+		strings.NewReader("{\"command\": \"DONE\"}\n"))
+	if err == nil {
+		t.Error("Expected an error for batching with ordered execution")
+	}
+}
+
+func TestExecuteBatch(t *testing.T) {
+	// runs of mutations of the same user are applied in order, interleaved with the other requests
+	p, err := newPipeline(feed.NewRegistry(feed.NewFeed), Config{BatchSize: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	c := newClient(json.NewEncoder(&output), nil, true)
+	batch := []*queue.Request{
+		{Command: "ADD", Id: 0, User: "alice", TimeStamp: 1},
+		{Command: "ADD", Id: 1, User: "alice", TimeStamp: 2},
+		{Command: "REMOVE", Id: 2, User: "alice", TimeStamp: 1},
+		{Command: "CONTAINS", Id: 3, User: "alice", TimeStamp: 1},
+		{Command: "ADD", Id: 4, User: "bob", TimeStamp: 1},
+		{Command: "REMOVE", Id: 5, User: "alice", TimeStamp: 1},
+		{Command: "REMOVE", Id: 6, User: "bob", TimeStamp: 1},
+	}
+	for _, task := range batch {
+		task.Meta = c.track()
+	}
+	executeBatch(p, batch)
+	c.Close()
+	p.Close()
+
+	expected := []bool{true, true, true, false, true, false, true}
+	dec := json.NewDecoder(&output)
+	for id, success := range expected {
+		var response Response
+		if err := dec.Decode(&response); err != nil {
+			t.Fatalf("Expected %d responses. Got:%v", len(expected), id)
+		}
+		if response.Id != id || response.Success != success {
+			t.Errorf("Expected response %d to be %v. Got:%v", id, success, response)
+		}
+	}
+}
+
+func TestPagingDuplicateTimestamps(t *testing.T) {
+	// runs of posts with the same timestamp, longer and shorter than a page
+	f := feed.NewFeed()
+	timestamps := []float64{5, 4, 4, 4, 4, 4, 3, 3, 2}
+	for i, timestamp := range timestamps {
+		f.Add(strconv.Itoa(i), timestamp)
+	}
+
+	for limit := 1; limit <= len(timestamps); limit++ {
+		seen := map[string]bool{}
+		task := &queue.Request{Command: "FEED", Limit: limit}
+		for pages := 0; ; pages++ {
+			if pages > len(timestamps) {
+				t.Fatalf("Limit %d: too many pages", limit)
+			}
+			response, err := readPage(context.Background(), f, task)
+			if err != nil {
+				t.Fatalf("Limit %d: expected no error. Got:%v", limit, err)
+			}
+			for _, post := range response.Feed {
+				if seen[*post.Body] {
+					t.Errorf("Limit %d: post %s returned twice", limit, *post.Body)
+				}
+				seen[*post.Body] = true
+			}
+			if response.Cursor == "" {
+				break
+			}
+			task.Cursor = response.Cursor
+		}
+		if len(seen) != len(timestamps) {
+			t.Errorf("Limit %d: expected %d posts over all the pages. Got:%v", limit, len(timestamps), len(seen))
+		}
+	}
+}
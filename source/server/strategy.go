@@ -0,0 +1,154 @@
+// Strategies selectable from the server configuration: which feed implementation holds the posts
+// of each user, which r/w lock synchronizes the lock-based feeds and which queue holds the tasks.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"proj2/feed"
+	"proj2/lock"
+	"proj2/queue"
+	"sync"
+)
+
+// lockConstructor returns the constructor of the r/w lock named by `strategy`. The locks built by lock.NewRWLock
+// and lock.NewRWLockAtomic admit at most `maxReaders` readers at once: 0 means lock.DefaultMaxReaders, < 0 no limit.
+func lockConstructor(strategy string, maxReaders int) (func() lock.RWLock, error) {
+	var opts []lock.Option
+	if maxReaders != 0 {
+		opts = append(opts, lock.WithMaxReaders(maxReaders))
+	}
+	switch strategy {
+	case "", "cond":
+		return func() lock.RWLock { return lock.NewRWLock(opts...) }, nil
+	case "reader":
+		opts = append(opts, lock.WithPolicy(lock.ReaderPreferred))
+		return func() lock.RWLock { return lock.NewRWLock(opts...) }, nil
+	case "fair":
+		opts = append(opts, lock.WithPolicy(lock.FairPolicy))
+		return func() lock.RWLock { return lock.NewRWLock(opts...) }, nil
+	case "atomic":
+		return func() lock.RWLock { return lock.NewRWLockAtomic(opts...) }, nil
+	case "faster":
+		return lock.NewRWLockFaster, nil
+	case "sync":
+		return func() lock.RWLock { return &sync.RWMutex{} }, nil
+	}
+	return nil, fmt.Errorf("unknown lock strategy %q", strategy)
+}
+
+// canTimeOut returns whether the "FEED" requests can give up waiting for the lock of the feeds selected by
+// `config`: the feeds without a feed-wide lock never wait for one, and the lock-based feeds need a lock.TimedRWLock
+// (the instrumented and debug locks give up like the lock they wrap)
+func canTimeOut(config Config) bool {
+	switch config.FeedStrategy {
+	case "", "coarse", "optimistic", "upgradable":
+	default:
+		return true
+	}
+	newLock, err := lockConstructor(config.LockStrategy, config.MaxReaders)
+	if err != nil {
+		return false
+	}
+	_, ok := newLock().(lock.TimedRWLock)
+	return ok
+}
+
+// newRegistry creates the registry holding one feed per user, with the feed implementation and r/w lock
+// selected by `config`
+func newRegistry(config Config) (*feed.Registry, error) {
+	var stats *lock.Stats
+	if config.LockStats {
+		stats = lock.NewStats()
+	}
+	var watchdog *lock.Watchdog
+	if config.DebugLocks {
+		threshold := config.LockHoldThreshold
+		if threshold == 0 {
+			threshold = lock.DefaultHoldThreshold
+		}
+		watchdog = lock.NewWatchdog(threshold, func(dump string) { fmt.Fprint(os.Stderr, dump) })
+	}
+	newFeed, err := feedConstructor(config.FeedStrategy, config.LockStrategy, config.MaxReaders, stats, watchdog)
+	if err != nil {
+		return nil, err
+	}
+	return feed.NewRegistryWithStats(newFeed, stats), nil
+}
+
+// feedConstructor returns the constructor of the feed implementation named by `feedStrategy`.
+// Feeds that synchronize with a r/w lock get a new lock of kind `lockStrategy` (see lockConstructor), which
+// records its statistics in `stats` unless it is nil, and is a debug lock reporting to `watchdog` unless it is nil.
+func feedConstructor(feedStrategy string, lockStrategy string, maxReaders int, stats *lock.Stats,
+	watchdog *lock.Watchdog) (func() feed.Feed, error) {
+	newLock, err := lockConstructor(lockStrategy, maxReaders)
+	if err != nil {
+		return nil, err
+	}
+	if stats != nil {
+		// the instrumented lock has no upgradable read mode
+		if feedStrategy == "upgradable" {
+			return nil, fmt.Errorf("lock statistics are not available for the upgradable feed")
+		}
+		newPlainLock := newLock
+		newLock = func() lock.RWLock { return lock.NewInstrumentedRWLock(newPlainLock(), stats) }
+	}
+	if watchdog != nil {
+		// nor has the debug lock
+		if feedStrategy == "upgradable" {
+			return nil, fmt.Errorf("debug locks are not available for the upgradable feed")
+		}
+		newTrackedLock := newLock
+		newLock = func() lock.RWLock { return lock.NewDebugRWLock(newTrackedLock(), watchdog) }
+	}
+	switch feedStrategy {
+	case "", "coarse":
+		return func() feed.Feed { return feed.NewFeedWithLock(newLock()) }, nil
+	case "optimistic":
+		return func() feed.Feed { return feed.NewOptFeedWithLock(newLock()) }, nil
+	case "upgradable":
+		// only the locks built by lock.NewRWLock have an upgradable read mode
+		if _, ok := newLock().(lock.UpgradableRWLock); !ok {
+			return nil, fmt.Errorf("lock strategy %q has no upgradable read mode", lockStrategy)
+		}
+		return func() feed.Feed { return feed.NewUpgradableFeedWithLock(newLock().(lock.UpgradableRWLock)) }, nil
+	case "skiplist":
+		return feed.NewSkipListFeed, nil
+	case "fine":
+		return feed.NewFineFeed, nil
+	case "lazy":
+		return feed.NewLazyFeed, nil
+	case "lockfree":
+		return feed.NewLockFreeFeed, nil
+	}
+	return nil, fmt.Errorf("unknown feed strategy %q", feedStrategy)
+}
+
+// newQueue creates the queue of tasks named by `config.QueueStrategy`. `config.WorkStealing` selects the
+// work-stealing deques and a `config.QueueCapacity` > 0 the bounded queue, whatever the strategy.
+func newQueue(config Config) (queue.Queue, error) {
+	if config.WorkStealing {
+		// like the priority queue, the deques do not dequeue the tasks in the order they were enqueued
+		if config.OrderedExecution {
+			return nil, fmt.Errorf("work stealing cannot be used with ordered execution")
+		}
+		return queue.NewStealingQueue(config.ConsumersCount), nil
+	}
+	if config.QueueCapacity > 0 {
+		return queue.NewBoundedQueue(config.QueueCapacity), nil
+	}
+	switch config.QueueStrategy {
+	case "", "lockfree":
+		return queue.NewLockFreeQueue(), nil
+	case "pooled":
+		return queue.NewPooledQueue(), nil
+	case "priority":
+		// ordered execution relies on tasks being dequeued in the order they were enqueued (see order.go)
+		if config.OrderedExecution {
+			return nil, fmt.Errorf("queue strategy %q cannot be used with ordered execution", config.QueueStrategy)
+		}
+		return queue.NewPriorityQueue(config.QueueWeights), nil
+	}
+	return nil, fmt.Errorf("unknown queue strategy %q", config.QueueStrategy)
+}
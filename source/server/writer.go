@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// responder delivers the responses of executed requests back to the client
+type responder interface {
+	respond(response interface{})
+}
+
+// encoderResponder writes each response directly with the encoder. Only safe when a single
+// goroutine responds, i.e., in sequential mode.
+type encoderResponder struct {
+	enc 	*json.Encoder
+}
+
+func (r encoderResponder) respond(response interface{}) {
+	r.enc.Encode(response)
+}
+
+// responseWriter is the last stage of the parallel server: consumers hand their responses to it
+// and a single writer goroutine encodes them.
+// Obs: json.Encoder is not safe for concurrent use; with several consumers calling Encode on the same
+// encoder, the bytes of two responses could interleave on the output.
+type responseWriter struct {
+	enc 		*json.Encoder 		// the buffer to encode responses
+	mux 		sync.Mutex 			// protects `pending` and `closed`
+	cond 		*sync.Cond 			// signals the writer that there are responses to write
+	pending 	[]interface{} 		// responses waiting to be written
+	closed 		bool 				// no more responses will be sent
+	wg 			sync.WaitGroup 		// tracks the writer goroutine
+	next 		uint64 				// ordered responses: sequence number of the next response to write
+	early 		map[uint64]interface{} // ordered responses: responses waiting for the ones before them
+}
+
+// newResponseWriter creates a responseWriter and starts its writer goroutine
+func newResponseWriter(enc *json.Encoder) *responseWriter {
+	w := &responseWriter{enc: enc}
+	w.cond = sync.NewCond(&w.mux)
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// respond queues a response to be written
+func (w *responseWriter) respond(response interface{}) {
+	w.mux.Lock()
+	w.pending = append(w.pending, response)
+	w.cond.Signal()
+	w.mux.Unlock()
+}
+
+// respondAt queues the response of the request with sequence number `seq` (see order.go) to be written after
+// the responses of all requests before it. A nil response means the request has no response.
+// Obs: either every response is sent with respondAt or none is.
+func (w *responseWriter) respondAt(seq uint64, response interface{}) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if seq != w.next {
+		if w.early == nil {
+			w.early = make(map[uint64]interface{})
+		}
+		w.early[seq] = response
+		return
+	}
+	// the response is the next one: queue it and the ones that were waiting for it
+	for ok := true; ok; response, ok = w.early[w.next] {
+		delete(w.early, w.next)
+		if response != nil {
+			w.pending = append(w.pending, response)
+		}
+		w.next++
+	}
+	w.cond.Signal()
+}
+
+// sequencedResponder sends the response of one request through respondAt
+type sequencedResponder struct {
+	w 		*responseWriter
+	seq 	uint64 		// sequence number of the request
+	sent 	bool 		// whether the request got a response
+}
+
+func (r *sequencedResponder) respond(response interface{}) {
+	r.sent = true
+	r.w.respondAt(r.seq, response)
+}
+
+// run writes the queued responses until the writer is closed and there is nothing left to write.
+// Responses are taken in batches: the writer swaps the pending slice for an empty one, so consumers
+// only wait for the lock while the slices are swapped, never while responses are being encoded.
+func (w *responseWriter) run() {
+	defer w.wg.Done()
+	var batch []interface{}
+	for {
+		w.mux.Lock()
+		for len(w.pending) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if len(w.pending) == 0 && w.closed {
+			w.mux.Unlock()
+			return
+		}
+		batch, w.pending = w.pending, batch[:0]
+		w.mux.Unlock()
+
+		for i, response := range batch {
+			w.enc.Encode(response)
+			batch[i] = nil
+		}
+	}
+}
+
+// Close waits until all queued responses are written and stops the writer goroutine.
+// No response may be sent after Close.
+func (w *responseWriter) Close() {
+	w.mux.Lock()
+	w.closed = true
+	w.cond.Signal()
+	w.mux.Unlock()
+	w.wg.Wait()
+}
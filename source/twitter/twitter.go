@@ -1,37 +1,83 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"proj2/queue"
 	"proj2/server"
 	"strconv"
+	"strings"
 	// "runtime"
 )
 
+const usage = "Usage: twitter [-feed=strategy] [-lock=strategy] [-readers=n] [-lockstats] [-debuglocks] [-holdthreshold=duration] [-feedtimeout=duration] [-listen=address] [-http=address] [-queue=capacity] [-queuetype=strategy] [-weights=read,write,feed] [-steal] [-batch=size] [number of threads]\n" +
+	" -feed = the feed implementation: coarse (default), optimistic, upgradable, skiplist, fine, lazy, lockfree\n" +
+	" -lock = the r/w lock of the coarse, optimistic and upgradable feeds: cond (default), reader, fair, faster, atomic, sync\n" +
+	" -readers = the maximum number of readers holding the cond, reader, fair and atomic locks; 0 (default) means 32\n" +
+	" -lockstats = record the contention statistics of the locks of the feeds, returned by the STATS command\n" +
+	" -debuglocks = panic on misuse of the locks of the feeds and report the locks held for too long, with their waiters\n" +
+	" -holdthreshold = how long a lock is held before -debuglocks reports it, e.g. 100ms; 0 (default) means 1s\n" +
+	" -feedtimeout = how long a FEED request waits for the lock of the feed before failing, e.g. 50ms; 0 (default) means no limit\n" +
+	" -listen = serve clients over a socket instead of stdin/stdout: tcp://host:port or unix:///path\n" +
+	" -http = serve the REST API on a TCP address, e.g. :8080 (see server/http.go)\n" +
+	" -queue = the maximum number of requests waiting to be executed; 0 (default) means no limit\n" +
+	" -queuetype = the unbounded queue of requests: lockfree (default), pooled, priority\n" +
+	" -weights = the shares of reads, writes and feeds in the priority queue, e.g. 4,2,1 (default)\n" +
+	" -steal = give each consumer its own deque and let idle consumers steal from the others\n" +
+	" -batch = the maximum number of requests a consumer takes at once; 0 (default) means no batching\n" +
+	" number of threads = the number of consumers; if not given or 1, the server runs sequentially\n"
 
-func main() {
-	args := os.Args
 
+func main() {
 	// runtime.GOMAXPROCS(2)
-	
+
+	feedStrategy := flag.String("feed", "coarse", "feed implementation")
+	lockStrategy := flag.String("lock", "cond", "r/w lock of the lock-based feeds")
+	maxReaders := flag.Int("readers", 0, "maximum number of readers holding a r/w lock")
+	lockStats := flag.Bool("lockstats", false, "record contention statistics of the feed locks")
+	debugLocks := flag.Bool("debuglocks", false, "check the use of the feed locks and report long holds")
+	holdThreshold := flag.Duration("holdthreshold", 0, "hold time of a feed lock reported by -debuglocks")
+	feedTimeout := flag.Duration("feedtimeout", 0, "maximum wait of a FEED request for the lock of the feed")
+	listen := flag.String("listen", "", "address to accept clients on")
+	httpAddress := flag.String("http", "", "address to serve the REST API on")
+	queueCapacity := flag.Int("queue", 0, "capacity of the queue of requests")
+	queueStrategy := flag.String("queuetype", "lockfree", "implementation of the queue of requests")
+	weights := flag.String("weights", "", "shares of reads, writes and feeds in the priority queue")
+	workStealing := flag.Bool("steal", false, "per-consumer deques with work stealing")
+	batchSize := flag.Int("batch", 0, "maximum number of requests a consumer takes at once")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	args := flag.Args()
+
+	queueWeights, err := parseWeights(*weights)
+	if err != nil {
+		fmt.Printf("\nError %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	var mode string
 	var nConsumers int
 
-	
+
 	// retrieve the number of consumers from the command line
-	if len(args) != 2 {
+	if len(args) != 1 {
 		nConsumers = 1
 	} else {
-		nConsumers, _ = strconv.Atoi(args[1])
+		nConsumers, _ = strconv.Atoi(args[0])
 	}
-	 
+
 	// set the mode
 	if nConsumers > 1 {
 		mode = "p"
 	} else {
 		mode = "s"
 	}
-	
+
 	// encoder to send responses to the client via os.stdout
 	enc := json.NewEncoder(os.Stdout)
 	// decoder to read requests from the client via os.stdin
@@ -43,8 +89,63 @@ func main() {
 		Decoder: dec,
 		Mode: mode,
 		ConsumersCount: nConsumers,
+		FeedStrategy: *feedStrategy,
+		LockStrategy: *lockStrategy,
+		MaxReaders: *maxReaders,
+		LockStats: *lockStats,
+		DebugLocks: *debugLocks,
+		LockHoldThreshold: *holdThreshold,
+		FeedTimeout: *feedTimeout,
+		QueueCapacity: *queueCapacity,
+		QueueStrategy: *queueStrategy,
+		QueueWeights: queueWeights,
+		WorkStealing: *workStealing,
+		BatchSize: *batchSize,
 	}
-	
+
+	// deploy the server listening for clients until interrupted
+	if *listen != "" || *httpAddress != "" {
+		var l net.Listener
+		serve := server.Serve
+		if *httpAddress != "" {
+			serve = server.ServeHTTP
+			l, err = net.Listen("tcp", *httpAddress)
+		} else {
+			l, err = server.Listen(*listen)
+		}
+		if err != nil {
+			fmt.Printf("\nError %s\n", err.Error())
+			os.Exit(1)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := serve(ctx, l, conf); err != nil && ctx.Err() == nil {
+			fmt.Printf("\nError %s\n", err.Error())
+		}
+		return
+	}
+
 	// deploy the server
 	server.Run(conf)
 }
+
+// parseWeights parses the weights of the priority queue given as "read,write,feed".
+// An empty string gives the default weights.
+func parseWeights(s string) (queue.Weights, error) {
+	if s == "" {
+		return queue.DefaultWeights, nil
+	}
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return queue.Weights{}, fmt.Errorf("invalid weights %q: expected read,write,feed", s)
+	}
+	var values [3]int
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || value < 1 {
+			return queue.Weights{}, fmt.Errorf("invalid weights %q: weights must be positive integers", s)
+		}
+		values[i] = value
+	}
+	return queue.Weights{Read: values[0], Write: values[1], Feed: values[2]}, nil
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
 
 	//"io/ioutil"
 	"math/rand"
@@ -1104,3 +1106,97 @@ func TestAllRequestsXtraLarge(t *testing.T) {
 	rand.Shuffle(len(posts), func(i, j int) { posts[i], posts[j] = posts[j], posts[i] })
 	runAllRequests(threads, posts, t)
 }
+
+// ConcurrentResponsesWellFormed
+// Action(s):
+//  1. Spawns many consumers and sends a burst of "ADD" requests with long bodies mixed with "FEED" requests,
+//     so that many large responses are written at the same time by different consumers.
+//  2. Reads the output line by line and checks that every line is a single well-formed json response,
+//     i.e., bytes of different responses were not interleaved.
+//  3. Checks that every request got exactly one response and sends a Done request.
+func TestConcurrentResponsesWellFormed(t *testing.T) {
+
+	numOfThreadsStr := "32"
+	const numOfAdds = 500
+	const feedEvery = 10
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "go", "run", "twitter.go", numOfThreadsStr)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal("<ConcurrentResponsesWellFormed>: error in getting stdout pipe")
+	}
+	stdin, errIn := cmd.StdinPipe()
+	if errIn != nil {
+		t.Fatal("<ConcurrentResponsesWellFormed>: error in getting stdin pipe")
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal("<ConcurrentResponsesWellFormed> cmd.Start error in executing test")
+	}
+	inDone := make(chan bool)
+	outDone := make(chan bool)
+
+	// every "ADD" body is 1KB long, so "FEED" responses grow to hundreds of KB
+	body := strings.Repeat("x", 1024)
+	var numOfRequests int
+
+	go func() {
+		encoder := json.NewEncoder(stdin)
+		idx := 0
+		for i := 0; i < numOfAdds; i++ {
+			request := _TestAddRequest{"ADD", int64(idx), float64(i), body}
+			if err := encoder.Encode(&request); err != nil {
+				t.Error("<ConcurrentResponsesWellFormed> add cmd.encode error in executing test")
+			}
+			idx++
+			if i%feedEvery == 0 {
+				request := _TestFeedRequest{"FEED", int64(idx)}
+				if err := encoder.Encode(&request); err != nil {
+					t.Error("<ConcurrentResponsesWellFormed> feed cmd.encode error in executing test")
+				}
+				idx++
+			}
+		}
+		numOfRequests = idx
+		if err := encoder.Encode(&_TestDoneRequest{"DONE"}); err != nil {
+			t.Error("<ConcurrentResponsesWellFormed> done cmd.encode error in executing test")
+		}
+		inDone <- true
+	}()
+
+	go func() {
+		reader := bufio.NewReader(stdout)
+		seen := make(map[int64]bool)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			if !json.Valid(line) {
+				t.Errorf("Received a malformed response (responses interleaved?): %.80s...", line)
+				continue
+			}
+			var response struct {
+				Id int64 `json:"id"`
+			}
+			json.Unmarshal(line, &response)
+			if seen[response.Id] {
+				t.Errorf("Received more than one response for id:%v", response.Id)
+			}
+			seen[response.Id] = true
+		}
+		<-inDone
+		if len(seen) != numOfRequests {
+			t.Errorf("Did not receive the right amount of responses. Got:%v, Expected:%v", len(seen), numOfRequests)
+		}
+		outDone <- true
+	}()
+
+	<-outDone
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("The automated test timed out. You may have a deadlock, starvation issue and/or you did not implement" +
+			" the necessary code for passing this test.")
+	}
+}
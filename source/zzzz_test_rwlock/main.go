@@ -41,7 +41,7 @@ func main() {
 
 	var readWg, writeWg sync.WaitGroup
 	rw := lock.NewRWLock()
-	// rw := lock.NewRMWAtomicLock()
+	// rw := lock.NewRWLockAtomic()
 	
 	writerSpawned := 0
 	writerMax := 2